@@ -14,4 +14,24 @@ type backend interface {
 	ActiveAntiEntropy(*cluster, site, int)
 	NewVerifier(*cluster) verifier
 	FreeSpace() uint64
+	keyLister
+}
+
+// backends that know more about their storage than just the
+// free space can report it so it gets gossiped to the cluster
+type capacityReporter interface {
+	Capacity() uint64
+	BlobCount() int64
+}
+
+// backends that only hold copies of what's stored elsewhere in
+// the cluster. they get filled in on reads, and rebalancing
+// shouldn't move their copies around or count them as replicas
+type readCache interface {
+	CachesReads() bool
+}
+
+func cachesReads(b backend) bool {
+	c, ok := b.(readCache)
+	return ok && c.CachesReads()
 }
@@ -3,13 +3,12 @@ package main
 import (
 	_ "expvar"
 	"fmt"
-	"io"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"runtime"
 	"strings"
-	"strconv"
 	"time"
 
 	"github.com/hashicorp/memberlist"
@@ -19,9 +18,10 @@ import (
 )
 
 func makeHandler(fn func(http.ResponseWriter, *http.Request, *site), s *site) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
+	return instrument(func(w http.ResponseWriter, r *http.Request) {
+		requestCounter.Add(1)
 		fn(w, r, s)
-	}
+	})
 }
 
 var (
@@ -48,6 +48,15 @@ var (
 		Name: "cask_rebalance_delete_total",
 		Help: "Keys that were removed from the local node",
 	})
+	// merkle anti-entropy
+	merkleRangesCompared = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "cask_merkle_ranges_compared_total",
+		Help: "key ranges compared with another node",
+	})
+	merkleKeysRepaired = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "cask_merkle_keys_repaired_total",
+		Help: "keys copied to or from another node after a range comparison",
+	})
 	// cluster related
 	clusterJoins = prometheus.NewCounter(prometheus.CounterOpts{
 		Name: "cask_cluster_joins_total",
@@ -61,11 +70,80 @@ var (
 		Name: "cask_cluster_total",
 		Help: "total size of cluster",
 	})
+	ringVersionGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "cask_ring_version",
+		Help: "number of times the hash ring has been rebuilt",
+	})
+	// memory backend
+	memoryEvictions = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "cask_memory_evictions_total",
+		Help: "files thrown out of memory to make room for new ones",
+	})
+	// multiple disks
+	disksOffline = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "cask_disks_offline",
+		Help: "disks that have failed and been taken offline",
+	})
+	disksKeysRecovered = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "cask_disks_keys_recovered_total",
+		Help: "keys fetched back from other nodes after a disk failed",
+	})
+	// tiered storage
+	tierMigrations = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "cask_tier_migrations_total",
+		Help: "keys moved from this node to the cold nodes",
+	})
+	tierPromotions = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "cask_tier_promotions_total",
+		Help: "cold keys copied back to the hot nodes after being read",
+	})
+	// pack files
+	packBytesReclaimed = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "cask_pack_reclaimed_bytes_total",
+		Help: "space freed up by compacting pack files",
+	})
 	// disk space
 	diskFreeSpace = prometheus.NewGauge(prometheus.GaugeOpts{
 		Name: "cask_disk_free_bytes",
 		Help: "free disk space available to this node",
 	})
+	// http api
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "cask_http_requests_total",
+		Help: "requests handled, by route and status code",
+	}, []string{"route", "code"})
+	httpDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "cask_http_request_duration_seconds",
+		Help:    "how long requests took to handle, by route and status code",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "code"})
+	httpBytesIn = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "cask_http_request_bytes_total",
+		Help: "bytes read from request bodies, by route",
+	}, []string{"route"})
+	httpBytesOut = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "cask_http_response_bytes_total",
+		Help: "bytes written in responses, by route",
+	}, []string{"route"})
+	// calls to other nodes
+	peerDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "cask_peer_request_duration_seconds",
+		Help:    "how long requests to other nodes took, by peer and operation",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"peer", "op"})
+	peerErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "cask_peer_request_errors_total",
+		Help: "requests to other nodes that failed, by peer and operation",
+	}, []string{"peer", "op"})
+	clusterRetrieves = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "cask_cluster_retrieve_total",
+		Help: "files this node didn't have that it asked the rest of the cluster for, by whether it got them",
+	}, []string{"result"})
+	// verification
+	verifications = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "cask_verify_total",
+		Help: "files checked against their hash, by outcome (ok, corrupt, repaired, unrepairable)",
+	}, []string{"outcome"})
 )
 
 func init() {
@@ -75,11 +153,30 @@ func init() {
 	prometheus.MustRegister(rebalanceNoops)
 	prometheus.MustRegister(rebalanceDeletes)
 
+	prometheus.MustRegister(merkleRangesCompared)
+	prometheus.MustRegister(merkleKeysRepaired)
+
 	prometheus.MustRegister(clusterJoins)
 	prometheus.MustRegister(clusterLeaves)
 	prometheus.MustRegister(clusterTotal)
+	prometheus.MustRegister(ringVersionGauge)
 
+	prometheus.MustRegister(memoryEvictions)
+	prometheus.MustRegister(disksOffline)
+	prometheus.MustRegister(disksKeysRecovered)
+	prometheus.MustRegister(tierMigrations)
+	prometheus.MustRegister(tierPromotions)
+	prometheus.MustRegister(packBytesReclaimed)
 	prometheus.MustRegister(diskFreeSpace)
+
+	prometheus.MustRegister(httpRequests)
+	prometheus.MustRegister(httpDuration)
+	prometheus.MustRegister(httpBytesIn)
+	prometheus.MustRegister(httpBytesOut)
+	prometheus.MustRegister(peerDuration)
+	prometheus.MustRegister(peerErrors)
+	prometheus.MustRegister(clusterRetrieves)
+	prometheus.MustRegister(verifications)
 }
 
 type config struct {
@@ -88,12 +185,55 @@ type config struct {
 	UUID            string
 	Backend         string
 	DiskBackendRoot string `envconfig:"DISK_BACKEND_ROOT"`
+	HintsFile       string `envconfig:"HINTS_FILE"`
+	RebuildIndex    bool   `envconfig:"REBUILD_INDEX"`
 	KeepFree        uint64 `envconfig:"KEEP_FREE"`
 	MaxUploadSize   int64  `envconfig:"MAX_UPLOAD_SIZE"`
 
-	S3AccessKey string `envconfig:"S3_ACCESS_KEY"`
-	S3SecretKey string `envconfig:"S3_SECRET_KEY"`
-	S3Bucket    string `envconfig:"S3_BUCKET"`
+	DiskBackendRoots  string `envconfig:"DISK_BACKEND_ROOTS"`
+	DiskCheckInterval int    `envconfig:"DISK_CHECK_INTERVAL"`
+	DiskLayout        int    `envconfig:"DISK_LAYOUT"`
+
+	PackThreshold       int64 `envconfig:"PACK_THRESHOLD"`
+	PackSegmentSize     int64 `envconfig:"PACK_SEGMENT_SIZE"`
+	PackCompactInterval int   `envconfig:"PACK_COMPACT_INTERVAL"`
+
+	CapacityWeighted bool    `envconfig:"CAPACITY_WEIGHTED"`
+	Weight           float64 `envconfig:"WEIGHT"`
+	Zone             string  `envconfig:"ZONE"`
+	Rack             string  `envconfig:"RACK"`
+
+	StorageClass  string `envconfig:"STORAGE_CLASS"`
+	ColdAfter     int    `envconfig:"COLD_AFTER"`
+	PromoteOnRead bool   `envconfig:"PROMOTE_ON_READ"`
+	AccessFile    string `envconfig:"ACCESS_FILE"`
+	TierInterval  int    `envconfig:"TIER_INTERVAL"`
+
+	S3AccessKey     string `envconfig:"S3_ACCESS_KEY"`
+	S3SecretKey     string `envconfig:"S3_SECRET_KEY"`
+	S3Bucket        string `envconfig:"S3_BUCKET"`
+	S3Region        string `envconfig:"S3_REGION"`
+	S3Endpoint      string `envconfig:"S3_ENDPOINT"`
+	S3VirtualHosted bool   `envconfig:"S3_VIRTUAL_HOSTED"`
+	S3Prefix        string `envconfig:"S3_PREFIX"`
+
+	S3QuotaBytes    uint64 `envconfig:"S3_QUOTA_BYTES"`
+	S3QuotaObjects  int64  `envconfig:"S3_QUOTA_OBJECTS"`
+	S3UsageInterval int    `envconfig:"S3_USAGE_INTERVAL"`
+
+	MemoryMaxBytes    uint64 `envconfig:"MEMORY_MAX_BYTES"`
+	MemoryReadThrough bool   `envconfig:"MEMORY_READ_THROUGH"`
+
+	TraceExporter string `envconfig:"TRACE_EXPORTER"`
+	TraceEndpoint string `envconfig:"TRACE_ENDPOINT"`
+	TraceFile     string `envconfig:"TRACE_FILE"`
+
+	LogLevel  string `envconfig:"LOG_LEVEL"`
+	LogFormat string `envconfig:"LOG_FORMAT"`
+
+	EventsFile    string `envconfig:"EVENTS_FILE"`
+	EventsMaxSize int64  `envconfig:"EVENTS_MAX_SIZE"`
+	EventsMaxAge  int    `envconfig:"EVENTS_MAX_AGE"`
 
 	Port              int
 	GossipPort        int `envconfig:"GOSSIP_PORT"`
@@ -103,6 +243,7 @@ type config struct {
 	ClusterSecret     string `envconfig:"CLUSTER_SECRET"`
 	HeartbeatInterval int    `envconfig:"HEARTBEAT_INTERVAL"`
 	AAEInterval       int    `envconfig:"AAE_INTERVAL"`
+	MerkleAAEInterval int    `envconfig:"MERKLE_AAE_INTERVAL"`
 	MaxProcs          int    `envconfig:"MAX_PROCS"`
 	SSLCert           string `envconfig:"SSL_CERT"`
 	SSLKey            string `envconfig:"SSL_Key"`
@@ -111,6 +252,9 @@ type config struct {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "migrate-layout" {
+		os.Exit(migrateLayoutCommand(os.Args[2:]))
+	}
 	var c config
 	err := envconfig.Process("cask", &c)
 	if err != nil {
@@ -121,14 +265,31 @@ func main() {
 		c.MaxUploadSize = 2 * 1024 * 1024 * 1024
 	}
 	lc := newLogCache(200)
-	log.SetOutput(io.MultiWriter(os.Stderr, lc))
-	log.SetPrefix(c.UUID[:8] + " ")
+	if err := setupLogging(c.LogLevel, c.LogFormat, c.UUID[:8], lc); err != nil {
+		log.Fatal(err)
+	}
 	n := newNode(c.UUID, c.BaseURL, c.Writeable)
+	n.Weight = c.Weight
+	n.Zone = c.Zone
+	n.Rack = c.Rack
+	if c.StorageClass != "" && c.StorageClass != hotClass && c.StorageClass != coldClass {
+		log.Fatal("storage class has to be hot or cold")
+	}
+	n.StorageClass = c.StorageClass
+	if c.Backend == "memory" && c.MemoryReadThrough {
+		if c.StorageClass != "" {
+			log.Fatal("a read-through cache can't have a storage class")
+		}
+		n.StorageClass = cacheClass
+	}
+	if err := setupTracing(c.TraceExporter, c.TraceEndpoint, c.TraceFile, c.UUID); err != nil {
+		log.Fatal(err)
+	}
 
 	backend := setupBackend(c)
 
 	if c.MaxProcs > 0 {
-		log.Printf("max procs: %d\n", c.MaxProcs)
+		slog.Info("max procs", "procs", c.MaxProcs)
 		runtime.GOMAXPROCS(c.MaxProcs)
 	} else {
 		runtime.GOMAXPROCS(runtime.NumCPU())
@@ -138,20 +299,72 @@ func main() {
 		c.KeepFree = 10 * 1024 * 1024 * 1024
 	}
 	cluster := newCluster(n, c.ClusterSecret, c.HeartbeatInterval)
+	cluster.CapacityWeighted = c.CapacityWeighted
+	// memberlist won't gossip metadata over its limit, so catch
+	// zones, racks and URLs that are too long now
+	meta, dropped := cluster.nodeMeta(memberlist.MetaMaxSize)
+	if meta == nil {
+		log.Fatal("the UUID, base URL and cluster secret are too long to gossip")
+	}
+	if len(dropped) > 0 {
+		slog.Warn("node metadata is too big, leaving fields out", "op", "gossip", "fields", dropped)
+	}
+	hintsFiles := []string{c.HintsFile}
+	if c.HintsFile == "" && c.Backend == "disk" {
+		hintsFiles = []string{c.DiskBackendRoot + "hints.json"}
+		if j, ok := backend.(*jbodBackend); ok {
+			// a copy on every disk
+			hintsFiles = j.paths("hints.json")
+		}
+	}
+	if j, ok := backend.(*jbodBackend); ok {
+		if c.DiskCheckInterval == 0 {
+			c.DiskCheckInterval = 60
+		}
+		go j.WatchDisks(cluster, time.Duration(c.DiskCheckInterval)*time.Second)
+	}
+	cluster.handoff = newHintedHandoff(newHintStore(hintsFiles...), backend, c.ClusterSecret)
+	if c.EventsFile == "" && c.Backend == "disk" {
+		c.EventsFile = c.DiskBackendRoot + "events.log"
+		if j, ok := backend.(*jbodBackend); ok && len(j.online()) > 0 {
+			c.EventsFile = j.online()[0].Root + "events.log"
+		}
+	}
+	setupJournal(c)
 	err = startMemberList(cluster, c)
 	if err != nil {
 		log.Fatal("couldn't start gossip", err)
 	}
 	s := newSite(n, cluster, backend, c.Replication, c.MaxReplication, c.ClusterSecret, c.AAEInterval, c.MaxUploadSize, lc)
+	accessFiles := []string{c.AccessFile}
+	if c.AccessFile == "" && c.Backend == "disk" {
+		accessFiles = []string{c.DiskBackendRoot + "access.json"}
+		if j, ok := backend.(*jbodBackend); ok {
+			accessFiles = j.paths("access.json")
+		}
+	}
+	s.Tiering.ColdAfter = time.Duration(c.ColdAfter) * 24 * time.Hour
+	s.Tiering.PromoteOnRead = c.PromoteOnRead
+	s.Tiering.access = newAccessTracker(accessFiles...)
+	if c.TierInterval == 0 {
+		c.TierInterval = 3600
+	}
+	go s.TierMigration(time.Duration(c.TierInterval) * time.Second)
 	go s.ActiveAntiEntropy()
-	go n.WatchFreeSpace(c.KeepFree, backend)
+	if c.MerkleAAEInterval == 0 {
+		c.MerkleAAEInterval = 60
+	}
+	if c.MerkleAAEInterval > 0 {
+		go s.MerkleAntiEntropy(c.MerkleAAEInterval)
+	}
+	go cluster.WatchFreeSpace(c.KeepFree, backend)
 
-	log.Println("=== Cask Node starting ================")
-	log.Println("Root: " + c.DiskBackendRoot)
-	log.Println("UUID: " + c.UUID)
-	log.Println("Base URL: " + c.BaseURL)
-	log.Println("AAEInterval: " + strconv.Itoa(c.AAEInterval))
-	log.Println("=======================================")
+	slog.Info("cask node starting",
+		"root", c.DiskBackendRoot+c.DiskBackendRoots,
+		"uuid", c.UUID,
+		"base_url", c.BaseURL,
+		"aae_interval", c.AAEInterval,
+	)
 
 	http.HandleFunc("GET /", makeHandler(clusterInfoHandler, s))
 	http.HandleFunc("POST /", makeHandler(postFileHandler, s))
@@ -159,12 +372,26 @@ func main() {
 	http.HandleFunc("GET /local/", makeHandler(localPostFormHandler, s))
 	http.HandleFunc("POST /local/", makeHandler(handleLocalPost, s))
 	http.HandleFunc("GET /local/{key}/", makeHandler(localHandler, s))
+	http.HandleFunc("DELETE /local/{key}/", makeHandler(localDropHandler, s))
+	http.HandleFunc("GET /local/keys/", makeHandler(localKeysHandler, s))
 
 	http.HandleFunc("GET /file/{key}/", makeHandler(fileHandler, s))
+	http.HandleFunc("GET /keys/", makeHandler(clusterKeysHandler, s))
 	http.HandleFunc("GET /join/", makeHandler(joinFormHandler, s))
 	http.HandleFunc("POST /join/", makeHandler(joinHandler, s))
 	http.HandleFunc("GET /config/", makeHandler(configHandler, s))
+	http.HandleFunc("GET /status/", makeHandler(statusHandler, s))
+	http.HandleFunc("GET /cluster/health/", makeHandler(clusterHealthHandler, s))
+	http.HandleFunc("GET /drain/", makeHandler(drainHandler, s))
+	http.HandleFunc("POST /drain/", makeHandler(drainHandler, s))
+	http.HandleFunc("DELETE /drain/", makeHandler(drainHandler, s))
+	http.HandleFunc("GET /ring/", makeHandler(ringHandler, s))
+	http.HandleFunc("GET /ring/{key}/", makeHandler(ringKeyHandler, s))
+	http.HandleFunc("GET /ring/dryrun/", makeHandler(ringDryRunHandler, s))
+	http.HandleFunc("GET /aae/range/", makeHandler(aaeRangeHandler, s))
 	http.HandleFunc("GET /log/", makeHandler(logHandler, s))
+	http.HandleFunc("GET /log/stream/", makeHandler(logStreamHandler, s))
+	http.HandleFunc("GET /events/", makeHandler(eventsHandler, s))
 	http.HandleFunc("GET /upload/", makeHandler(uploadFormHandler, s))
 
 	http.HandleFunc("GET /favicon.ico", faviconHandler)
@@ -190,23 +417,130 @@ func main() {
 	}
 }
 
+func setupJournal(c config) {
+	if c.EventsFile == "" {
+		return
+	}
+	if c.EventsMaxSize == 0 {
+		// default to 10MB a file
+		c.EventsMaxSize = 10 * 1024 * 1024
+	}
+	if c.EventsMaxAge == 0 {
+		c.EventsMaxAge = 30
+	}
+	j, err := newJournal(c.EventsFile, c.EventsMaxSize, time.Duration(c.EventsMaxAge)*24*time.Hour)
+	if err != nil {
+		log.Fatal("couldn't open the event journal: ", err)
+	}
+	activeJournal.Store(j)
+}
+
 func setupBackend(c config) backend {
 	var backend backend
 	switch c.Backend {
 	case "disk":
-		backend = newDiskBackend(c.DiskBackendRoot)
+		if c.DiskBackendRoots != "" {
+			j := newJBODBackend(strings.Split(c.DiskBackendRoots, ","))
+			// disks that are offline now get this when they come back
+			err := j.Prepare(func(d *diskBackend) error {
+				if err := setupLayout(d, c); err != nil {
+					return err
+				}
+				return setupPacks(d, c)
+			})
+			if err != nil {
+				log.Fatal("refusing to start: ", err)
+			}
+			// now, rather than in the middle of the first upload
+			j.LoadIndex()
+			if c.RebuildIndex {
+				if err := j.RebuildIndex(); err != nil {
+					log.Fatal("couldn't rebuild the key index: ", err)
+				}
+			}
+			backend = j
+			break
+		}
+		d := newDiskBackend(c.DiskBackendRoot)
+		if err := setupLayout(d, c); err != nil {
+			log.Fatal("refusing to start: ", err)
+		}
+		if err := setupPacks(d, c); err != nil {
+			log.Fatal(err)
+		}
+		d.LoadIndex()
+		if c.RebuildIndex {
+			if err := d.RebuildIndex(); err != nil {
+				log.Fatal("couldn't rebuild the key index: ", err)
+			}
+		}
+		backend = d
 	case "s3":
-		if c.S3AccessKey == "" || c.S3SecretKey == "" || c.S3Bucket == "" {
-			log.Fatal("need S3 ACCESS_KEY, SECRET_KEY, and bucket all configured")
-		} else {
-			backend = newS3Backend(c.S3AccessKey, c.S3SecretKey, c.S3Bucket)
+		if c.S3Bucket == "" {
+			log.Fatal("need an S3 bucket configured")
+		}
+		b, err := newS3Backend(s3Config{
+			AccessKey: c.S3AccessKey,
+			SecretKey: c.S3SecretKey,
+			Bucket:    c.S3Bucket,
+			Region:    c.S3Region,
+			Endpoint:  c.S3Endpoint,
+			Prefix:    c.S3Prefix,
+
+			VirtualHosted: c.S3VirtualHosted,
+
+			QuotaBytes:   c.S3QuotaBytes,
+			QuotaObjects: c.S3QuotaObjects,
+		})
+		if err != nil {
+			log.Fatal("couldn't set up S3: ", err)
+		}
+		if c.S3UsageInterval == 0 {
+			c.S3UsageInterval = 3600
 		}
+		go b.WatchUsage(time.Duration(c.S3UsageInterval) * time.Second)
+		go b.RefreshAuth(s3AuthRefresh)
+		backend = b
+	case "memory":
+		if c.MemoryMaxBytes == 0 {
+			// default to 1GB
+			c.MemoryMaxBytes = 1024 * 1024 * 1024
+		}
+		m := newMemoryBackend(c.MemoryMaxBytes)
+		m.ReadThrough = c.MemoryReadThrough
+		backend = m
 	default:
 		log.Fatal("unsupported backend type")
 	}
 	return backend
 }
 
+func setupLayout(d *diskBackend, c config) error {
+	fresh := diskLayout(c.DiskLayout)
+	if fresh == 0 {
+		fresh = layoutDeep
+	}
+	return d.CheckLayout(fresh)
+}
+
+func setupPacks(d *diskBackend, c config) error {
+	if c.PackThreshold <= 0 {
+		return nil
+	}
+	if c.PackSegmentSize == 0 {
+		// default to 64MB
+		c.PackSegmentSize = 64 * 1024 * 1024
+	}
+	if c.PackCompactInterval == 0 {
+		c.PackCompactInterval = 3600
+	}
+	if err := d.EnablePacks(c.PackThreshold, c.PackSegmentSize); err != nil {
+		return fmt.Errorf("couldn't open pack files in %s: %w", d.Root, err)
+	}
+	go d.packs.CompactEvery(c.PackCompactInterval)
+	return nil
+}
+
 func startMemberList(cluster *cluster, conf config) error {
 	hostname, _ := os.Hostname()
 	c := memberlist.DefaultLocalConfig()
@@ -214,7 +548,8 @@ func startMemberList(cluster *cluster, conf config) error {
 	c.Name = hostname + "-" + fmt.Sprintf("%d", conf.GossipPort)
 	c.Delegate = cluster
 	c.Events = cluster
-	mlist, err := memberlist.Create(c)
+	var err error
+	mlist, err = memberlist.Create(c)
 	if err != nil {
 		return err
 	}
@@ -222,7 +557,7 @@ func startMemberList(cluster *cluster, conf config) error {
 		parts := strings.Split(conf.Neighbors, ",")
 		_, err := mlist.Join(parts)
 		if err != nil {
-			log.Println(err)
+			slog.Warn("couldn't join the cluster", "op", "gossip", "err", err)
 		}
 	}
 	broadcasts = &memberlist.TransmitLimitedQueue{
@@ -234,3 +569,14 @@ func startMemberList(cluster *cluster, conf config) error {
 
 	return nil
 }
+
+// push our current metadata (writeability, capacity, etc.)
+// out to the rest of the cluster
+func updateGossipMeta() {
+	if mlist == nil {
+		return
+	}
+	if err := mlist.UpdateNode(time.Second); err != nil {
+		slog.Warn("couldn't update gossip metadata", "op", "gossip", "err", err)
+	}
+}
@@ -1,9 +1,11 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
-	"log"
+	"log/slog"
+	"math"
 	"mime/multipart"
 	"sort"
 	"time"
@@ -11,6 +13,8 @@ import (
 	"github.com/hashicorp/memberlist"
 )
 
+// default number of positions on the ring for each node. a
+// node's weight scales this up or down.
 const replicas = 16
 
 type cluster struct {
@@ -19,6 +23,22 @@ type cluster struct {
 	neighbors         map[string]node
 	chF               chan func()
 	HeartbeatInterval int
+	// give nodes with bigger disks more of the ring
+	CapacityWeighted bool
+	// nil if hinted handoff isn't set up
+	handoff *hintedHandoff
+	// nodes that left recently. they still count as owners for
+	// hinted handoff in case they come back
+	departed map[string]node
+
+	// cached rings. only touched from the backend goroutine.
+	// ringSelf is what we looked like when it was built, since
+	// our own writeability can change underneath it.
+	ring        ringEntryList
+	writeRing   ringEntryList
+	ringVersion uint64
+	ringValid   bool
+	ringSelf    node
 }
 
 func newCluster(myself *node, secret string, heartbeatInterval int) *cluster {
@@ -31,6 +51,7 @@ func newCluster(myself *node, secret string, heartbeatInterval int) *cluster {
 		Myself:            myself,
 		secret:            secret,
 		neighbors:         make(map[string]node),
+		departed:          make(map[string]node),
 		chF:               make(chan func()),
 		HeartbeatInterval: heartbeatInterval,
 	}
@@ -39,24 +60,86 @@ func newCluster(myself *node, secret string, heartbeatInterval int) *cluster {
 	return c
 }
 
-func (c *cluster) jsonSerialize() []byte {
+func (c *cluster) heartbeat() heartbeat {
+	self := c.Self()
 	var hb = heartbeat{
-		UUID:      c.Myself.UUID,
-		BaseURL:   c.Myself.BaseURL,
-		Writeable: c.Myself.Writeable,
+		UUID:      self.UUID,
+		BaseURL:   self.BaseURL,
+		Writeable: self.Writeable,
 		Secret:    c.secret,
+		FreeSpace: self.FreeSpace,
+		Capacity:  self.Capacity,
+		BlobCount: self.BlobCount,
+		// nobody needs more than this, and it keeps the metadata small
+		Load:     math.Round(self.Load*100) / 100,
+		Weight:   self.Weight,
+		Zone:     self.Zone,
+		Rack:     self.Rack,
+		Draining: self.Draining,
+	}
+	if self.class() != hotClass {
+		hb.Class = self.StorageClass
 	}
-	b, _ := json.Marshal(hb)
+	return hb
+}
+
+func (c *cluster) jsonSerialize() []byte {
+	b, _ := json.Marshal(c.heartbeat())
 	return b
 }
 
+// the optional heartbeat fields, in the order they're left out
+// when there isn't room for everything. the least useful go first.
+// the storage class and draining flag change where files go, so
+// they always stay
+var optionalMeta = []struct {
+	name  string
+	clear func(*heartbeat)
+}{
+	{"blob_count", func(hb *heartbeat) { hb.BlobCount = 0 }},
+	{"load", func(hb *heartbeat) { hb.Load = 0 }},
+	{"capacity", func(hb *heartbeat) { hb.Capacity = 0 }},
+	{"free_space", func(hb *heartbeat) { hb.FreeSpace = 0 }},
+	{"weight", func(hb *heartbeat) { hb.Weight = 0 }},
+	{"rack", func(hb *heartbeat) { hb.Rack = "" }},
+	{"zone", func(hb *heartbeat) { hb.Zone = "" }},
+}
+
+// the heartbeat, cut down to fit in limit bytes, and which
+// fields had to go. nil if even the bare minimum doesn't fit
+func (c *cluster) nodeMeta(limit int) ([]byte, []string) {
+	hb := c.heartbeat()
+	var dropped []string
+	for i := 0; ; i++ {
+		b, _ := json.Marshal(hb)
+		if len(b) <= limit {
+			return b, dropped
+		}
+		if i == len(optionalMeta) {
+			return nil, dropped
+		}
+		optionalMeta[i].clear(&hb)
+		dropped = append(dropped, optionalMeta[i].name)
+	}
+}
+
 // implement memberlist.Delegate interface
 func (c *cluster) GetBroadcasts(overhead, limit int) [][]byte {
 	return broadcasts.GetBroadcasts(overhead, limit)
 }
 
+// memberlist panics if this is over limit, so fields get left out
+// rather than that
 func (c *cluster) NodeMeta(limit int) []byte {
-	return c.jsonSerialize()
+	b, dropped := c.nodeMeta(limit)
+	if b == nil {
+		slog.Error("node metadata doesn't fit even without the optional fields", "op", "gossip", "limit", limit)
+		return nil
+	}
+	if len(dropped) > 0 {
+		slog.Warn("node metadata is too big, leaving fields out", "op", "gossip", "fields", dropped, "limit", limit)
+	}
+	return b
 }
 
 func (c *cluster) NotifyMsg([]byte) {
@@ -71,11 +154,10 @@ func (c *cluster) MergeRemoteState(buf []byte, join bool) {
 	if err := json.Unmarshal(buf, &hb); err != nil {
 		return
 	}
-	n := node{
-		UUID: hb.UUID, BaseURL: hb.BaseURL, Writeable: hb.Writeable,
-		LastSeen: time.Now()}
+	n := hb.node()
 	if c.CheckSecret(hb.Secret) {
 		c.UpdateNeighbor(n)
+		c.replayHints(n)
 	}
 }
 
@@ -85,12 +167,11 @@ func (c *cluster) NotifyJoin(joinNode *memberlist.Node) {
 	if err := json.Unmarshal(joinNode.Meta, &hb); err != nil {
 		return
 	}
-	n := node{
-		UUID: hb.UUID, BaseURL: hb.BaseURL, Writeable: hb.Writeable,
-		LastSeen: time.Now()}
+	n := hb.node()
 	if c.CheckSecret(hb.Secret) {
 		c.AddNeighbor(n)
 		clusterJoins.Inc()
+		c.replayHints(n)
 	}
 }
 
@@ -99,9 +180,7 @@ func (c *cluster) NotifyLeave(leaveNode *memberlist.Node) {
 	if err := json.Unmarshal(leaveNode.Meta, &hb); err != nil {
 		return
 	}
-	n := node{
-		UUID: hb.UUID, BaseURL: hb.BaseURL, Writeable: hb.Writeable,
-		LastSeen: time.Now()}
+	n := hb.node()
 	if c.CheckSecret(hb.Secret) {
 		c.RemoveNeighbor(n)
 		clusterLeaves.Inc()
@@ -113,14 +192,22 @@ func (c *cluster) NotifyUpdate(updateNode *memberlist.Node) {
 	if err := json.Unmarshal(updateNode.Meta, &hb); err != nil {
 		return
 	}
-	n := node{
-		UUID: hb.UUID, BaseURL: hb.BaseURL, Writeable: hb.Writeable,
-		LastSeen: time.Now()}
+	n := hb.node()
 	if c.CheckSecret(hb.Secret) {
 		c.UpdateNeighbor(n)
+		c.replayHints(n)
 	}
 }
 
+// the node is alive, so if we've been holding any files for
+// it, now is the time to hand them over
+func (c *cluster) replayHints(n node) {
+	if c.handoff == nil || !n.Writeable || n.Draining {
+		return
+	}
+	c.handoff.Trigger(n)
+}
+
 // serialize all reads/writes through here
 func (c *cluster) backend() {
 	for f := range c.chF {
@@ -128,16 +215,50 @@ func (c *cluster) backend() {
 	}
 }
 
+// a copy of our own node. Myself is only changed from the
+// backend goroutine (see UpdateSelf), so it's read there too
+func (c *cluster) Self() node {
+	r := make(chan node)
+	go func() {
+		c.chF <- func() {
+			r <- *c.Myself
+		}
+	}()
+	return <-r
+}
+
+// change our own node, from the backend goroutine
+func (c *cluster) UpdateSelf(fn func(*node)) {
+	done := make(chan bool)
+	c.chF <- func() {
+		fn(c.Myself)
+		done <- true
+	}
+	<-done
+}
+
 func (c *cluster) AddNeighbor(n node) {
 	c.chF <- func() {
+		if _, ok := c.neighbors[n.UUID]; !ok {
+			publishClusterEvent(clusterJoin, n, n.BaseURL)
+		}
 		c.neighbors[n.UUID] = n
+		delete(c.departed, n.UUID)
+		c.ringValid = false
 		clusterTotal.Set(float64(len(c.neighbors)))
 	}
 }
 
 func (c *cluster) RemoveNeighbor(n node) {
 	c.chF <- func() {
-		delete(c.neighbors, n.UUID)
+		if old, ok := c.neighbors[n.UUID]; ok {
+			delete(c.neighbors, n.UUID)
+			c.ringValid = false
+			old.Writeable = false
+			old.LastFailed = time.Now()
+			c.departed[n.UUID] = old
+			publishClusterEvent(clusterLeave, old, "")
+		}
 		clusterTotal.Set(float64(len(c.neighbors)))
 	}
 }
@@ -168,7 +289,7 @@ type fResp struct {
 	Err bool
 }
 
-func (c cluster) FindNeighborByUUID(uuid string) (*node, bool) {
+func (c *cluster) FindNeighborByUUID(uuid string) (*node, bool) {
 	r := make(chan fResp)
 	go func() {
 		c.chF <- func() {
@@ -183,11 +304,26 @@ func (c cluster) FindNeighborByUUID(uuid string) (*node, bool) {
 func (c *cluster) UpdateNeighbor(neighbor node) {
 	c.chF <- func() {
 		if n, ok := c.neighbors[neighbor.UUID]; ok {
+			if n.Writeable != neighbor.Writeable {
+				publishClusterEvent(writeability(neighbor.Writeable), neighbor, "")
+			}
 			n.BaseURL = neighbor.BaseURL
 			n.Writeable = neighbor.Writeable
+			n.FreeSpace = neighbor.FreeSpace
+			n.Capacity = neighbor.Capacity
+			n.BlobCount = neighbor.BlobCount
+			n.Load = neighbor.Load
+			n.Weight = neighbor.Weight
+			n.Zone = neighbor.Zone
+			n.Rack = neighbor.Rack
+			n.Draining = neighbor.Draining
+			n.StorageClass = neighbor.StorageClass
 			if neighbor.LastSeen.Sub(n.LastSeen) > 0 {
 				n.LastSeen = neighbor.LastSeen
 			}
+			if c.ringAttributesDiffer(c.neighbors[neighbor.UUID], n) {
+				c.ringValid = false
+			}
 			c.neighbors[neighbor.UUID] = n
 		}
 	}
@@ -196,6 +332,11 @@ func (c *cluster) UpdateNeighbor(neighbor node) {
 func (c *cluster) FailedNeighbor(neighbor node) {
 	c.chF <- func() {
 		if n, ok := c.neighbors[neighbor.UUID]; ok {
+			if n.Writeable {
+				c.ringValid = false
+				// only when it goes down, not every failed call after
+				publishClusterEvent(clusterFailed, n, "")
+			}
 			n.Writeable = false
 			n.LastFailed = time.Now()
 			c.neighbors[neighbor.UUID] = n
@@ -207,7 +348,7 @@ type listResp struct {
 	Ns []node
 }
 
-func (c cluster) NeighborsInclusive() []node {
+func (c *cluster) NeighborsInclusive() []node {
 	r := make(chan listResp)
 	go func() {
 		c.chF <- func() {
@@ -229,7 +370,7 @@ func (c cluster) NeighborsInclusive() []node {
 	return resp.Ns
 }
 
-func (c cluster) WriteableNeighbors() []node {
+func (c *cluster) WriteableNeighbors() []node {
 	var all = c.NeighborsInclusive()
 	var p []node // == nil
 	for _, i := range all {
@@ -251,114 +392,289 @@ func (p ringEntryList) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
 func (p ringEntryList) Len() int           { return len(p) }
 func (p ringEntryList) Less(i, j int) bool { return p[i].Hash < p[j].Hash }
 
-func (c cluster) Ring() ringEntryList {
-	// TODO: cache the ring so we don't have to regenerate
-	// every time. it only changes when a node joins or leaves
-	return neighborsToRing(c.NeighborsInclusive())
+func (c *cluster) Ring() ringEntryList {
+	r, _ := c.currentRing()
+	return r.all
+}
+
+func (c *cluster) WriteRing() ringEntryList {
+	r, _ := c.currentRing()
+	return r.writeable
+}
+
+// bumped every time the ring is rebuilt. handy for debugging
+// whether two nodes see the same ring
+func (c *cluster) RingVersion() uint64 {
+	_, v := c.currentRing()
+	return v
 }
 
-func (c cluster) WriteRing() ringEntryList {
-	return neighborsToRing(c.WriteableNeighbors())
+type rings struct {
+	all       ringEntryList
+	writeable ringEntryList
 }
 
-func neighborsToRing(neighbors []node) ringEntryList {
-	keys := make(ringEntryList, replicas*len(neighbors))
-	for i := range neighbors {
-		node := neighbors[i]
-		nkeys := node.HashKeys()
-		for j := range nkeys {
-			keys[i*replicas+j] = ringEntry{Node: node, Hash: nkeys[j]}
+type ringResp struct {
+	R       rings
+	Version uint64
+}
+
+func (c *cluster) currentRing() (rings, uint64) {
+	r := make(chan ringResp)
+	go func() {
+		c.chF <- func() {
+			c.refreshRing()
+			r <- ringResp{rings{c.ring, c.writeRing}, c.ringVersion}
+		}
+	}()
+	resp := <-r
+	return resp.R, resp.Version
+}
+
+// only call from the backend goroutine. the rings that get
+// handed out are never modified afterwards, so they can be
+// shared.
+func (c *cluster) refreshRing() {
+	if c.ringValid && !c.ringAttributesDiffer(c.ringSelf, *c.Myself) {
+		return
+	}
+	all := make([]node, 0, len(c.neighbors)+1)
+	all = append(all, *c.Myself)
+	for _, n := range c.neighbors {
+		all = append(all, n)
+	}
+	c.ring = neighborsToRing(all, c.CapacityWeighted)
+	// built from the full ring so that capacity weighting
+	// comes out the same as it does for reads. draining nodes
+	// are on their way out, so they don't get new writes, and
+	// cold nodes only get what's moved to them.
+	c.writeRing = nil
+	for _, r := range c.ring {
+		if r.Node.Writeable && !r.Node.Draining && r.Node.class() == hotClass {
+			c.writeRing = append(c.writeRing, r)
+		}
+	}
+	c.ringSelf = *c.Myself
+	c.ringValid = true
+	c.ringVersion++
+	ringVersionGauge.Set(float64(c.ringVersion))
+}
+
+// whether the difference between two versions of a node
+// affects where it sits on the ring
+func (c *cluster) ringAttributesDiffer(a, b node) bool {
+	return a.Writeable != b.Writeable ||
+		a.Weight != b.Weight ||
+		a.Zone != b.Zone ||
+		a.Rack != b.Rack ||
+		a.Draining != b.Draining ||
+		a.class() != b.class() ||
+		(c.CapacityWeighted && a.Capacity != b.Capacity)
+}
+
+func neighborsToRing(all []node, capacityWeighted bool) ringEntryList {
+	var neighbors []node
+	for _, n := range all {
+		if n.class() != cacheClass {
+			neighbors = append(neighbors, n)
+		}
+	}
+	counts := virtualNodeCounts(neighbors, capacityWeighted)
+	var keys ringEntryList
+	for i, node := range neighbors {
+		for _, h := range node.hashKeysN(counts[i]) {
+			keys = append(keys, ringEntry{Node: node, Hash: h})
 		}
 	}
 	sort.Sort(keys)
 	return keys
 }
 
+// how many positions on the ring each node gets. normally
+// that's set by the node's weight, but with capacity weighting
+// that is further scaled by its capacity relative to the
+// average. nodes that haven't reported a capacity yet are
+// left unscaled.
+func virtualNodeCounts(neighbors []node, capacityWeighted bool) []int {
+	counts := make([]int, len(neighbors))
+	var total uint64
+	var known int
+	for _, n := range neighbors {
+		if n.Capacity > 0 {
+			total += n.Capacity
+			known++
+		}
+	}
+	for i, n := range neighbors {
+		counts[i] = n.VirtualNodes()
+		if !capacityWeighted || known == 0 || n.Capacity == 0 {
+			continue
+		}
+		mean := float64(total) / float64(known)
+		v := int(math.Round(float64(counts[i]) * float64(n.Capacity) / mean))
+		if v < 1 {
+			v = 1
+		}
+		counts[i] = v
+	}
+	return counts
+}
+
 // returns the list of all nodes in the order
 // that the given hash will choose to write to them
-func (c cluster) WriteOrder(hash string) []node {
-	return hashOrder(hash, len(c.GetNeighbors())+1, c.WriteRing())
+func (c *cluster) WriteOrder(hash string) []node {
+	return c.order(hash, true)
 }
 
 // returns the list of all nodes in the order
 // that the given hash will choose to try to read from them
-func (c cluster) ReadOrder(hash string) []node {
-	return hashOrder(hash, len(c.GetNeighbors())+1, c.Ring())
+func (c *cluster) ReadOrder(hash string) []node {
+	return c.order(hash, false)
+}
+
+// like ReadOrder, but only the nodes in one storage class
+func (c *cluster) ClassOrder(hash, class string) []node {
+	var results []node
+	for _, n := range c.ReadOrder(hash) {
+		if n.class() == class {
+			results = append(results, n)
+		}
+	}
+	return results
+}
+
+func (c *cluster) order(hash string, write bool) []node {
+	r := make(chan listResp)
+	go func() {
+		c.chF <- func() {
+			c.refreshRing()
+			ring := c.ring
+			if write {
+				ring = c.writeRing
+			}
+			r <- listResp{c.liveNodes(hashOrder(hash, len(c.neighbors)+1, ring))}
+		}
+	}()
+	resp := <-r
+	return resp.Ns
+}
+
+// the ring only gets rebuilt when placement changes, so its
+// copies of the nodes can be out of date on everything else
+// (last seen, etc.). only call from the backend goroutine.
+func (c *cluster) liveNodes(nodes []node) []node {
+	for i := range nodes {
+		if nodes[i].UUID == c.Myself.UUID {
+			nodes[i] = *c.Myself
+		} else if n, ok := c.neighbors[nodes[i].UUID]; ok {
+			nodes[i] = n
+		}
+	}
+	return nodes
 }
 
 func hashOrder(hash string, size int, ring []ringEntry) []node {
-	// our approach is to find the first bucket after our hash,
-	// partition the ring on that and put the first part on the
-	// end. Then go through and extract the ordering.
+	// find the first bucket after our hash, then go around the
+	// ring from there (wrapping past the end) and extract the
+	// ordering.
 
 	// so, with a ring of [1,2,3,4,5,6,7,8,9,10]
-	// and a hash of 7, we partition it into
-	// [1,2,3,4,5,6] and [7,8,9,10]
-	// then recombine them into
-	// [7,8,9,10] + [1,2,3,4,5,6]
+	// and a hash of 7, we start at 7 and go
 	// [7,8,9,10,1,2,3,4,5,6]
-	var partitionIndex = 0
-	for i, r := range ring {
-		// TODO: how will we support other hash types?
-		if "sha1:"+r.Hash > hash {
-			partitionIndex = i
-			break
-		}
+	// TODO: how will we support other hash types?
+	start := sort.Search(len(ring), func(i int) bool {
+		return "sha1:"+ring[i].Hash > hash
+	})
+	if start == len(ring) {
+		start = 0
 	}
-	// yay, slices
-	reordered := append(ring[partitionIndex:], ring[:partitionIndex]...)
 
 	results := make([]node, size)
 	var seen = map[string]bool{}
 	var i = 0
-	for _, r := range reordered {
+	for j := 0; j < len(ring) && i < size; j++ {
+		r := ring[(start+j)%len(ring)]
 		if !seen[r.Node.UUID] {
 			results[i] = r.Node
 			i++
 			seen[r.Node.UUID] = true
 		}
 	}
+	// then make sure the replicas end up in different
+	// zones/racks where possible
+	copy(results, spreadFailureDomains(results[:i]))
 	return results
 }
 
 func (c *cluster) Retrieve(key key) ([]byte, error) {
+	return c.RetrieveContext(context.Background(), key)
+}
+
+func (c *cluster) RetrieveContext(ctx context.Context, key key) (_ []byte, err error) {
+	ctx, sp := startSpan(ctx, "cluster retrieve")
+	sp.SetAttr("cask.key", key.String())
+	defer func() { sp.Finish(err) }()
 	// we don't have the full-size, so check the cluster
 	nodesToCheck := c.ReadOrder(key.String())
 	// this is where we go down the list and ask the other
 	// nodes for the image
 	// TODO: parallelize this
+	l := logger(ctx).With("key", key.String(), "op", "retrieve")
 	for _, n := range nodesToCheck {
 		if n.UUID == c.Myself.UUID {
 			// checking ourself would be silly
 			continue
 		}
-		log.Printf("ask node %s for it\n", n.UUID)
-		f, err := n.Retrieve(key, c.secret)
+		f, err := n.RetrieveContext(ctx, key, c.secret)
 		if err == nil {
 			// got it, return it
-			log.Println("   they had it")
+			l.Debug("peer had it", "peer", n.UUID)
+			clusterRetrieves.WithLabelValues("found").Inc()
 			return f, nil
 		}
-		log.Println("   they didn't have it. try another")
+		l.Debug("peer didn't have it, trying another", "peer", n.UUID)
 		// that node didn't have it so we keep going
 	}
+	l.Info("not found in the cluster")
+	clusterRetrieves.WithLabelValues("not_found").Inc()
 	return nil, errors.New("not found in the cluster")
 }
 
 func (c *cluster) AddFile(key key, f multipart.File, replication int, minReplication int) bool {
+	return c.AddFileContext(context.Background(), key, f, replication, minReplication)
+}
+
+func (c *cluster) AddFileContext(ctx context.Context, key key, f multipart.File, replication int, minReplication int) bool {
+	ctx, sp := startSpan(ctx, "cluster add file")
+	sp.SetAttr("cask.key", key.String())
+	defer sp.Finish(nil)
 	nodes := c.WriteOrder(key.String())
+	// any of the nodes that should own the file that are down
+	// get a hint left with whichever node takes their place
+	owners, missed := c.owners(key, replication)
 	var saveCount = 0
 	for _, n := range nodes {
 		if n.BaseURL == "" {
 			continue
 		}
 		if n.Writeable {
-			if n.AddFile(key, f, c.secret) {
+			hintFor := ""
+			if !owners[n.UUID] && len(missed) > 0 {
+				hintFor = missed[0].UUID
+			}
+			if n.AddFileWithHint(ctx, key, f, c.secret, hintFor) {
+				recordEvent(eventReplicated, key, n.UUID, "upload")
 				saveCount++
 				n.LastSeen = time.Now()
 				c.UpdateNeighbor(n)
+				if hintFor != "" {
+					missed = missed[1:]
+				}
 			} else {
 				c.FailedNeighbor(n)
+				if owners[n.UUID] {
+					missed = append(missed, n)
+				}
 			}
 			_, _ = f.Seek(0, 0)
 			if saveCount >= replication {
@@ -366,18 +682,117 @@ func (c *cluster) AddFile(key key, f multipart.File, replication int, minReplica
 			}
 		}
 	}
+	if saveCount < minReplication {
+		logger(ctx).Warn("couldn't write enough copies", "key", key.String(),
+			"op", "add_file", "copies", saveCount, "needed", minReplication)
+	}
 	return saveCount >= minReplication
 }
 
+// how long a node that has left the cluster keeps getting
+// hints written for it
+const hintWindow = 3 * time.Hour
+
+// the nodes that would hold the first `replication` copies of
+// the key if everything was up, and the ones among them that
+// are known to be down right now
+func (c *cluster) owners(key key, replication int) (map[string]bool, []node) {
+	owners := make(map[string]bool)
+	var down []node
+	for _, n := range c.ownerOrder(key.String()) {
+		if len(owners) >= replication {
+			break
+		}
+		if n.UUID == "" || n.Draining {
+			continue
+		}
+		owners[n.UUID] = true
+		if !n.Writeable && n.Unhealthy() {
+			down = append(down, n)
+		}
+	}
+	return owners, down
+}
+
+// like ReadOrder, but nodes that have recently left are put
+// back on the ring
+func (c *cluster) ownerOrder(hash string) []node {
+	r := make(chan listResp)
+	go func() {
+		c.chF <- func() {
+			c.refreshRing()
+			ring := c.ring
+			size := len(c.neighbors) + 1
+			var recent []node
+			for uuid, n := range c.departed {
+				if time.Since(n.LastFailed) > hintWindow {
+					delete(c.departed, uuid)
+					continue
+				}
+				recent = append(recent, n)
+			}
+			if len(recent) > 0 {
+				all := append([]node{*c.Myself}, recent...)
+				for _, n := range c.neighbors {
+					all = append(all, n)
+				}
+				ring = neighborsToRing(all, c.CapacityWeighted)
+				size += len(recent)
+			}
+			r <- listResp{c.liveNodes(hashOrder(hash, size, ring))}
+		}
+	}()
+	resp := <-r
+	return resp.Ns
+}
+
 type heartbeat struct {
 	UUID      string `json:"uuid"`
 	BaseURL   string `json:"base_url"`
 	Writeable bool   `json:"writeable"`
 	Secret    string `json:"secret"`
 
+	// everything else has to squeeze into memberlist's 512 bytes of
+	// node metadata too, so the names are short and anything unset
+	// is left out
+
+	// capacity and load
+	FreeSpace uint64  `json:"fs,omitempty"`
+	Capacity  uint64  `json:"cap,omitempty"`
+	BlobCount int64   `json:"bc,omitempty"`
+	Load      float64 `json:"ld,omitempty"`
+
+	Weight float64 `json:"wt,omitempty"`
+	// failure domain labels
+	Zone string `json:"z,omitempty"`
+	Rack string `json:"r,omitempty"`
+
+	Draining bool `json:"dr,omitempty"`
+	// storage class. empty for hot
+	Class string `json:"cl,omitempty"`
+
 	Neighbors []nodeHeartbeat `json:"neighbors"`
 }
 
-func (c cluster) CheckSecret(s string) bool {
+func (hb heartbeat) node() node {
+	return node{
+		UUID:      hb.UUID,
+		BaseURL:   hb.BaseURL,
+		Writeable: hb.Writeable,
+		FreeSpace: hb.FreeSpace,
+		Capacity:  hb.Capacity,
+		BlobCount: hb.BlobCount,
+		Load:      hb.Load,
+		Weight:    hb.Weight,
+		Zone:      hb.Zone,
+		Rack:      hb.Rack,
+		Draining:  hb.Draining,
+		LastSeen:  time.Now(),
+
+		StorageClass: hb.Class,
+	}
+}
+
+func (c *cluster) CheckSecret(s string) bool {
 	return c.secret == s
 }
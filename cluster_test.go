@@ -3,9 +3,12 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"sort"
+	"strings"
 	"testing"
 	"time"
 
@@ -35,10 +38,13 @@ func Test_jsonSerialize(t *testing.T) {
 	if string(c.jsonSerialize()) != d {
 		t.Error("incorrect json")
 	}
-	// NodeMeta outputs the same
-	if string(c.NodeMeta(10)) != d {
+	// NodeMeta outputs the same, as long as it fits
+	if string(c.NodeMeta(512)) != d {
 		t.Error("bad output from NodeMeta")
 	}
+	if c.NodeMeta(10) != nil {
+		t.Error("NodeMeta went over its limit")
+	}
 	// LocalState outputs the same
 	if string(c.LocalState(true)) != d {
 		t.Error("bad output from NodeMeta")
@@ -134,6 +140,36 @@ func TestRing(t *testing.T) {
 	}
 }
 
+func TestCacheNodesStayOffTheRing(t *testing.T) {
+	n := newNode("testuuid", "http://localhost:1000", true)
+	c := newCluster(n, "clustersecret", 60)
+	c.AddNeighbor(*newNode("testuuid2", "http://localhost:1001", true))
+	cache := newNode("cache", "http://localhost:1002", true)
+	cache.StorageClass = cacheClass
+	c.AddNeighbor(*cache)
+
+	if len(c.Ring()) != 2*replicas || len(c.WriteRing()) != 2*replicas {
+		t.Errorf("expected only the two storage nodes on the ring, got %d and %d", len(c.Ring()), len(c.WriteRing()))
+	}
+	for i := 0; i < 50; i++ {
+		k := contentKey(fmt.Sprint(i))
+		for _, o := range c.ReadOrder(k) {
+			if o.UUID == "cache" {
+				t.Fatalf("the cache shouldn't be an owner of %s", k)
+			}
+		}
+	}
+	if peers := sharedRanges(c.Ring(), "testuuid", 2); len(peers["cache"]) != 0 {
+		t.Error("nothing should be synced with the cache")
+	}
+	// the cache says what it is in its heartbeat
+	var hb heartbeat
+	_ = json.Unmarshal(newCluster(cache, "clustersecret", 60).NodeMeta(512), &hb)
+	if hb.node().class() != cacheClass {
+		t.Errorf("expected the cache to gossip its class, got %q", hb.node().class())
+	}
+}
+
 func TestWriteOrder(t *testing.T) {
 	n1 := newNode("a", "http://localhost:1000", true)
 	n2 := newNode("b", "http://localhost:1001", true)
@@ -431,6 +467,7 @@ func Test_Cluster_Retrieve_With_Neighbor(t *testing.T) {
 }
 
 func Test_Cluster_AddFile_With_Neighbor(t *testing.T) {
+	j := testJournal(t, 1<<20)
 	// Setup a mock neighbor that accepts the file
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.Method == "POST" && r.URL.Path == "/local/" {
@@ -483,4 +520,182 @@ func Test_Cluster_AddFile_With_Neighbor(t *testing.T) {
 	if !c.AddFile(*k, file, 1, 1) {
 		t.Error("AddFile failed")
 	}
+	events, err := j.Events(eventFilter{Key: k.String(), Type: eventReplicated})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].Peer != "neighbor" || events[0].Detail != "upload" {
+		t.Errorf("the first copy should be in the journal: %+v", events)
+	}
+}
+
+func TestHeartbeatCarriesCapacity(t *testing.T) {
+	n := newNode("testuuid", "http://localhost:1000", true)
+	n.FreeSpace = 500
+	n.Capacity = 1000
+	n.BlobCount = 42
+	n.Load = 1.5
+	c := newCluster(n, "clustersecret", 60)
+
+	var hb heartbeat
+	if err := json.Unmarshal(c.NodeMeta(512), &hb); err != nil {
+		t.Fatal(err)
+	}
+	got := hb.node()
+	if got.FreeSpace != 500 || got.Capacity != 1000 || got.BlobCount != 42 || got.Load != 1.5 {
+		t.Errorf("capacity fields didn't survive the heartbeat: %+v", got)
+	}
+
+	// and they get updated on the neighbor
+	c2 := newCluster(newNode("other", "http://localhost:1001", true), "clustersecret", 60)
+	c2.AddNeighbor(node{UUID: "testuuid", BaseURL: "http://localhost:1000", Writeable: true})
+	c2.UpdateNeighbor(got)
+	n2, _ := c2.FindNeighborByUUID("testuuid")
+	if n2.Capacity != 1000 || n2.FreeSpace != 500 {
+		t.Errorf("UpdateNeighbor didn't update capacity: %+v", n2)
+	}
+}
+
+func TestNodeMetaFitsTheLimit(t *testing.T) {
+	n := newNode("testuuid", "http://localhost:1000", true)
+	n.FreeSpace = 1 << 40
+	n.Capacity = 1 << 41
+	n.BlobCount = 1 << 30
+	n.Load = 1.23456789
+	n.Zone = strings.Repeat("z", 200)
+	n.Rack = strings.Repeat("r", 200)
+	n.Draining = true
+	n.StorageClass = coldClass
+	c := newCluster(n, "clustersecret", 60)
+
+	meta := c.NodeMeta(512)
+	if len(meta) > 512 {
+		t.Fatalf("node metadata is %d bytes", len(meta))
+	}
+	var hb heartbeat
+	if err := json.Unmarshal(meta, &hb); err != nil {
+		t.Fatal(err)
+	}
+	got := hb.node()
+	if got.Rack != "" || got.Zone == "" {
+		t.Errorf("the rack should have gone before the zone: %+v", got)
+	}
+	if !got.Draining || got.StorageClass != coldClass {
+		t.Errorf("draining and class should always be kept: %+v", got)
+	}
+	if hb := c.heartbeat(); hb.Load != 1.23 {
+		t.Errorf("load should be rounded, got %v", hb.Load)
+	}
+
+	c.UpdateSelf(func(n *node) { n.BaseURL = "http://" + strings.Repeat("x", 600) })
+	if meta := c.NodeMeta(512); meta != nil {
+		t.Errorf("metadata that can't fit shouldn't be returned: %d bytes", len(meta))
+	}
+}
+
+func TestCapacityWeightedRing(t *testing.T) {
+	small := node{UUID: "small", Writeable: true, Capacity: 1000}
+	big := node{UUID: "big", Writeable: true, Capacity: 3000}
+	unknown := node{UUID: "unknown", Writeable: true}
+
+	// unweighted, everyone gets the same share
+	r := neighborsToRing([]node{small, big, unknown}, false)
+	if len(r) != 3*replicas {
+		t.Errorf("Expected ring length of %d, but got %d", 3*replicas, len(r))
+	}
+
+	r = neighborsToRing([]node{small, big, unknown}, true)
+	counts := map[string]int{}
+	for _, e := range r {
+		counts[e.Node.UUID]++
+	}
+	if counts["small"] != replicas/2 {
+		t.Errorf("small node should get half the default, got %d", counts["small"])
+	}
+	if counts["big"] != replicas*3/2 {
+		t.Errorf("big node should get 1.5x the default, got %d", counts["big"])
+	}
+	if counts["unknown"] != replicas {
+		t.Errorf("node without a capacity should get the default, got %d", counts["unknown"])
+	}
+	if !sort.IsSorted(r) {
+		t.Error("ring is not sorted")
+	}
+}
+
+func TestRingIsCached(t *testing.T) {
+	n := newNode("testuuid", "http://localhost:1000", true)
+	c := newCluster(n, "clustersecret", 60)
+	c.AddNeighbor(*newNode("testuuid2", "http://localhost:1001", true))
+
+	r1 := c.Ring()
+	v := c.RingVersion()
+	r2 := c.Ring()
+	if &r1[0] != &r2[0] || c.RingVersion() != v {
+		t.Error("ring was rebuilt without any changes")
+	}
+
+	// just seeing a node again doesn't change the ring
+	n2 := *newNode("testuuid2", "http://localhost:1001", true)
+	n2.LastSeen = time.Now()
+	c.UpdateNeighbor(n2)
+	c.RemoveNeighbor(node{UUID: "not-there"})
+	if c.RingVersion() != v {
+		t.Error("ring was rebuilt for a change that doesn't affect it")
+	}
+	// but the orderings still have the fresh copy of the node
+	for _, o := range c.ReadOrder("sha1:a94a8fe5ccb19ba61c4c0873d391e987982fbbd3") {
+		if o.UUID == "testuuid2" && !o.LastSeen.Equal(n2.LastSeen) {
+			t.Error("ReadOrder returned a stale node")
+		}
+	}
+
+	// writeability changes do
+	c.FailedNeighbor(n2)
+	if c.RingVersion() != v+1 {
+		t.Errorf("expected version %d, got %d", v+1, c.RingVersion())
+	}
+	if len(c.WriteRing()) != replicas {
+		t.Errorf("failed node should have left the write ring")
+	}
+	// and so do changes to ourself
+	n.Writeable = false
+	if c.RingVersion() != v+2 {
+		t.Errorf("expected version %d, got %d", v+2, c.RingVersion())
+	}
+	if len(c.WriteRing()) != 0 {
+		t.Errorf("nothing should be writeable")
+	}
+	c.RemoveNeighbor(n2)
+	if c.RingVersion() != v+3 || len(c.Ring()) != replicas {
+		t.Errorf("removing a node should rebuild the ring")
+	}
+}
+
+func Test_hashOrderMatchesLinearScan(t *testing.T) {
+	var nodes []node
+	for _, u := range []string{"a", "b", "c", "d", "e"} {
+		nodes = append(nodes, node{UUID: u})
+	}
+	ring := neighborsToRing(nodes, false)
+	for _, r := range ring {
+		// right on a ring position, and either side of it
+		for _, h := range []string{r.Hash, r.Hash[:39] + "0", r.Hash[:39] + "f"} {
+			got := hashOrder("sha1:"+h, len(nodes), ring)
+			// the first bucket strictly after the hash owns it
+			var first string
+			for _, e := range ring {
+				if e.Hash > h {
+					first = e.Node.UUID
+					break
+				}
+			}
+			if first == "" {
+				first = ring[0].Node.UUID
+			}
+			if got[0].UUID != first {
+				t.Errorf("hash %s: expected %s first, got %s", h, first, got[0].UUID)
+			}
+		}
+	}
 }
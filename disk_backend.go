@@ -1,74 +1,139 @@
 package main
 
 import (
+	"bytes"
 	"crypto/sha1"
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"math/rand"
 	"os"
 	"path/filepath"
 	"syscall"
 	"time"
-
-	"github.com/thraxil/randwalk"
 )
 
 type diskBackend struct {
-	Root string
+	Root  string
+	index *keyIndex
+	// nil unless small files are being packed
+	packs  *packStore
+	layout diskLayout
 }
 
 func newDiskBackend(root string) *diskBackend {
-	return &diskBackend{Root: root}
+	d := &diskBackend{Root: root, layout: layoutDeep}
+	if l, _, err := detectLayout(root, layoutDeep); err == nil && l.known() {
+		d.layout = l
+	}
+	// not d.scan, which would be stuck with a copy of d from
+	// before packing was turned on
+	d.index = newKeyIndex(root+"index.log", func(fn func(indexEntry)) error {
+		return d.scan(fn)
+	})
+	return d
 }
 
 func (d diskBackend) String() string {
 	return "Disk"
 }
 
+// store files up to threshold bytes in pack files instead of
+// giving them a directory each
+func (d *diskBackend) EnablePacks(threshold, segmentSize int64) error {
+	p, err := newPackStore(d.Root+"packs/", threshold, segmentSize)
+	if err != nil {
+		return err
+	}
+	d.packs = p
+	return nil
+}
+
+func (d diskBackend) packed(key key) bool {
+	return d.packs != nil && d.packs.Has(key)
+}
+
 func (d *diskBackend) Write(key key, r io.ReadCloser) error {
-	path := d.Root + key.Algorithm + "/" + key.AsPath()
-	log.Printf("writing to %s\n", path)
+	path := d.layout.dir(d.Root, key)
+	l := slog.With("key", key.String(), "op", "write")
+	if d.packs != nil {
+		buf, err := io.ReadAll(io.LimitReader(r, d.packs.Threshold+1))
+		if err != nil {
+			l.Error("error reading file to pack", "err", err)
+			return err
+		}
+		if int64(len(buf)) <= d.packs.Threshold {
+			l.Debug("packing")
+			if err := d.packs.Put(key, buf); err != nil {
+				l.Error("couldn't pack file", "err", err)
+				return err
+			}
+			// in case it was stored before packing was turned on
+			_ = d.layout.remove(d.Root, key)
+			d.index.Put(key, int64(len(buf)))
+			return nil
+		}
+		r = io.NopCloser(io.MultiReader(bytes.NewReader(buf), r))
+	}
+	l.Debug("writing", "path", path)
 	err := os.MkdirAll(path, 0755)
 	if err != nil {
-		log.Println("couldn't make directory path")
-		log.Println(err)
+		l.Error("couldn't make directory path", "err", err)
 		return err
 	}
-	fullpath := path + "/data"
+	fullpath := d.layout.path(d.Root, key)
 	f, err := os.OpenFile(fullpath, os.O_CREATE|os.O_RDWR, 0644)
 	if err != nil {
-		log.Println("couldn't write file")
-		log.Println(err)
+		l.Error("couldn't write file", "err", err)
 		return err
 	}
 	defer f.Close()
-	_, err = io.Copy(f, r)
+	size, err := io.Copy(f, r)
 	if err != nil {
-		log.Println("error copying data into file")
-		log.Println(err)
+		l.Error("error copying data into file", "err", err)
 		return err
 	}
+	d.index.Put(key, size)
 	return nil
 }
 
 func (d diskBackend) Read(key key) ([]byte, error) {
-	path := d.Root + key.Algorithm + "/" + key.AsPath() + "/data"
-	return os.ReadFile(path)
+	if d.packs != nil {
+		if data, ok, err := d.packs.Get(key); ok {
+			return data, err
+		}
+	}
+	return os.ReadFile(d.layout.path(d.Root, key))
 }
 
 func (d diskBackend) Exists(key key) bool {
-	path := d.Root + key.Algorithm + "/" + key.AsPath() + "/data"
-	if _, err := os.Stat(path); os.IsNotExist(err) {
+	if d.packed(key) {
+		return true
+	}
+	info, err := os.Stat(d.layout.path(d.Root, key))
+	if os.IsNotExist(err) {
 		return false
 	}
+	if err == nil && !d.index.Has(key) {
+		// the index can miss a write if we crashed at the
+		// wrong moment. this is a cheap place to catch that
+		d.index.Put(key, info.Size())
+	}
 	return true
 }
 
 func (d diskBackend) Delete(key key) error {
-	path := d.Root + key.Algorithm + "/" + key.AsPath()
-	return os.RemoveAll(path)
+	if d.packs != nil {
+		if err := d.packs.Delete(key); err != nil {
+			return err
+		}
+	}
+	err := d.layout.remove(d.Root, key)
+	if err == nil {
+		d.index.Delete(key)
+	}
+	return err
 }
 
 // the only File methods that we care about
@@ -87,18 +152,18 @@ func basename(path string) string {
 
 func visitPreChecks(path string, f fileish, err error, c *cluster) (bool, error) {
 	if err != nil {
-		log.Printf("visit was handed an error: %s", err.Error())
+		slog.Error("visit was handed an error", "path", path, "op", "aae", "err", err)
 		return true, err
 	}
 	if c == nil {
-		log.Println("verifier.visit was given a nil cluster")
+		slog.Error("verifier.visit was given a nil cluster", "op", "aae")
 		return true, errors.New("nil cluster")
 	}
 
 	if f.IsDir() {
 		return true, nil
 	}
-	if basename(path) != "data" {
+	if name := basename(path); name != "data" && !isHash(name) {
 		return true, nil
 	}
 	return false, nil
@@ -143,17 +208,23 @@ func (v *diskVerifier) VerifyKey(key key) error {
 	r := make(chan error)
 	go func() {
 		v.chF <- func() {
-			path := v.b.Root + key.Algorithm + "/" + key.AsPath() + "/data"
+			if v.b.packed(key) {
+				data, _, _ := v.b.packs.Get(key)
+				r <- v.doVerify(v.b.packs.path(key), key, fmt.Sprintf("%x", sha1.Sum(data)))
+				return
+			}
+			path := v.b.layout.path(v.b.Root, key)
+			l := slog.With("key", key.String(), "path", path, "op", "verify")
 			h := sha1.New()
 			file, err := os.Open(path)
 			if err != nil {
-				log.Printf("error opening %s\n", path)
+				l.Error("error opening file", "err", err)
 				return
 			}
 			defer file.Close()
 			_, err = io.Copy(h, file)
 			if err != nil {
-				log.Printf("error copying %s\n", path)
+				l.Error("error reading file", "err", err)
 				return
 			}
 			hash := fmt.Sprintf("%x", h.Sum(nil))
@@ -165,18 +236,27 @@ func (v *diskVerifier) VerifyKey(key key) error {
 
 func (v *diskVerifier) doVerify(path string, key key, h string) error {
 	if key.String() == "sha1:"+h {
+		verifications.WithLabelValues("ok").Inc()
 		return nil
 	}
-	log.Printf("corrupted file %s\n", path)
+	l := slog.With("key", key.String(), "path", path, "op", "verify")
+	l.Warn("corrupted file")
+	verifications.WithLabelValues("corrupt").Inc()
+	recordEvent(eventCorrupt, key, "", path)
 	repaired, err := v.repairFile(path, key)
 	if err != nil {
-		log.Printf("error trying to repair file")
+		l.Error("error trying to repair file", "err", err)
+		verifications.WithLabelValues("unrepairable").Inc()
+		recordEvent(eventRepairFailed, key, "", err.Error())
 		return err
 	}
 	if repaired {
-		log.Printf("successfully repaired file")
+		l.Info("successfully repaired file")
+		verifications.WithLabelValues("repaired").Inc()
 		return nil
 	}
+	verifications.WithLabelValues("unrepairable").Inc()
+	recordEvent(eventRepairFailed, key, "", "")
 	return errors.New("unrepairable file")
 }
 
@@ -188,11 +268,17 @@ func (v *diskVerifier) repairFile(path string, key key) (bool, error) {
 		}
 		found, f, err := n.CheckFile(key, v.c.secret)
 		if found && err == nil {
-			err := v.replaceFile(path, f)
+			var err error
+			if v.b.packs != nil && v.b.packs.owns(path) {
+				err = v.b.packs.Put(key, f)
+			} else {
+				err = v.replaceFile(path, f)
+			}
 			if err != nil {
-				log.Println("error replacing the file")
+				slog.Error("error replacing the file", "key", key.String(), "peer", n.UUID, "op", "repair", "err", err)
 				continue
 			}
+			recordEvent(eventRepaired, key, n.UUID, "")
 			return true, nil
 		}
 
@@ -204,29 +290,23 @@ func (v *diskVerifier) repairFile(path string, key key) (bool, error) {
 func (v *diskVerifier) replaceFile(path string, file []byte) error {
 	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
 	if err != nil {
-		log.Println("couldn't open for writing")
+		slog.Error("couldn't open for writing", "path", path, "op", "repair", "err", err)
 		f.Close()
 		return err
 	}
 	_, err = f.Write(file)
 	f.Close()
 	if err != nil {
-		log.Println("couldn't write file")
+		slog.Error("couldn't write file", "path", path, "op", "repair", "err", err)
 		return err
 	}
 	return nil
 }
 
 func visit(path string, f os.FileInfo, err error, c *cluster, s site) error {
-	if aaeSkip < aaeOffset {
-		aaeSkip++
-		return nil
-	}
-
 	defer func() {
 		if r := recover(); r != nil {
-			log.Printf("Error in active anti-entropy.visit() [%s] %s\n", c.Myself.UUID, path)
-			log.Println(r)
+			slog.Error("panic in active anti-entropy visit", "path", path, "op", "aae", "err", r)
 		}
 	}()
 
@@ -240,23 +320,24 @@ func visit(path string, f os.FileInfo, err error, c *cluster, s site) error {
 		time.Sleep(time.Duration(s.AAEInterval+jitter) * time.Second)
 	}()
 
-	log.Printf("AAE visiting %s\n", path)
+	l := slog.With("path", path, "op", "aae")
+	l.Debug("AAE visiting")
 
 	key, err := keyFromPath(path)
 	if err != nil {
-		log.Println("couldn't get key from path")
+		l.Warn("couldn't get key from path")
 		return nil
 	}
 	h := sha1.New()
 	file, err := os.Open(path)
 	if err != nil {
-		log.Printf("error opening %s\n", path)
+		l.Error("error opening file", "err", err)
 		return err
 	}
 	defer file.Close()
 	_, err = io.Copy(h, file)
 	if err != nil {
-		log.Printf("error copying %s\n", path)
+		l.Error("error reading file", "err", err)
 		return err
 	}
 	hash := fmt.Sprintf("%x", h.Sum(nil))
@@ -273,34 +354,71 @@ func visit(path string, f os.FileInfo, err error, c *cluster, s site) error {
 	return nil
 }
 
-func makeVisitor(fn func(string, os.FileInfo, error, *cluster, site) error,
-	c *cluster, s site) func(path string, f os.FileInfo, err error) error {
-	return func(path string, f os.FileInfo, err error) error {
-		return fn(path, f, err, c, s)
+// like visit(), but for a key in a pack file
+func (d diskBackend) visitPacked(k key, s site) error {
+	defer func() {
+		jitter := rand.Intn(5)
+		time.Sleep(time.Duration(s.AAEInterval+jitter) * time.Second)
+	}()
+	slog.Debug("AAE visiting packed", "key", k.String(), "op", "aae")
+	data, _, err := d.packs.Get(k)
+	if err != nil && err != errPackCorrupt {
+		return err
 	}
+	if err := s.Verify(d.packs.path(k), k, fmt.Sprintf("%x", sha1.Sum(data))); err != nil {
+		return err
+	}
+	return s.Rebalance(k)
 }
 
-var aaeOffset = 0
-var aaeSkip = 0
+// how many keys AAE takes from the index at a time
+const aaeBatchSize = 100
 
+// goes through the keys in the index, the ones that have gone
+// the longest without being checked first
 func (d diskBackend) ActiveAntiEntropy(cluster *cluster, site site, interval int) {
-	aaeOffset = rand.Intn(10000)
+	_, err := os.ReadDir(d.Root)
+	if err != nil {
+		fmt.Printf("Can't get a directory listing for %s. Let's fail fast.\n", d.Root)
+		os.Exit(1)
+	}
 	for {
-		_, err := os.ReadDir(d.Root)
-		if err != nil {
-			fmt.Printf("Can't get a directory listing for %s. Let's fail fast.\n", d.Root)
-			os.Exit(1)
-		}
-		if aaeSkip >= aaeOffset {
+		if d.aaeBatch(cluster, site) == 0 {
 			jitter := rand.Intn(5)
 			time.Sleep(time.Duration(interval+jitter) * time.Second)
-			log.Println("AAE starting at the top")
 		}
-		err = randwalk.Walk(d.Root, makeVisitor(visit, cluster, site))
+	}
+}
+
+// checks the next batch of keys from the index. returns how
+// many there were
+func (d diskBackend) aaeBatch(cluster *cluster, site site) int {
+	entries := d.index.LeastRecentlyVerified(aaeBatchSize)
+	for _, e := range entries {
+		k, err := keyFromString(e.Key)
+		if err != nil {
+			continue
+		}
+		if d.packed(*k) {
+			err = d.visitPacked(*k, site)
+		} else {
+			path := d.layout.path(d.Root, *k)
+			f, serr := os.Stat(path)
+			if os.IsNotExist(serr) {
+				slog.Warn("in the index but not on disk", "key", k.String(), "op", "aae")
+				d.index.Delete(*k)
+				continue
+			}
+			err = visit(path, f, serr, cluster, site)
+		}
 		if err != nil {
-			log.Printf("randwalk.Walk() returned %v\n", err)
+			slog.Warn("AAE failed", "key", k.String(), "op", "aae", "err", err)
+		}
+		if d.index.Has(*k) {
+			d.index.MarkVerified(*k, time.Now())
 		}
 	}
+	return len(entries)
 }
 
 func (d diskBackend) FreeSpace() uint64 {
@@ -308,3 +426,79 @@ func (d diskBackend) FreeSpace() uint64 {
 	_ = syscall.Statfs(d.Root, &stat)
 	return stat.Bavail * uint64(stat.Bsize)
 }
+
+func (d diskBackend) Capacity() uint64 {
+	var stat syscall.Statfs_t
+	_ = syscall.Statfs(d.Root, &stat)
+	return stat.Blocks * uint64(stat.Bsize)
+}
+
+func (d diskBackend) BlobCount() int64 {
+	return d.index.Count()
+}
+
+func (d diskBackend) IndexStats() indexStats {
+	return d.index.Stats()
+}
+
+func (d diskBackend) RangeDigest(r keyRange) (int, setDigest) {
+	return d.index.RangeDigest(r)
+}
+
+// read the index in, or build it if there isn't one
+func (d diskBackend) LoadIndex() {
+	d.index.load()
+}
+
+// rebuild the index from what's actually on disk
+func (d diskBackend) RebuildIndex() error {
+	return d.index.Rebuild()
+}
+
+// every key on disk. only used to build the index. the
+// directory tree is laid out so that walking it in lexical
+// order visits the keys in sorted order
+func (d diskBackend) scan(fn func(indexEntry)) error {
+	root := d.Root + "sha1"
+	err := filepath.WalkDir(root, func(path string, e os.DirEntry, err error) error {
+		if err != nil {
+			if path == root && os.IsNotExist(err) {
+				// nothing written yet
+				return filepath.SkipAll
+			}
+			return err
+		}
+		if e.IsDir() {
+			return nil
+		}
+		k, err := keyFromPath(path)
+		if err != nil || path != filepath.Clean(d.layout.path(d.Root, *k)) {
+			return nil
+		}
+		info, err := e.Info()
+		if err != nil {
+			return nil
+		}
+		fn(indexEntry{Key: k.String(), Size: info.Size(), Stored: info.ModTime()})
+		return nil
+	})
+	if err != nil || d.packs == nil {
+		return err
+	}
+	d.packs.forEach(func(k string, size int64) {
+		fn(indexEntry{Key: k, Size: size})
+	})
+	return nil
+}
+
+func (d diskBackend) List(after string, limit int) ([]keyInfo, error) {
+	var results []keyInfo
+	for _, e := range d.index.List(after, limit) {
+		k, err := keyFromString(e.Key)
+		if err != nil {
+			continue
+		}
+		results = append(results, keyInfo{Key: *k, Size: e.Size})
+	}
+	return results, nil
+}
@@ -233,3 +233,92 @@ func TestDiskVerifierVerifyBadHash(t *testing.T) {
 		t.Errorf("Verify should have failed with bad hash")
 	}
 }
+
+func TestDiskBackendCapacityAndBlobCount(t *testing.T) {
+	tmpdir, err := os.MkdirTemp("", "disk_backend_test")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	backend := newDiskBackend(tmpdir + "/")
+	if backend.Capacity() == 0 {
+		t.Error("expected a non-zero capacity")
+	}
+	if backend.Capacity() < backend.FreeSpace() {
+		t.Error("capacity should be at least the free space")
+	}
+
+	k1, _ := keyFromString("sha1:a94a8fe5ccb19ba61c4c0873d391e987982fbbd3")
+	k2, _ := keyFromString("sha1:f48dd853820860816c75d54d0f58d47663456009")
+	_ = backend.Write(*k1, io.NopCloser(bytes.NewReader([]byte("test"))))
+
+	// initial count comes from a walk
+	if c := backend.BlobCount(); c != 1 {
+		t.Errorf("expected 1 blob, got %d", c)
+	}
+	// after that it is tracked
+	_ = backend.Write(*k2, io.NopCloser(bytes.NewReader([]byte("test data"))))
+	_ = backend.Write(*k2, io.NopCloser(bytes.NewReader([]byte("test data"))))
+	if c := backend.BlobCount(); c != 2 {
+		t.Errorf("expected 2 blobs, got %d", c)
+	}
+	_ = backend.Delete(*k1)
+	_ = backend.Delete(*k1)
+	if c := backend.BlobCount(); c != 1 {
+		t.Errorf("expected 1 blob, got %d", c)
+	}
+}
+
+func TestDiskBackendList(t *testing.T) {
+	tmpdir, err := os.MkdirTemp("", "disk_backend_test")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	backend := newDiskBackend(tmpdir + "/")
+	keys, err := backend.List("", 0)
+	if err != nil || len(keys) != 0 {
+		t.Errorf("empty backend should list nothing: %v %v", keys, err)
+	}
+
+	for _, s := range []string{
+		"sha1:f48dd853820860816c75d54d0f58d47663456009",
+		"sha1:a94a8fe5ccb19ba61c4c0873d391e987982fbbd3",
+		"sha1:a94a8fe5ccb19ba61c4c0873d391e987982fbbd4",
+		"sha1:0000000000000000000000000000000000000000",
+	} {
+		k, _ := keyFromString(s)
+		_ = backend.Write(*k, io.NopCloser(bytes.NewReader([]byte(s))))
+	}
+
+	keys, err = backend.List("", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 4 {
+		t.Fatalf("expected 4 keys, got %d", len(keys))
+	}
+	if keys[0].Key.String() != "sha1:0000000000000000000000000000000000000000" ||
+		keys[3].Key.String() != "sha1:f48dd853820860816c75d54d0f58d47663456009" {
+		t.Errorf("keys not in order: %v", keys)
+	}
+	if keys[0].Size != 45 {
+		t.Errorf("wrong size: %d", keys[0].Size)
+	}
+
+	keys, _ = backend.List("sha1:a94a8fe5ccb19ba61c4c0873d391e987982fbbd3", 1)
+	if len(keys) != 1 || keys[0].Key.String() != "sha1:a94a8fe5ccb19ba61c4c0873d391e987982fbbd4" {
+		t.Errorf("paging didn't work: %v", keys)
+	}
+
+	var count int
+	_ = forEachKey(backend, func(keyInfo) error {
+		count++
+		return nil
+	})
+	if count != 4 {
+		t.Errorf("forEachKey visited %d keys", count)
+	}
+}
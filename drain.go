@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// draining a node takes it out of the write ring and pushes
+// everything it has onto the nodes that will own it once it's
+// gone. when every key has enough copies elsewhere, it's safe
+// to shut the node down and remove it.
+
+type drainStatus struct {
+	Draining     bool      `json:"draining"`
+	Started      time.Time `json:"started"`
+	Passes       int       `json:"passes"`
+	Checked      int       `json:"checked"`
+	Replicated   int       `json:"replicated"`
+	Failed       int       `json:"failed"`
+	SafeToRemove bool      `json:"safe_to_remove"`
+}
+
+type drainer struct {
+	s *site
+
+	mu     sync.Mutex
+	status drainStatus
+	stop   chan struct{}
+}
+
+func newDrainer(s *site) *drainer {
+	return &drainer{s: s}
+}
+
+func (d *drainer) Status() drainStatus {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.status
+}
+
+func (d *drainer) Start() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.status.Draining {
+		return
+	}
+	slog.Info("starting drain", "op", "drain")
+	d.status = drainStatus{Draining: true, Started: time.Now()}
+	d.stop = make(chan struct{})
+	d.setDraining(true)
+	go d.run(d.stop)
+}
+
+func (d *drainer) Cancel() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.status.Draining {
+		return
+	}
+	slog.Info("cancelling drain", "op", "drain")
+	close(d.stop)
+	d.status.Draining = false
+	d.status.SafeToRemove = false
+	d.setDraining(false)
+}
+
+// the heartbeat goroutines read our node, so it's changed
+// through the cluster
+func (d *drainer) setDraining(draining bool) {
+	d.s.Cluster.UpdateSelf(func(n *node) { n.Draining = draining })
+	updateGossipMeta()
+}
+
+func (d *drainer) run(stop chan struct{}) {
+	// give the rest of the cluster a moment to hear that we
+	// are leaving the write ring
+	select {
+	case <-stop:
+		return
+	case <-time.After(time.Duration(d.s.Cluster.HeartbeatInterval) * time.Second):
+	}
+	for {
+		failed, err := d.pass(stop)
+		if err == errDrainCancelled {
+			return
+		}
+		if err != nil {
+			slog.Warn("drain pass failed", "op", "drain", "err", err)
+		} else if failed == 0 {
+			d.mu.Lock()
+			d.status.SafeToRemove = true
+			d.mu.Unlock()
+			slog.Info("drain complete. safe to remove this node", "op", "drain")
+			return
+		}
+		// some keys couldn't be placed. try again later
+		select {
+		case <-stop:
+			return
+		case <-time.After(drainRetryInterval):
+		}
+	}
+}
+
+var errDrainCancelled = errors.New("drain cancelled")
+
+// how long to wait before another pass when some keys couldn't
+// be placed
+const drainRetryInterval = 5 * time.Minute
+
+// one pass over every key we have. returns how many couldn't
+// be given enough replicas elsewhere
+func (d *drainer) pass(stop chan struct{}) (int, error) {
+	d.mu.Lock()
+	d.status.Passes++
+	d.status.Checked = 0
+	d.status.Replicated = 0
+	d.status.Failed = 0
+	d.mu.Unlock()
+
+	failed := 0
+	err := forEachKey(d.s.Backend, func(ki keyInfo) error {
+		select {
+		case <-stop:
+			return errDrainCancelled
+		default:
+		}
+		ok := d.drainKey(ki.Key)
+		d.mu.Lock()
+		d.status.Checked++
+		if ok {
+			d.status.Replicated++
+		} else {
+			d.status.Failed++
+			failed++
+		}
+		d.mu.Unlock()
+		return nil
+	})
+	return failed, err
+}
+
+// make sure the key is on enough of its new owners. returns
+// true once it has a full set of replicas that aren't here.
+func (d *drainer) drainKey(k key) bool {
+	l := slog.With("key", k.String(), "op", "drain")
+	var data []byte
+	copies := 0
+	for _, n := range d.s.Cluster.ClassOrder(k.String(), d.s.self().class()) {
+		if n.UUID == "" || n.UUID == d.s.Node.UUID || n.Draining || !n.Writeable {
+			continue
+		}
+		if found, err := n.RetrieveInfo(k, d.s.ClusterSecret); err == nil && found {
+			copies++
+		} else {
+			if data == nil {
+				b, err := d.s.Backend.Read(k)
+				if err != nil {
+					l.Error("drain couldn't read", "err", err)
+					return false
+				}
+				data = b
+			}
+			if n.AddFile(k, bytes.NewReader(data), d.s.ClusterSecret) {
+				l.Info("drain replicated", "peer", n.UUID)
+				recordEvent(eventReplicated, k, n.UUID, "drain")
+				copies++
+			}
+		}
+		if copies >= d.s.Replication {
+			return true
+		}
+	}
+	l.Warn("drain couldn't place enough replicas", "replicas", copies, "want", d.s.Replication)
+	return false
+}
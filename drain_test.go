@@ -0,0 +1,119 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func Test_drainKey(t *testing.T) {
+	var posts int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" {
+			posts++
+			_, _ = w.Write([]byte("sha1:da39a3ee5e6b4b0d3255bfef95601890afd80709"))
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer ts.Close()
+
+	n := newNode("testuuid", "http://localhost:1000", true)
+	n.Draining = true
+	c := newCluster(n, "secret", 60)
+	c.AddNeighbor(*newNode("neighbor", ts.URL, true))
+	mb := &MockBackendFull{
+		data: map[string][]byte{
+			"sha1:da39a3ee5e6b4b0d3255bfef95601890afd80709": []byte(""),
+		},
+	}
+	s := &site{Node: n, Cluster: c, Backend: mb, Replication: 1, ClusterSecret: "secret"}
+	d := newDrainer(s)
+
+	k, _ := keyFromString("sha1:da39a3ee5e6b4b0d3255bfef95601890afd80709")
+	if !d.drainKey(*k) {
+		t.Error("key should have been placed on the neighbor")
+	}
+	if posts != 1 {
+		t.Errorf("expected the file to be pushed once, got %d", posts)
+	}
+
+	// not enough other nodes for two replicas
+	s.Replication = 2
+	if d.drainKey(*k) {
+		t.Error("there's only one other node, so that can't be enough")
+	}
+
+	failed, err := d.pass(make(chan struct{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := d.Status()
+	if failed != 1 || st.Checked != 1 || st.Failed != 1 || st.Passes != 1 {
+		t.Errorf("unexpected status after a pass: %+v", st)
+	}
+}
+
+func Test_drainStartCancel(t *testing.T) {
+	n := newNode("testuuid", "http://localhost:1000", true)
+	c := newCluster(n, "secret", 60)
+	s := &site{Node: n, Cluster: c, Backend: &MockBackendFull{}, ClusterSecret: "secret"}
+	s.drainer = newDrainer(s)
+
+	// no secret, no drain
+	req := httptest.NewRequest("POST", "/drain/", nil)
+	rr := httptest.NewRecorder()
+	drainHandler(rr, req, s)
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("got status %d, want %d", rr.Code, http.StatusForbidden)
+	}
+
+	req = httptest.NewRequest("POST", "/drain/", nil)
+	req.Header.Set("X-Cask-Cluster-Secret", "secret")
+	rr = httptest.NewRecorder()
+	drainHandler(rr, req, s)
+	if rr.Code != http.StatusOK {
+		t.Errorf("got status %d, want %d", rr.Code, http.StatusOK)
+	}
+	if !strings.Contains(rr.Body.String(), `"draining":true`) {
+		t.Errorf("unexpected status: %s", rr.Body.String())
+	}
+	if !n.Draining {
+		t.Error("node should be marked as draining")
+	}
+	if len(c.WriteRing()) != 0 {
+		t.Error("a draining node shouldn't be in the write ring")
+	}
+	if len(c.Ring()) != replicas {
+		t.Error("a draining node should still be readable")
+	}
+
+	req = httptest.NewRequest("DELETE", "/drain/", nil)
+	req.Header.Set("X-Cask-Cluster-Secret", "secret")
+	rr = httptest.NewRecorder()
+	drainHandler(rr, req, s)
+	if n.Draining || s.drainer.Status().Draining {
+		t.Error("drain should have been cancelled")
+	}
+	if len(c.WriteRing()) != replicas {
+		t.Error("node should be back in the write ring")
+	}
+}
+
+func Test_handleLocalPostDraining(t *testing.T) {
+	n := &node{Writeable: true, Draining: true, UUID: "test"}
+	s := &site{
+		Cluster:       newCluster(n, "test_secret", 60),
+		Backend:       &MockBackendFull{},
+		Node:          n,
+		MaxUploadSize: 1024,
+	}
+	req := httptest.NewRequest("POST", "/local/", strings.NewReader(""))
+	req.Header.Set("X-Cask-Cluster-Secret", "test_secret")
+	rr := httptest.NewRecorder()
+	handleLocalPost(rr, req, s)
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("got status %d, want %d", rr.Code, http.StatusServiceUnavailable)
+	}
+}
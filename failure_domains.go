@@ -0,0 +1,94 @@
+package main
+
+// nodes can be labelled with a zone and a rack. replicas should
+// be spread across as many distinct zones, and then racks, as
+// the cluster allows so that losing one of them doesn't take
+// out every copy of a file.
+
+func (n node) rackDomain() string {
+	return n.Zone + "/" + n.Rack
+}
+
+// reorder the nodes so that, as far as possible, each one is in
+// a zone (or failing that, a rack) that hasn't been used yet.
+// otherwise the original order is kept, so with no labels
+// configured this changes nothing.
+func spreadFailureDomains(nodes []node) []node {
+	remaining := make([]node, len(nodes))
+	copy(remaining, nodes)
+	results := make([]node, 0, len(nodes))
+	zones := map[string]bool{}
+	racks := map[string]bool{}
+	for len(remaining) > 0 {
+		best, bestScore := 0, -1
+		for i, n := range remaining {
+			score := 0
+			if !zones[n.Zone] {
+				score = 2
+			} else if !racks[n.rackDomain()] {
+				score = 1
+			}
+			if score > bestScore {
+				best, bestScore = i, score
+			}
+			if score == 2 {
+				break
+			}
+		}
+		n := remaining[best]
+		zones[n.Zone] = true
+		racks[n.rackDomain()] = true
+		results = append(results, n)
+		remaining = append(remaining[:best], remaining[best+1:]...)
+	}
+	return results
+}
+
+// keeps track of which failure domains a file has replicas in
+type domainTracker struct {
+	wantZones int
+	wantRacks int
+	zones     map[string]bool
+	racks     map[string]bool
+}
+
+// we want replicas in as many distinct zones and racks as
+// there are available to write to, up to the replication level
+func newDomainTracker(nodes []node, replication int) *domainTracker {
+	allZones := map[string]bool{}
+	allRacks := map[string]bool{}
+	for _, n := range nodes {
+		if n.UUID == "" || !n.Writeable {
+			continue
+		}
+		allZones[n.Zone] = true
+		allRacks[n.rackDomain()] = true
+	}
+	return &domainTracker{
+		wantZones: min(replication, len(allZones)),
+		wantRacks: min(replication, len(allRacks)),
+		zones:     map[string]bool{},
+		racks:     map[string]bool{},
+	}
+}
+
+func (d *domainTracker) add(n node) {
+	d.zones[n.Zone] = true
+	d.racks[n.rackDomain()] = true
+}
+
+// would a copy on this node be in a zone or rack that doesn't
+// have one yet
+func (d *domainTracker) adds(n node) bool {
+	return (len(d.zones) < d.wantZones && !d.zones[n.Zone]) ||
+		(len(d.racks) < d.wantRacks && !d.racks[n.rackDomain()])
+}
+
+// how many more copies it takes to cover the zones and racks
+func (d *domainTracker) missing() int {
+	return max(d.wantZones-len(d.zones), d.wantRacks-len(d.racks), 0)
+}
+
+func (d *domainTracker) satisfied() bool {
+	return len(d.zones) >= d.wantZones && len(d.racks) >= d.wantRacks
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/memberlist"
+)
+
+func Test_spreadFailureDomains(t *testing.T) {
+	// no labels, order is unchanged
+	nodes := []node{{UUID: "a"}, {UUID: "b"}, {UUID: "c"}}
+	r := spreadFailureDomains(nodes)
+	for i := range nodes {
+		if r[i].UUID != nodes[i].UUID {
+			t.Errorf("order changed without any labels: %v", r)
+		}
+	}
+
+	nodes = []node{
+		{UUID: "a1", Zone: "a", Rack: "1"},
+		{UUID: "a2", Zone: "a", Rack: "1"},
+		{UUID: "a3", Zone: "a", Rack: "2"},
+		{UUID: "b1", Zone: "b", Rack: "1"},
+		{UUID: "b2", Zone: "b", Rack: "1"},
+	}
+	r = spreadFailureDomains(nodes)
+	var got []string
+	for _, n := range r {
+		got = append(got, n.UUID)
+	}
+	// new zones first, then new racks, then whatever is left
+	if strings.Join(got, ",") != "a1,b1,a3,a2,b2" {
+		t.Errorf("unexpected order: %v", got)
+	}
+}
+
+func Test_domainTracker(t *testing.T) {
+	nodes := []node{
+		{UUID: "a1", Zone: "a", Writeable: true},
+		{UUID: "a2", Zone: "a", Writeable: true},
+		{UUID: "b1", Zone: "b", Writeable: true},
+		// can't write to it, so it doesn't count as available
+		{UUID: "c1", Zone: "c"},
+	}
+	d := newDomainTracker(nodes, 3)
+	d.add(nodes[0])
+	d.add(nodes[1])
+	if d.satisfied() {
+		t.Error("both replicas are in zone a")
+	}
+	d.add(nodes[2])
+	if !d.satisfied() {
+		t.Error("replicas are in every available zone")
+	}
+
+	// nothing labelled, anything goes
+	d = newDomainTracker([]node{{UUID: "x", Writeable: true}, {UUID: "y", Writeable: true}}, 2)
+	d.add(node{UUID: "x"})
+	if !d.satisfied() {
+		t.Error("should be satisfied without labels")
+	}
+}
+
+func TestWriteOrderSpreadsZones(t *testing.T) {
+	n1 := newNode("a", "http://localhost:1000", true)
+	n1.Zone = "east"
+	n2 := newNode("b", "http://localhost:1001", true)
+	n2.Zone = "east"
+	n3 := newNode("c", "http://localhost:1002", true)
+	n3.Zone = "west"
+	c := newCluster(n1, "clustersecret", 60)
+	c.AddNeighbor(*n2)
+	c.AddNeighbor(*n3)
+
+	// without zones this hash puts a, b, c in order (see TestWriteOrder)
+	hash := "sha1:a94a8fe5ccb19ba61c4c0873d391e987982fbbd3"
+	for _, o := range [][]node{c.WriteOrder(hash), c.ReadOrder(hash)} {
+		if o[0].UUID != "a" || o[1].UUID != "c" || o[2].UUID != "b" {
+			t.Errorf("expected a, c, b, got %s, %s, %s", o[0].UUID, o[1].UUID, o[2].UUID)
+		}
+	}
+}
+
+func TestHeartbeatFitsInNodeMeta(t *testing.T) {
+	n := newNode("111b1f38-4a30-4bc1-9341-ea0a1c7976e2", "https://cask-node-17.example.com:8380", true)
+	n.Zone = "us-east-1a"
+	n.Rack = "rack-42"
+	n.Weight = 1.25
+	n.FreeSpace = 18000000000000
+	n.Capacity = 20000000000000
+	n.BlobCount = 123456789
+	n.Load = 123.456
+	c := newCluster(n, "a-reasonably-long-cluster-secret-value", 60)
+	b := c.NodeMeta(memberlist.MetaMaxSize)
+	if len(b) > memberlist.MetaMaxSize {
+		t.Errorf("node metadata is %d bytes, the limit is %d", len(b), memberlist.MetaMaxSize)
+	}
+	var hb heartbeat
+	if err := json.Unmarshal(b, &hb); err != nil {
+		t.Fatal(err)
+	}
+	if hb.node().Zone != "us-east-1a" || hb.node().Rack != "rack-42" {
+		t.Error("labels didn't make it through the heartbeat")
+	}
+}
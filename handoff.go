@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"sort"
+	"sync"
+)
+
+// hinted handoff. when a write can't go to one of the nodes
+// that should own the file because it's down, the node that
+// takes the write in its place records a hint. once the owner
+// is seen alive again, the hint is replayed and the owner gets
+// its copy without waiting for AAE to notice.
+
+type hintStore struct {
+	mu    sync.Mutex
+	hints map[string]map[string]bool // target uuid -> keys
+	// how many targets each key is being held for
+	held map[string]int
+	// hints are saved here so they survive a restart. if there's
+	// nowhere to save them, they're only kept in memory. like the
+	// key index, it's an append-only log of changes that gets
+	// compacted once it's mostly stale
+	file  *mirroredFile
+	lines int
+}
+
+type hintEntry struct {
+	Target  string `json:"target"`
+	Key     string `json:"key"`
+	Removed bool   `json:"removed,omitempty"`
+}
+
+// with more than one path, a copy is kept at each of them
+func newHintStore(paths ...string) *hintStore {
+	h := &hintStore{
+		hints: make(map[string]map[string]bool),
+		held:  make(map[string]int),
+		file:  newMirroredFile(paths...),
+	}
+	if !h.file.enabled() {
+		return h
+	}
+	if err := h.readLog(); err != nil && !os.IsNotExist(err) {
+		slog.Error("couldn't read hints", "op", "handoff", "err", err)
+	}
+	// start the log off with just what's live
+	if err := h.compact(); err != nil {
+		slog.Error("couldn't save hints", "op", "handoff", "err", err)
+	}
+	return h
+}
+
+func (h *hintStore) readLog() error {
+	b, err := h.file.Read()
+	if err != nil {
+		return err
+	}
+	// hints used to be saved as one JSON object
+	var saved map[string][]string
+	if json.Unmarshal(b, &saved) == nil {
+		for target, keys := range saved {
+			for _, k := range keys {
+				h.apply(hintEntry{Target: target, Key: k})
+			}
+		}
+		return nil
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		var e hintEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			// a torn write at the end from a crash
+			continue
+		}
+		h.apply(e)
+	}
+	return scanner.Err()
+}
+
+// update the in memory maps. returns false if nothing changed
+func (h *hintStore) apply(e hintEntry) bool {
+	if e.Removed {
+		if !h.hints[e.Target][e.Key] {
+			return false
+		}
+		delete(h.hints[e.Target], e.Key)
+		if len(h.hints[e.Target]) == 0 {
+			delete(h.hints, e.Target)
+		}
+		if h.held[e.Key]--; h.held[e.Key] <= 0 {
+			delete(h.held, e.Key)
+		}
+		return true
+	}
+	if h.hints[e.Target][e.Key] {
+		return false
+	}
+	if h.hints[e.Target] == nil {
+		h.hints[e.Target] = make(map[string]bool)
+	}
+	h.hints[e.Target][e.Key] = true
+	h.held[e.Key]++
+	return true
+}
+
+// must hold the lock
+func (h *hintStore) append(e hintEntry) {
+	if !h.apply(e) || !h.file.enabled() {
+		return
+	}
+	b, err := json.Marshal(e)
+	l := slog.With("key", e.Key, "peer", e.Target, "op", "handoff")
+	if err != nil {
+		l.Error("couldn't encode hint", "err", err)
+		return
+	}
+	if err := h.file.Append(append(b, '\n')); err != nil {
+		l.Error("couldn't save hints", "err", err)
+		return
+	}
+	h.lines++
+	if h.lines > 2*len(h.held)+1000 {
+		if err := h.compact(); err != nil {
+			l.Error("couldn't compact hints", "err", err)
+		}
+	}
+}
+
+// write out just the live hints and switch to that
+func (h *hintStore) compact() error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	lines := 0
+	for target, keys := range h.hints {
+		for k := range keys {
+			if err := enc.Encode(hintEntry{Target: target, Key: k}); err != nil {
+				return err
+			}
+			lines++
+		}
+	}
+	if err := h.file.Rewrite(buf.Bytes()); err != nil {
+		return err
+	}
+	h.lines = lines
+	return nil
+}
+
+func (h *hintStore) Add(target string, k key) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.append(hintEntry{Target: target, Key: k.String()})
+}
+
+func (h *hintStore) Remove(target string, k key) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.append(hintEntry{Target: target, Key: k.String(), Removed: true})
+}
+
+// whether we're holding the key for any node
+func (h *hintStore) Holding(k key) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.held[k.String()] > 0
+}
+
+func (h *hintStore) HasHintsFor(target string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.hints[target]) > 0
+}
+
+// keys waiting to be handed off to the target
+func (h *hintStore) For(target string) []key {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var keys []key
+	for s := range h.hints[target] {
+		k, err := keyFromString(s)
+		if err != nil {
+			continue
+		}
+		keys = append(keys, *k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+	return keys
+}
+
+type hintedHandoff struct {
+	store   *hintStore
+	backend backend
+	secret  string
+
+	// nodes that have been seen alive and might have hints
+	// waiting. one loop works through them
+	mu      sync.Mutex
+	waiting map[string]node
+	wake    chan struct{}
+}
+
+func newHintedHandoff(store *hintStore, b backend, secret string) *hintedHandoff {
+	h := &hintedHandoff{
+		store:   store,
+		backend: b,
+		secret:  secret,
+		waiting: make(map[string]node),
+		wake:    make(chan struct{}, 1),
+	}
+	go h.run()
+	return h
+}
+
+// the node is up. gossip calls this a lot, so it just queues it
+// up for the replay loop if there's anything for it
+func (h *hintedHandoff) Trigger(n node) {
+	if !h.store.HasHintsFor(n.UUID) {
+		return
+	}
+	h.mu.Lock()
+	h.waiting[n.UUID] = n
+	h.mu.Unlock()
+	select {
+	case h.wake <- struct{}{}:
+	default:
+		// already woken up
+	}
+}
+
+func (h *hintedHandoff) run() {
+	for range h.wake {
+		h.mu.Lock()
+		waiting := h.waiting
+		h.waiting = make(map[string]node)
+		h.mu.Unlock()
+		for _, n := range waiting {
+			h.Replay(n)
+		}
+	}
+}
+
+// send the node everything we've been holding for it
+func (h *hintedHandoff) Replay(n node) {
+	keys := h.store.For(n.UUID)
+	if len(keys) == 0 {
+		return
+	}
+	l := slog.With("peer", n.UUID, "op", "handoff")
+	l.Info("replaying hints", "hints", len(keys))
+	for _, k := range keys {
+		data, err := h.backend.Read(k)
+		if err != nil {
+			// we don't have it anymore, so there is nothing to
+			// hand off. AAE elsewhere will have to sort it out
+			l.Warn("hinted file is gone", "key", k.String(), "err", err)
+			h.store.Remove(n.UUID, k)
+			continue
+		}
+		if !n.AddFile(k, bytes.NewReader(data), h.secret) {
+			l.Warn("couldn't hand off. will try again later", "key", k.String())
+			return
+		}
+		l.Info("handed off", "key", k.String())
+		recordEvent(eventReplicated, k, n.UUID, "handoff")
+		h.store.Remove(n.UUID, k)
+	}
+}
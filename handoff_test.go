@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_hintStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hints.json")
+	h := newHintStore(path)
+	k1, _ := keyFromString("sha1:da39a3ee5e6b4b0d3255bfef95601890afd80709")
+	k2, _ := keyFromString("sha1:fa39a3ee5e6b4b0d3255bfef95601890afd80709")
+	h.Add("target", *k2)
+	h.Add("target", *k1)
+	h.Add("other", *k1)
+
+	// survives a restart
+	h = newHintStore(path)
+	keys := h.For("target")
+	if len(keys) != 2 || keys[0].String() != k1.String() || keys[1].String() != k2.String() {
+		t.Errorf("unexpected hints after reload: %v", keys)
+	}
+
+	h.Remove("target", *k1)
+	h.Remove("other", *k1)
+	h = newHintStore(path)
+	if keys := h.For("target"); len(keys) != 1 || keys[0].String() != k2.String() {
+		t.Errorf("unexpected hints after remove: %v", keys)
+	}
+	if keys := h.For("other"); len(keys) != 0 {
+		t.Errorf("expected no hints left, got %v", keys)
+	}
+}
+
+func Test_hintedHandoffReplay(t *testing.T) {
+	var posts int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		posts++
+		_, _ = w.Write([]byte("sha1:da39a3ee5e6b4b0d3255bfef95601890afd80709"))
+	}))
+	defer ts.Close()
+
+	k, _ := keyFromString("sha1:da39a3ee5e6b4b0d3255bfef95601890afd80709")
+	gone, _ := keyFromString("sha1:fa39a3ee5e6b4b0d3255bfef95601890afd80709")
+	mb := &MockBackendFull{
+		data: map[string][]byte{k.String(): []byte("")},
+	}
+	store := newHintStore("")
+	store.Add("target", *k)
+	store.Add("target", *gone)
+	h := newHintedHandoff(store, mb, "secret")
+
+	h.Replay(*newNode("target", ts.URL, true))
+	if posts != 1 {
+		t.Errorf("expected one file to be handed off, got %d", posts)
+	}
+	if keys := store.For("target"); len(keys) != 0 {
+		t.Errorf("hints should all be cleared, got %v", keys)
+	}
+}
+
+func Test_recordHint(t *testing.T) {
+	n := &node{Writeable: true, UUID: "test"}
+	c := newCluster(n, "test_secret", 60)
+	c.handoff = newHintedHandoff(newHintStore(""), nil, "test_secret")
+	s := &site{
+		Cluster:       c,
+		Backend:       &MockBackendFull{},
+		Node:          n,
+		MaxUploadSize: 1024,
+	}
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	part, _ := writer.CreateFormFile("file", "test.txt")
+	_, _ = part.Write([]byte("content"))
+	writer.Close()
+	req := httptest.NewRequest("POST", "/local/", body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	req.Header.Set("X-Cask-Cluster-Secret", "test_secret")
+	req.Header.Set("X-Cask-Hint-For", "down-node")
+	rr := httptest.NewRecorder()
+	handleLocalPost(rr, req, s)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", rr.Code, http.StatusOK)
+	}
+	if keys := c.handoff.store.For("down-node"); len(keys) != 1 {
+		t.Errorf("expected a hint for the down node, got %v", keys)
+	}
+}
+
+func TestAddFileLeavesHintForDepartedOwner(t *testing.T) {
+	var hint string
+	var k *key
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hint = r.Header.Get("X-Cask-Hint-For")
+		_, _ = w.Write([]byte(k.String()))
+	}))
+	defer ts.Close()
+
+	n := newNode("testuuid", "http://localhost:1000", false)
+	c := newCluster(n, "secret", 60)
+	c.AddNeighbor(*newNode("up", ts.URL, true))
+	departed := *newNode("departed", "http://localhost:1001", true)
+	departed.LastSeen = time.Now().Add(-time.Minute)
+	c.AddNeighbor(departed)
+	c.RemoveNeighbor(departed)
+
+	// find some content that the departed node would own
+	var content []byte
+	for i := 0; i < 1000; i++ {
+		content = []byte(fmt.Sprint(i))
+		k, _ = keyFromString(fmt.Sprintf("sha1:%x", sha1.Sum(content)))
+		if owners, _ := c.owners(*k, 1); owners["departed"] {
+			break
+		}
+		k = nil
+	}
+	if k == nil {
+		t.Fatal("departed node doesn't own anything")
+	}
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	part, _ := writer.CreateFormFile("file", "test.txt")
+	_, _ = part.Write(content)
+	writer.Close()
+	req := httptest.NewRequest("POST", "/", body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	if err := req.ParseMultipartForm(1024); err != nil {
+		t.Fatal(err)
+	}
+	file, _, err := req.FormFile("file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	if !c.AddFile(*k, file, 1, 1) {
+		t.Fatal("AddFile failed")
+	}
+	if hint != "departed" {
+		t.Errorf("expected a hint for the departed node, got %q", hint)
+	}
+}
+
+func Test_hintStoreMirrored(t *testing.T) {
+	paths := []string{filepath.Join(t.TempDir(), "hints.json"), filepath.Join(t.TempDir(), "hints.json")}
+	h := newHintStore(paths...)
+	k, _ := keyFromString("sha1:da39a3ee5e6b4b0d3255bfef95601890afd80709")
+	h.Add("target", *k)
+
+	// lose a disk
+	_ = os.Remove(paths[0])
+	h = newHintStore(paths...)
+	if keys := h.For("target"); len(keys) != 1 {
+		t.Errorf("the hint should have survived on the other disk: %v", keys)
+	}
+	if _, err := os.Stat(paths[0]); err != nil {
+		t.Errorf("the lost copy should have been written again: %s", err)
+	}
+}
+
+func Test_hintStoreLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hints.json")
+	// the old format was a single JSON object
+	_ = os.WriteFile(path, []byte(`{"target":["sha1:da39a3ee5e6b4b0d3255bfef95601890afd80709"]}`), 0644)
+	h := newHintStore(path)
+	k, _ := keyFromString("sha1:da39a3ee5e6b4b0d3255bfef95601890afd80709")
+	if !h.Holding(*k) || !h.HasHintsFor("target") {
+		t.Fatal("old hints file wasn't read")
+	}
+
+	// adds and removes are appended, not rewritten
+	for i := 0; i < 10; i++ {
+		h.Add("other", *k)
+		h.Remove("other", *k)
+	}
+	b, _ := os.ReadFile(path)
+	if lines := bytes.Count(b, []byte("\n")); lines != 21 {
+		t.Errorf("expected 21 lines in the log, got %d", lines)
+	}
+	h.Remove("target", *k)
+	if h.Holding(*k) {
+		t.Error("shouldn't be holding it for anyone")
+	}
+
+	// a torn write at the end is ignored
+	f, _ := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	_, _ = f.WriteString(`{"target":"x","ke`)
+	f.Close()
+	h = newHintStore(path)
+	if h.Holding(*k) {
+		t.Error("removed hint came back")
+	}
+	b, _ = os.ReadFile(path)
+	if len(b) != 0 {
+		t.Errorf("log should have been compacted to nothing: %q", b)
+	}
+}
+
+func Test_hintedHandoffTrigger(t *testing.T) {
+	posted := make(chan bool, 10)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("sha1:da39a3ee5e6b4b0d3255bfef95601890afd80709"))
+		posted <- true
+	}))
+	defer ts.Close()
+	k, _ := keyFromString("sha1:da39a3ee5e6b4b0d3255bfef95601890afd80709")
+	mb := &MockBackendFull{data: map[string][]byte{k.String(): []byte("")}}
+	store := newHintStore("")
+	h := newHintedHandoff(store, mb, "secret")
+
+	// nothing to hand off, so nothing happens
+	h.Trigger(*newNode("nobody", ts.URL, true))
+	store.Add("target", *k)
+	for i := 0; i < 5; i++ {
+		h.Trigger(*newNode("target", ts.URL, true))
+	}
+	select {
+	case <-posted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("hint was never replayed")
+	}
+	time.Sleep(50 * time.Millisecond)
+	if len(posted) != 0 {
+		t.Errorf("file was handed off more than once")
+	}
+	if store.Holding(*k) {
+		t.Error("hint should have been cleared")
+	}
+}
+
+func Test_rebalanceKeepsHintedCopy(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// everyone else already has it
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+	n := newNode("testuuid", "http://localhost:1000", true)
+	c := newCluster(n, "secret", 60)
+	c.AddNeighbor(*newNode("neighbor1", ts.URL, true))
+	c.AddNeighbor(*newNode("neighbor2", ts.URL, true))
+	c.handoff = newHintedHandoff(newHintStore(""), nil, "secret")
+
+	// find a key that we aren't first in line for
+	var k *key
+	for i := 0; k == nil; i++ {
+		kk, _ := keyFromString(fmt.Sprintf("sha1:%x", sha1.Sum([]byte(fmt.Sprint(i)))))
+		if c.ClassOrder(kk.String(), hotClass)[0].UUID != n.UUID {
+			k = kk
+		}
+	}
+	mb := &MockBackendFull{data: map[string][]byte{k.String(): []byte("")}}
+	r := rebalancer{c: c, s: site{Node: n, Cluster: c, Backend: mb, Replication: 1, MaxReplication: 1}}
+
+	c.handoff.store.Add("down", *k)
+	_ = r.doRebalance(context.Background(), *k)
+	if mb.deletedKey != "" {
+		t.Fatal("deleted a copy we're holding for another node")
+	}
+	c.handoff.store.Remove("down", *k)
+	_ = r.doRebalance(context.Background(), *k)
+	if mb.deletedKey != k.String() {
+		t.Error("excess copy should be cleared once the hint is gone")
+	}
+}
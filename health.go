@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	healthGreen  = "green"
+	healthYellow = "yellow"
+	healthRed    = "red"
+	// how long to wait for each node's status
+	healthTimeout = 5 * time.Second
+	// less free than this (as a fraction of capacity) is a warning
+	lowFreeSpace = 0.1
+	// how long an answer from /cluster/health/ is reused for
+	healthCacheFor = 5 * time.Second
+)
+
+// the whole cluster's health, put together from every node's
+// /status/
+type clusterHealth struct {
+	Verdict     string   `json:"verdict"`
+	Reasons     []string `json:"reasons"`
+	Reachable   int      `json:"reachable"`
+	Unreachable int      `json:"unreachable"`
+	Capacity    uint64   `json:"capacity"`
+	FreeSpace   uint64   `json:"free_space"`
+	ReadOnly    []string `json:"read_only"`
+	// keys that are probably missing a copy, because a node that
+	// has them can't be reached. it's an overestimate, since the
+	// same key can be on more than one unreachable node
+	UnderReplicated int64                    `json:"under_replicated"`
+	Disagreements   []membershipDisagreement `json:"disagreements"`
+	Nodes           []nodeHealth             `json:"nodes"`
+}
+
+type nodeHealth struct {
+	UUID      string `json:"uuid"`
+	BaseURL   string `json:"base_url"`
+	Reachable bool   `json:"reachable"`
+	Error     string `json:"error,omitempty"`
+	Writeable bool   `json:"writeable"`
+	FreeSpace uint64 `json:"free_space"`
+	Capacity  uint64 `json:"capacity"`
+	BlobCount int64  `json:"blob_count"`
+}
+
+// a node that doesn't know about all the others, or knows about
+// ones the node putting the report together doesn't
+type membershipDisagreement struct {
+	UUID    string   `json:"uuid"`
+	Missing []string `json:"missing,omitempty"`
+	Extra   []string `json:"extra,omitempty"`
+}
+
+// ask every node for its status, all at once
+func (s *site) gatherStatuses(ctx context.Context) ([]node, []nodeStatus, []error) {
+	nodes := s.Cluster.NeighborsInclusive()
+	statuses := make([]nodeStatus, len(nodes))
+	errs := make([]error, len(nodes))
+	var wg sync.WaitGroup
+	for i, n := range nodes {
+		if n.UUID == s.Node.UUID {
+			statuses[i] = s.Status()
+			continue
+		}
+		wg.Add(1)
+		go func(i int, n node) {
+			defer wg.Done()
+			statuses[i], errs[i] = n.Status(ctx, healthTimeout)
+		}(i, n)
+	}
+	wg.Wait()
+	return nodes, statuses, errs
+}
+
+func (s *site) ClusterHealth(ctx context.Context) clusterHealth {
+	nodes, statuses, errs := s.gatherStatuses(ctx)
+	return summarizeHealth(nodes, statuses, errs, s.Replication)
+}
+
+// anyone can ask for the cluster's health, and each time means a
+// request to every node. so the last answer is kept for a little
+// while, and requests that come in while it's being put together
+// wait for it rather than starting their own
+type healthCache struct {
+	mu sync.Mutex
+	at time.Time
+	h  clusterHealth
+}
+
+func (s *site) cachedClusterHealth(ctx context.Context) clusterHealth {
+	if s.health == nil {
+		return s.ClusterHealth(ctx)
+	}
+	s.health.mu.Lock()
+	defer s.health.mu.Unlock()
+	if !s.health.at.IsZero() && time.Since(s.health.at) < healthCacheFor {
+		return s.health.h
+	}
+	// everyone waiting gets this answer, so one of them hanging up
+	// shouldn't spoil it
+	s.health.h = s.ClusterHealth(context.WithoutCancel(ctx))
+	s.health.at = time.Now()
+	return s.health.h
+}
+
+func summarizeHealth(nodes []node, statuses []nodeStatus, errs []error, replication int) clusterHealth {
+	h := clusterHealth{
+		Reasons:       []string{},
+		ReadOnly:      []string{},
+		Disagreements: []membershipDisagreement{},
+	}
+	// who each reachable node thinks is in the cluster
+	views := make(map[string]map[string]bool)
+	everyone := make(map[string]bool)
+	known := make(map[string]bool)
+	for _, n := range nodes {
+		known[n.UUID] = true
+	}
+	for i, n := range nodes {
+		everyone[n.UUID] = true
+		nh := nodeHealth{UUID: n.UUID, BaseURL: n.BaseURL}
+		if errs[i] != nil {
+			nh.Error = errs[i].Error()
+			// go with what the last heartbeat said
+			nh.Writeable = n.Writeable
+			nh.FreeSpace = n.FreeSpace
+			nh.Capacity = n.Capacity
+			nh.BlobCount = n.BlobCount
+			h.Unreachable++
+			h.UnderReplicated += n.BlobCount
+			h.Nodes = append(h.Nodes, nh)
+			continue
+		}
+		st := statuses[i]
+		nh.Reachable = true
+		nh.Writeable = st.Node.Writeable
+		nh.FreeSpace = st.FreeSpace
+		nh.Capacity = st.Capacity
+		nh.BlobCount = st.BlobCount
+		h.Reachable++
+		h.FreeSpace += nh.FreeSpace
+		h.Capacity += nh.Capacity
+		if !nh.Writeable {
+			h.ReadOnly = append(h.ReadOnly, n.UUID)
+		}
+		view := map[string]bool{n.UUID: true}
+		for _, nb := range st.Neighbors {
+			view[nb.UUID] = true
+			everyone[nb.UUID] = true
+		}
+		views[n.UUID] = view
+		h.Nodes = append(h.Nodes, nh)
+	}
+	for uuid, view := range views {
+		d := membershipDisagreement{UUID: uuid}
+		for u := range everyone {
+			if !view[u] {
+				d.Missing = append(d.Missing, u)
+			}
+		}
+		for u := range view {
+			if !known[u] {
+				d.Extra = append(d.Extra, u)
+			}
+		}
+		if len(d.Missing) > 0 || len(d.Extra) > 0 {
+			sort.Strings(d.Missing)
+			sort.Strings(d.Extra)
+			h.Disagreements = append(h.Disagreements, d)
+		}
+	}
+	sort.Slice(h.Disagreements, func(i, j int) bool {
+		return h.Disagreements[i].UUID < h.Disagreements[j].UUID
+	})
+	sort.Slice(h.Nodes, func(i, j int) bool {
+		return h.Nodes[i].UUID < h.Nodes[j].UUID
+	})
+	sort.Strings(h.ReadOnly)
+
+	h.Verdict = healthGreen
+	yellow := func(reason string) {
+		if h.Verdict == healthGreen {
+			h.Verdict = healthYellow
+		}
+		h.Reasons = append(h.Reasons, reason)
+	}
+	red := func(reason string) {
+		h.Verdict = healthRed
+		h.Reasons = append(h.Reasons, reason)
+	}
+	if h.Unreachable > 0 {
+		if h.Unreachable >= replication {
+			// every copy of some keys could be on them
+			red(fmt.Sprintf("%d nodes unreachable, with replication of %d", h.Unreachable, replication))
+		} else {
+			yellow(fmt.Sprintf("%d nodes unreachable", h.Unreachable))
+		}
+	}
+	if h.Reachable > 0 && len(h.ReadOnly) == h.Reachable {
+		red("no writeable nodes")
+	}
+	if len(h.Disagreements) > 0 {
+		yellow(fmt.Sprintf("%d nodes disagree about who is in the cluster", len(h.Disagreements)))
+	}
+	if h.Capacity > 0 && float64(h.FreeSpace) < float64(h.Capacity)*lowFreeSpace {
+		yellow("cluster is nearly full")
+	}
+	return h
+}
+
+func clusterHealthHandler(w http.ResponseWriter, r *http.Request, s *site) {
+	b, err := json.Marshal(s.cachedClusterHealth(r.Context()))
+	if err != nil {
+		http.Error(w, "json error", 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(b)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// a node serving /status/
+func statusPeer(t *testing.T, n *node, neighbors ...*node) *httptest.Server {
+	c := newCluster(n, "secret", 60)
+	for _, nb := range neighbors {
+		c.AddNeighbor(*nb)
+	}
+	s := newSite(n, c, newMemoryBackend(1000), 1, 1, "secret", 1, 1000, nil)
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /status/", makeHandler(statusHandler, s))
+	ts := httptest.NewServer(mux)
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func Test_clusterHealthHandler(t *testing.T) {
+	local := newNode("local", "", true)
+	ro := newNode("ro", "", false)
+	roServer := statusPeer(t, ro, local)
+	ro.BaseURL = roServer.URL
+
+	// knows about a node nobody else does, and not about "ro"
+	odd := newNode("odd", "", true)
+	oddServer := statusPeer(t, odd, local, newNode("stranger", "", true))
+	odd.BaseURL = oddServer.URL
+
+	gone := newNode("gone", "", true)
+	gone.BlobCount = 12
+	goneServer := httptest.NewServer(http.NotFoundHandler())
+	gone.BaseURL = goneServer.URL
+	goneServer.Close()
+
+	c := newCluster(local, "secret", 60)
+	c.AddNeighbor(*ro)
+	c.AddNeighbor(*odd)
+	c.AddNeighbor(*gone)
+	s := newSite(local, c, newMemoryBackend(1000), 2, 2, "secret", 1, 1000, nil)
+
+	req := httptest.NewRequest("GET", "/cluster/health/", nil)
+	rr := httptest.NewRecorder()
+	clusterHealthHandler(rr, req, s)
+	var h clusterHealth
+	if err := json.Unmarshal(rr.Body.Bytes(), &h); err != nil {
+		t.Fatal(err)
+	}
+	if h.Verdict != healthYellow {
+		t.Errorf("expected yellow, got %s: %v", h.Verdict, h.Reasons)
+	}
+	if h.Reachable != 3 || h.Unreachable != 1 || h.UnderReplicated != 12 {
+		t.Errorf("unexpected counts: %+v", h)
+	}
+	if len(h.ReadOnly) != 1 || h.ReadOnly[0] != "ro" {
+		t.Errorf("unexpected read only nodes: %v", h.ReadOnly)
+	}
+	if h.FreeSpace != 3000 || h.Capacity != 3000 {
+		t.Errorf("unexpected capacity: %d free of %d", h.FreeSpace, h.Capacity)
+	}
+	var oddView *membershipDisagreement
+	for i, d := range h.Disagreements {
+		if d.UUID == "odd" {
+			oddView = &h.Disagreements[i]
+		}
+	}
+	if oddView == nil || len(oddView.Extra) != 1 || oddView.Extra[0] != "stranger" {
+		t.Errorf("odd's view of the cluster should be reported: %+v", h.Disagreements)
+	}
+}
+
+func Test_clusterHealthHandlerCaches(t *testing.T) {
+	var asked atomic.Int32
+	peer := newNode("peer", "", true)
+	ps := newSite(peer, newCluster(peer, "secret", 60), newMemoryBackend(1000), 1, 1, "secret", 1, 1000, nil)
+	status := makeHandler(statusHandler, ps)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		asked.Add(1)
+		status(w, r)
+	}))
+	defer ts.Close()
+	peer.BaseURL = ts.URL
+
+	local := newNode("local", "", true)
+	c := newCluster(local, "secret", 60)
+	c.AddNeighbor(*peer)
+	s := newSite(local, c, newMemoryBackend(1000), 1, 1, "secret", 1, 1000, nil)
+	for i := 0; i < 3; i++ {
+		rr := httptest.NewRecorder()
+		clusterHealthHandler(rr, httptest.NewRequest("GET", "/cluster/health/", nil), s)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("got status %d", rr.Code)
+		}
+	}
+	if n := asked.Load(); n != 1 {
+		t.Errorf("expected the peer to be asked once, got %d", n)
+	}
+
+	s.health.at = time.Now().Add(-healthCacheFor)
+	rr := httptest.NewRecorder()
+	clusterHealthHandler(rr, httptest.NewRequest("GET", "/cluster/health/", nil), s)
+	if n := asked.Load(); n != 2 {
+		t.Errorf("expected the peer to be asked again once the answer is stale, got %d", n)
+	}
+}
+
+func Test_summarizeHealthRed(t *testing.T) {
+	a := newNode("a", "", false)
+	b := newNode("b", "", true)
+	h := summarizeHealth(
+		[]node{*a, *b},
+		[]nodeStatus{{Node: *a, Neighbors: []neighborStatus{{UUID: "b"}}}, {}},
+		[]error{nil, errors.New("connection refused")},
+		1,
+	)
+	if h.Verdict != healthRed || len(h.Reasons) != 2 {
+		t.Errorf("expected red for a lost node and no writeable nodes: %s %v", h.Verdict, h.Reasons)
+	}
+}
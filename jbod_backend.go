@@ -0,0 +1,423 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log/slog"
+	"math"
+	"math/rand"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// a disk backend spread over a bunch of disks, so one node can
+// use every disk in a server. each disk is a normal disk backend
+// with its own index. if one of them fails, it gets taken
+// offline and whatever was on it is fetched back from the rest
+// of the cluster onto the disks that are left.
+type jbodBackend struct {
+	Disks []*jbodDisk
+	// checks a disk's layout and opens its packs before it's used
+	prepare func(*diskBackend) error
+}
+
+type jbodDisk struct {
+	*diskBackend
+	// set from request goroutines as well as the watcher, so it
+	// only changes with a compare and swap
+	offline atomic.Bool
+	// whether its keys have been fetched back after it failed
+	recovered atomic.Bool
+	// whether prepare has been run on it. only touched at startup
+	// and from the watcher
+	prepared bool
+}
+
+var errNoDisks = errors.New("no disks available")
+
+func newJBODBackend(roots []string) *jbodBackend {
+	j := &jbodBackend{}
+	for _, root := range roots {
+		if !strings.HasSuffix(root, "/") {
+			root += "/"
+		}
+		d := &jbodDisk{diskBackend: newDiskBackend(root)}
+		j.Disks = append(j.Disks, d)
+		j.check(d)
+	}
+	return j
+}
+
+func (j *jbodBackend) String() string {
+	return "JBOD"
+}
+
+func (j *jbodBackend) online() []*jbodDisk {
+	var disks []*jbodDisk
+	for _, d := range j.Disks {
+		if !d.offline.Load() {
+			disks = append(disks, d)
+		}
+	}
+	return disks
+}
+
+// make sure we can still write to and read from a disk
+func probeDisk(d *jbodDisk) error {
+	path := d.Root + ".cask-probe"
+	if err := os.WriteFile(path, []byte("ok"), 0644); err != nil {
+		return err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if string(data) != "ok" {
+		return errors.New("probe file came back wrong")
+	}
+	return os.Remove(path)
+}
+
+// run fn on every disk before it's used. the ones that are online
+// now get it straight away. the rest get it if they come back
+func (j *jbodBackend) Prepare(fn func(*diskBackend) error) error {
+	j.prepare = fn
+	for _, d := range j.online() {
+		if err := fn(d.diskBackend); err != nil {
+			return err
+		}
+		d.prepared = true
+	}
+	return nil
+}
+
+// take the disk offline if it has stopped working. only the
+// watcher brings disks back
+func (j *jbodBackend) check(d *jbodDisk) {
+	if err := probeDisk(d); err != nil {
+		j.takeOffline(d, err)
+	}
+}
+
+func (j *jbodBackend) takeOffline(d *jbodDisk, err error) {
+	if d.offline.CompareAndSwap(false, true) {
+		slog.Warn("taking disk offline", "disk", d.Root, "op", "disk_check", "err", err)
+		disksOffline.Inc()
+	}
+}
+
+// offline disks get probed too, in case they were replaced or
+// only went away for a while
+func (j *jbodBackend) recheck(d *jbodDisk) {
+	err := probeDisk(d)
+	if err != nil {
+		j.takeOffline(d, err)
+	} else if d.offline.Load() {
+		j.bringBack(d)
+	}
+}
+
+// whatever was on the disk has probably been fetched onto the
+// other disks while it was gone. those copies are dropped from it,
+// so a key is still only ever on one disk
+func (j *jbodBackend) bringBack(d *jbodDisk) {
+	l := slog.With("disk", d.Root, "op", "disk_check")
+	if !d.prepared && j.prepare != nil {
+		// it was offline at startup
+		if err := j.prepare(d.diskBackend); err != nil {
+			l.Error("disk is back, but couldn't be set up", "err", err)
+			return
+		}
+		d.prepared = true
+	}
+	if err := d.RebuildIndex(); err != nil {
+		l.Error("disk is back, but its index couldn't be rebuilt", "err", err)
+		return
+	}
+	dropped := 0
+	for _, e := range d.index.List("", 0) {
+		k, err := keyFromString(e.Key)
+		if err != nil || !j.Exists(*k) {
+			continue
+		}
+		if err := d.Delete(*k); err != nil {
+			l.Warn("couldn't drop the extra copy", "key", k.String(), "err", err)
+			continue
+		}
+		dropped++
+	}
+	l.Info("disk is back online. dropped keys that were elsewhere", "dropped", dropped)
+	d.recovered.Store(false)
+	if d.offline.CompareAndSwap(true, false) {
+		disksOffline.Dec()
+	}
+}
+
+// a file of the same name on each disk
+func (j *jbodBackend) paths(name string) []string {
+	var paths []string
+	for _, d := range j.Disks {
+		paths = append(paths, d.Root+name)
+	}
+	return paths
+}
+
+// rendezvous hashing, weighted by free space. a key always goes
+// to the same disk as long as the disks and how full they are
+// don't change much, and emptier disks get more of them
+func (j *jbodBackend) place(key key) *jbodDisk {
+	var best *jbodDisk
+	bestScore := 0.0
+	for _, d := range j.online() {
+		free := d.FreeSpace()
+		if free == 0 {
+			continue
+		}
+		h := fnv.New64a()
+		_, _ = h.Write([]byte(d.Root + key.String()))
+		u := (float64(h.Sum64()>>11) + 0.5) / (1 << 53)
+		score := float64(free) / -math.Log(u)
+		if best == nil || score > bestScore {
+			best, bestScore = d, score
+		}
+	}
+	return best
+}
+
+// the disk that has the key, if any of them do
+func (j *jbodBackend) locate(key key) *jbodDisk {
+	for _, d := range j.online() {
+		if d.Exists(key) {
+			return d
+		}
+	}
+	return nil
+}
+
+func (j *jbodBackend) Write(key key, r io.ReadCloser) error {
+	d := j.locate(key)
+	if d == nil {
+		d = j.place(key)
+	}
+	if d == nil {
+		return errNoDisks
+	}
+	err := d.Write(key, r)
+	if err != nil {
+		j.check(d)
+	}
+	return err
+}
+
+func (j *jbodBackend) Read(key key) ([]byte, error) {
+	d := j.locate(key)
+	if d == nil {
+		return nil, os.ErrNotExist
+	}
+	data, err := d.Read(key)
+	if err != nil && !os.IsNotExist(err) {
+		j.check(d)
+	}
+	return data, err
+}
+
+func (j *jbodBackend) Exists(key key) bool {
+	return j.locate(key) != nil
+}
+
+func (j *jbodBackend) Delete(key key) error {
+	var firstErr error
+	for _, d := range j.online() {
+		if err := d.Delete(key); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (j *jbodBackend) FreeSpace() uint64 {
+	var total uint64
+	for _, d := range j.online() {
+		total += d.FreeSpace()
+	}
+	return total
+}
+
+func (j *jbodBackend) Capacity() uint64 {
+	var total uint64
+	for _, d := range j.online() {
+		total += d.Capacity()
+	}
+	return total
+}
+
+func (j *jbodBackend) BlobCount() int64 {
+	var total int64
+	for _, d := range j.online() {
+		total += d.BlobCount()
+	}
+	return total
+}
+
+func (j *jbodBackend) IndexStats() indexStats {
+	var st indexStats
+	for _, d := range j.online() {
+		ds := d.IndexStats()
+		st.Keys += ds.Keys
+		st.Bytes += ds.Bytes
+		st.Unverified += ds.Unverified
+		if !ds.OldestVerified.IsZero() && (st.OldestVerified.IsZero() || ds.OldestVerified.Before(st.OldestVerified)) {
+			st.OldestVerified = ds.OldestVerified
+		}
+	}
+	return st
+}
+
+// a key is only ever on one disk, so the digests just combine
+func (j *jbodBackend) RangeDigest(r keyRange) (int, setDigest) {
+	total := 0
+	var digest setDigest
+	for _, d := range j.online() {
+		n, dd := d.RangeDigest(r)
+		total += n
+		digest.toggle(dd)
+	}
+	return total, digest
+}
+
+func (j *jbodBackend) LoadIndex() {
+	for _, d := range j.online() {
+		d.LoadIndex()
+	}
+}
+
+func (j *jbodBackend) RebuildIndex() error {
+	for _, d := range j.online() {
+		if err := d.RebuildIndex(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (j *jbodBackend) List(after string, limit int) ([]keyInfo, error) {
+	seen := make(map[string]bool)
+	var results []keyInfo
+	for _, d := range j.online() {
+		keys, err := d.List(after, limit)
+		if err != nil {
+			return nil, err
+		}
+		for _, k := range keys {
+			if !seen[k.Key.String()] {
+				seen[k.Key.String()] = true
+				results = append(results, k)
+			}
+		}
+	}
+	sort.Slice(results, func(i, k int) bool {
+		return results[i].Key.String() < results[k].Key.String()
+	})
+	if limit > 0 && len(results) > limit {
+		results = results[:limit]
+	}
+	return results, nil
+}
+
+// takes a batch from each disk in turn
+func (j *jbodBackend) ActiveAntiEntropy(cluster *cluster, site site, interval int) {
+	for {
+		checked := 0
+		for _, d := range j.online() {
+			checked += d.aaeBatch(cluster, site)
+		}
+		if checked == 0 {
+			jitter := rand.Intn(5)
+			time.Sleep(time.Duration(interval+jitter) * time.Second)
+		}
+	}
+}
+
+// checks on every disk now and then, and fetches back the keys
+// that were on any that have failed
+func (j *jbodBackend) WatchDisks(c *cluster, interval time.Duration) {
+	for {
+		for _, d := range j.Disks {
+			j.recheck(d)
+			if d.offline.Load() && !d.recovered.Load() {
+				j.recover(c, d)
+				d.recovered.Store(true)
+			}
+		}
+		time.Sleep(interval)
+	}
+}
+
+// the failed disk's index is usually still in memory, so we know
+// what was on it. anything we don't find here gets picked up by
+// the other nodes' anti-entropy eventually
+func (j *jbodBackend) recover(c *cluster, d *jbodDisk) {
+	entries := d.index.List("", 0)
+	l := slog.With("disk", d.Root, "op", "disk_recover")
+	l.Info("recovering keys from failed disk", "keys", len(entries))
+	recovered := 0
+	for _, e := range entries {
+		k, err := keyFromString(e.Key)
+		if err != nil || j.Exists(*k) {
+			continue
+		}
+		data, err := c.Retrieve(*k)
+		if err != nil {
+			l.Warn("couldn't find key anywhere else", "key", k.String())
+			continue
+		}
+		if fmt.Sprintf("sha1:%x", sha1.Sum(data)) != k.String() {
+			l.Warn("got a bad copy", "key", k.String())
+			continue
+		}
+		if err := j.Write(*k, io.NopCloser(bytes.NewReader(data))); err != nil {
+			l.Error("couldn't write", "key", k.String(), "err", err)
+			continue
+		}
+		recovered++
+		disksKeysRecovered.Inc()
+	}
+	l.Info("recovered keys", "recovered", recovered, "keys", len(entries))
+}
+
+type jbodVerifier struct {
+	j         *jbodBackend
+	verifiers map[string]verifier
+}
+
+func (j *jbodBackend) NewVerifier(c *cluster) verifier {
+	v := &jbodVerifier{j: j, verifiers: make(map[string]verifier)}
+	for _, d := range j.Disks {
+		v.verifiers[d.Root] = d.NewVerifier(c)
+	}
+	return v
+}
+
+func (v *jbodVerifier) Verify(path string, key key, h string) error {
+	for root, dv := range v.verifiers {
+		if strings.HasPrefix(path, root) {
+			return dv.Verify(path, key, h)
+		}
+	}
+	return errors.New("path isn't on any disk")
+}
+
+func (v *jbodVerifier) VerifyKey(key key) error {
+	d := v.j.locate(key)
+	if d == nil {
+		return os.ErrNotExist
+	}
+	return v.verifiers[d.Root].VerifyKey(key)
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+func jbodWrite(t *testing.T, j *jbodBackend, content string) key {
+	k, _ := keyFromString(contentKey(content))
+	if err := j.Write(*k, io.NopCloser(bytes.NewReader([]byte(content)))); err != nil {
+		t.Fatal(err)
+	}
+	return *k
+}
+
+func TestJBODBackendSpreadsKeys(t *testing.T) {
+	j := newJBODBackend([]string{t.TempDir(), t.TempDir()})
+	var keys []key
+	for i := 0; i < 32; i++ {
+		keys = append(keys, jbodWrite(t, j, fmt.Sprintf("file %d", i)))
+	}
+	for _, d := range j.Disks {
+		if d.BlobCount() == 0 {
+			t.Errorf("nothing was put on %s", d.Root)
+		}
+	}
+	if j.BlobCount() != 32 {
+		t.Errorf("expected 32 keys, got %d", j.BlobCount())
+	}
+	if data, err := j.Read(keys[0]); err != nil || string(data) != "file 0" {
+		t.Errorf("unexpected read: %q %v", data, err)
+	}
+	if j.FreeSpace() <= j.Disks[0].FreeSpace() {
+		t.Errorf("free space should be the total of all disks")
+	}
+
+	all, _ := j.List("", 0)
+	if len(all) != 32 {
+		t.Fatalf("expected 32 keys listed, got %d", len(all))
+	}
+	for i := 1; i < len(all); i++ {
+		if all[i-1].Key.String() >= all[i].Key.String() {
+			t.Errorf("keys not in order: %v", all)
+		}
+	}
+	if page, _ := j.List(all[2].Key.String(), 2); len(page) != 2 || page[0].Key.String() != all[3].Key.String() {
+		t.Errorf("paging didn't work: %v", page)
+	}
+
+	// same key, same disk
+	d := j.locate(keys[0])
+	jbodWrite(t, j, "file 0")
+	if j.locate(keys[0]) != d || j.BlobCount() != 32 {
+		t.Errorf("rewriting a key should leave it where it was")
+	}
+	_ = j.Delete(keys[0])
+	if j.Exists(keys[0]) {
+		t.Errorf("key should have been deleted")
+	}
+}
+
+func TestJBODBackendRecoversFailedDisk(t *testing.T) {
+	j := newJBODBackend([]string{t.TempDir(), t.TempDir()})
+	peer := newMemoryBackend(1000)
+	for _, s := range []string{"one", "two", "three", "four", "five", "six"} {
+		jbodWrite(t, j, s)
+		memoryWrite(t, peer, s)
+	}
+	ts := memoryPeer(t, peer)
+	n := newNode("local", "", true)
+	c := newCluster(n, "secret", 60)
+	c.AddNeighbor(*newNode("peer", ts.URL, true))
+
+	failed := j.Disks[0]
+	if failed.BlobCount() == 0 {
+		failed = j.Disks[1]
+	}
+	lost := failed.BlobCount()
+	_ = os.RemoveAll(failed.Root)
+	j.check(failed)
+	if !failed.offline.Load() {
+		t.Fatalf("disk should have been taken offline")
+	}
+	if j.BlobCount() != 6-lost {
+		t.Errorf("offline disk's keys shouldn't be counted")
+	}
+
+	j.recover(c, failed)
+	if j.BlobCount() != 6 {
+		t.Errorf("expected all 6 keys back, got %d", j.BlobCount())
+	}
+	for _, k := range failed.index.List("", 0) {
+		key, _ := keyFromString(k.Key)
+		if data, err := j.Read(*key); err != nil || contentKey(string(data)) != k.Key {
+			t.Errorf("%s wasn't recovered: %v", k.Key, err)
+		}
+	}
+}
+
+func TestJBODBackendDiskComesBack(t *testing.T) {
+	j := newJBODBackend([]string{t.TempDir(), t.TempDir()})
+	peer := newMemoryBackend(1000)
+	for _, s := range []string{"one", "two", "three", "four", "five", "six"} {
+		jbodWrite(t, j, s)
+		memoryWrite(t, peer, s)
+	}
+	ts := memoryPeer(t, peer)
+	c := newCluster(newNode("local", "", true), "secret", 60)
+	c.AddNeighbor(*newNode("peer", ts.URL, true))
+
+	failed := j.Disks[0]
+	if failed.BlobCount() == 0 {
+		failed = j.Disks[1]
+	}
+	// pulled out, with everything still on it
+	moved := t.TempDir() + "/moved"
+	if err := os.Rename(failed.Root, moved); err != nil {
+		t.Fatal(err)
+	}
+	j.check(failed)
+	j.recover(c, failed)
+	if err := os.Rename(moved, failed.Root); err != nil {
+		t.Fatal(err)
+	}
+
+	j.recheck(failed)
+	if failed.offline.Load() {
+		t.Fatal("disk should be back online")
+	}
+	if j.BlobCount() != 6 || failed.BlobCount() != 0 {
+		t.Errorf("the copies fetched while it was gone should be the only ones: %d, %d on the disk", j.BlobCount(), failed.BlobCount())
+	}
+	if paths := j.paths("hints.json"); len(paths) != 2 || paths[1] != j.Disks[1].Root+"hints.json" {
+		t.Errorf("unexpected paths: %v", paths)
+	}
+}
+
+func gaugeValue(t *testing.T, g interface{ Write(*dto.Metric) error }) float64 {
+	var m dto.Metric
+	if err := g.Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetGauge().GetValue()
+}
+
+func TestJBODBackendDiskFailsOnce(t *testing.T) {
+	j := newJBODBackend([]string{t.TempDir(), t.TempDir()})
+	failed := j.Disks[0]
+	before := gaugeValue(t, disksOffline)
+	_ = os.RemoveAll(failed.Root)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			j.check(failed)
+		}()
+	}
+	wg.Wait()
+	if got := gaugeValue(t, disksOffline) - before; got != 1 {
+		t.Errorf("disk should only be counted offline once, got %v", got)
+	}
+	if err := os.MkdirAll(failed.Root, 0755); err != nil {
+		t.Fatal(err)
+	}
+	// requests don't bring disks back, only the watcher does
+	j.check(failed)
+	if !failed.offline.Load() {
+		t.Errorf("check shouldn't bring a disk back")
+	}
+	j.recheck(failed)
+	if failed.offline.Load() || gaugeValue(t, disksOffline) != before {
+		t.Errorf("disk should be back and the gauge where it started")
+	}
+}
+
+func TestJBODBackendPreparesDisksThatComeBack(t *testing.T) {
+	late := t.TempDir() + "/late"
+	j := newJBODBackend([]string{t.TempDir(), late})
+	var prepared []string
+	err := j.Prepare(func(d *diskBackend) error {
+		prepared = append(prepared, d.Root)
+		return d.CheckLayout(layoutDeep)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(prepared) != 1 {
+		t.Fatalf("only the online disk should be set up at startup: %v", prepared)
+	}
+	if err := os.MkdirAll(late, 0755); err != nil {
+		t.Fatal(err)
+	}
+	j.recheck(j.Disks[1])
+	if j.Disks[1].offline.Load() {
+		t.Fatal("disk should be back online")
+	}
+	if len(prepared) != 2 || prepared[1] != late+"/" {
+		t.Errorf("disk that came back should have been set up: %v", prepared)
+	}
+	if _, err := os.Stat(late + "/" + layoutFile); err != nil {
+		t.Errorf("layout wasn't written when the disk came back: %v", err)
+	}
+}
+
+func TestJBODBackendMissingRoot(t *testing.T) {
+	j := newJBODBackend([]string{t.TempDir(), "/nonexistent/cask/root"})
+	if !j.Disks[1].offline.Load() || j.Disks[1].Root != "/nonexistent/cask/root/" {
+		t.Errorf("a root that isn't there should start offline")
+	}
+	k := jbodWrite(t, j, "still works")
+	if !j.Disks[0].Exists(k) {
+		t.Errorf("write should have gone to the working disk")
+	}
+	if err := j.NewVerifier(nil).VerifyKey(k); err != nil {
+		t.Errorf("verify failed: %v", err)
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// an append-only record of what has happened to files on this
+// node, so the history of a key can be pieced together after the
+// fact. one JSON object per line. the current file is rotated once
+// it gets too big or is more than a day old, and rotated files are
+// removed once they're older than maxAge.
+type event struct {
+	Time   time.Time `json:"time"`
+	Type   string    `json:"type"`
+	Key    string    `json:"key"`
+	Peer   string    `json:"peer,omitempty"`
+	Detail string    `json:"detail,omitempty"`
+}
+
+const (
+	eventCorrupt      = "corrupt_detected"
+	eventRepaired     = "repaired"
+	eventRepairFailed = "repair_failed"
+	eventReplicated   = "replicated_to"
+	eventDeleted      = "excess_deleted"
+	eventUploaded     = "upload_received"
+)
+
+// how long one file of the journal covers at most
+const journalSegmentAge = 24 * time.Hour
+
+type journal struct {
+	path    string
+	maxSize int64
+	maxAge  time.Duration
+
+	mu      sync.Mutex
+	f       *os.File
+	size    int64
+	started time.Time
+}
+
+// nil when there's no journal. recordEvent does nothing then
+var activeJournal atomic.Pointer[journal]
+
+func newJournal(path string, maxSize int64, maxAge time.Duration) (*journal, error) {
+	j := &journal{path: path, maxSize: maxSize, maxAge: maxAge}
+	if err := j.open(); err != nil {
+		return nil, err
+	}
+	j.prune()
+	return j, nil
+}
+
+func (j *journal) open() error {
+	f, err := os.OpenFile(j.path, os.O_CREATE|os.O_APPEND|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	j.f = f
+	j.size = fi.Size()
+	j.started = time.Now()
+	// carry on from where the file starts
+	var first event
+	sc := bufio.NewScanner(f)
+	if sc.Scan() && json.Unmarshal(sc.Bytes(), &first) == nil {
+		j.started = first.Time
+	}
+	return nil
+}
+
+func (j *journal) Record(e event) error {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.size > 0 && (j.size+int64(len(b)) > j.maxSize || time.Since(j.started) > journalSegmentAge) {
+		if err := j.rotate(); err != nil {
+			return err
+		}
+	}
+	if j.size == 0 {
+		j.started = e.Time
+	}
+	n, err := j.f.Write(b)
+	j.size += int64(n)
+	return err
+}
+
+// rotated files get the time they were rotated tacked on the end,
+// so they sort in order
+func (j *journal) rotate() error {
+	j.f.Close()
+	rotated := j.path + "." + time.Now().UTC().Format("20060102T150405.000000000")
+	if _, err := os.Stat(rotated); err == nil {
+		// don't clobber one from the same instant
+		rotated += "-" + randomHex(2)
+	}
+	if err := os.Rename(j.path, rotated); err != nil {
+		return err
+	}
+	if err := j.open(); err != nil {
+		return err
+	}
+	j.prune()
+	return nil
+}
+
+func (j *journal) rotated() []string {
+	files, _ := filepath.Glob(j.path + ".*")
+	sort.Strings(files)
+	return files
+}
+
+// must be called with the lock held, or before anything else can
+// get at the journal
+func (j *journal) prune() {
+	for _, path := range j.rotated() {
+		fi, err := os.Stat(path)
+		if err != nil || time.Since(fi.ModTime()) <= j.maxAge {
+			continue
+		}
+		if err := os.Remove(path); err != nil {
+			slog.Warn("couldn't remove old events file", "path", path, "op", "journal", "err", err)
+		}
+	}
+}
+
+// which events to return. an empty field matches anything
+type eventFilter struct {
+	Key  string
+	Type string
+	Peer string
+	// only the most recent ones, if it's more than zero
+	Limit int
+}
+
+func (f eventFilter) matches(e event) bool {
+	return (f.Key == "" || e.Key == f.Key) &&
+		(f.Type == "" || e.Type == f.Type) &&
+		(f.Peer == "" || e.Peer == f.Peer)
+}
+
+// matching events, oldest first
+func (j *journal) Events(f eventFilter) ([]event, error) {
+	// only the files are opened under the lock. they're read
+	// without it, so uploads recording events don't wait on a scan
+	// of the whole journal. an open file still reads fine if it's
+	// rotated or pruned in the meantime
+	j.mu.Lock()
+	var files []*os.File
+	for _, path := range append(j.rotated(), j.path) {
+		fh, err := os.Open(path)
+		if os.IsNotExist(err) {
+			// pruned out from under us
+			continue
+		}
+		if err != nil {
+			j.mu.Unlock()
+			for _, fh := range files {
+				fh.Close()
+			}
+			return nil, err
+		}
+		files = append(files, fh)
+	}
+	j.mu.Unlock()
+	defer func() {
+		for _, fh := range files {
+			fh.Close()
+		}
+	}()
+	var events []event
+	for _, fh := range files {
+		sc := bufio.NewScanner(fh)
+		for sc.Scan() {
+			var e event
+			if json.Unmarshal(sc.Bytes(), &e) != nil {
+				// probably a half written line from a crash
+				continue
+			}
+			if f.matches(e) {
+				events = append(events, e)
+			}
+		}
+		if err := sc.Err(); err != nil {
+			return nil, err
+		}
+	}
+	if f.Limit > 0 && len(events) > f.Limit {
+		events = events[len(events)-f.Limit:]
+	}
+	return events, nil
+}
+
+func (j *journal) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.f.Close()
+}
+
+func recordEvent(typ string, k key, peer, detail string) {
+	j := activeJournal.Load()
+	if j == nil {
+		return
+	}
+	if err := j.Record(event{Type: typ, Key: k.String(), Peer: peer, Detail: detail}); err != nil {
+		slog.Error("couldn't record event", "type", typ, "key", k.String(), "peer", peer, "op", "journal", "err", err)
+	}
+}
+
+// /events/?key=<key>&type=<type>&peer=<uuid>&limit=<n>
+func eventsHandler(w http.ResponseWriter, r *http.Request, s *site) {
+	j := activeJournal.Load()
+	if j == nil {
+		http.Error(w, "no event journal on this node", http.StatusNotFound)
+		return
+	}
+	q := r.URL.Query()
+	f := eventFilter{Key: q.Get("key"), Type: q.Get("type"), Peer: q.Get("peer"), Limit: 1000}
+	if l := q.Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 1 {
+			http.Error(w, "bad limit", http.StatusBadRequest)
+			return
+		}
+		f.Limit = n
+	}
+	events, err := j.Events(f)
+	if err != nil {
+		logger(r.Context()).Error("couldn't read events", "op", "journal", "err", err)
+		http.Error(w, "couldn't read events", 500)
+		return
+	}
+	if events == nil {
+		events = []event{}
+	}
+	b, err := json.Marshal(events)
+	if err != nil {
+		http.Error(w, "json error", 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(b)
+}
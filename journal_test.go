@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testJournal(t *testing.T, maxSize int64) *journal {
+	j, err := newJournal(filepath.Join(t.TempDir(), "events.log"), maxSize, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	activeJournal.Store(j)
+	t.Cleanup(func() {
+		activeJournal.Store(nil)
+		j.Close()
+	})
+	return j
+}
+
+func TestJournalRotatesBySize(t *testing.T) {
+	j := testJournal(t, 200)
+	k, _ := keyFromString(contentKey("rotated"))
+	for i := 0; i < 10; i++ {
+		recordEvent(eventReplicated, *k, "peer", "rebalance")
+	}
+	if len(j.rotated()) == 0 {
+		t.Errorf("journal should have been rotated")
+	}
+	events, err := j.Events(eventFilter{Key: k.String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 10 {
+		t.Errorf("expected all 10 events across the files, got %d", len(events))
+	}
+	for i := 1; i < len(events); i++ {
+		if events[i].Time.Before(events[i-1].Time) {
+			t.Errorf("events are out of order")
+		}
+	}
+}
+
+func TestJournalAge(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "events.log")
+	old := path + ".20200101T000000.000000000"
+	_ = os.WriteFile(old, []byte("{}\n"), 0644)
+	_ = os.Chtimes(old, time.Now().Add(-48*time.Hour), time.Now().Add(-48*time.Hour))
+	b, _ := json.Marshal(event{Time: time.Now().Add(-25 * time.Hour), Type: eventRepaired, Key: "sha1:old"})
+	_ = os.WriteFile(path, append(b, '\n'), 0644)
+
+	j, err := newJournal(path, 1<<20, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+	if _, err := os.Stat(old); !os.IsNotExist(err) {
+		t.Errorf("old rotated file should have been removed")
+	}
+	k, _ := keyFromString(contentKey("new"))
+	_ = j.Record(event{Type: eventUploaded, Key: k.String()})
+	if len(j.rotated()) != 1 {
+		t.Errorf("a file more than a day old should be rotated")
+	}
+	events, _ := j.Events(eventFilter{})
+	if len(events) != 2 || events[0].Key != "sha1:old" {
+		t.Errorf("unexpected events: %v", events)
+	}
+}
+
+func TestJournalFilter(t *testing.T) {
+	j := testJournal(t, 1<<20)
+	a, _ := keyFromString(contentKey("a"))
+	b, _ := keyFromString(contentKey("b"))
+	recordEvent(eventCorrupt, *a, "", "")
+	recordEvent(eventRepaired, *a, "peer-1", "")
+	recordEvent(eventReplicated, *b, "peer-2", "rebalance")
+	recordEvent(eventReplicated, *a, "peer-2", "rebalance")
+
+	count := func(f eventFilter) int {
+		events, err := j.Events(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(events)
+	}
+	if n := count(eventFilter{Key: a.String()}); n != 3 {
+		t.Errorf("expected 3 events for a, got %d", n)
+	}
+	if n := count(eventFilter{Type: eventReplicated, Peer: "peer-2"}); n != 2 {
+		t.Errorf("expected 2 replications to peer-2, got %d", n)
+	}
+	if n := count(eventFilter{Limit: 1}); n != 1 {
+		t.Errorf("limit wasn't applied, got %d", n)
+	}
+}
+
+func TestEventsHandler(t *testing.T) {
+	rr := httptest.NewRecorder()
+	eventsHandler(rr, httptest.NewRequest("GET", "/events/", nil), &site{})
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("got %d without a journal", rr.Code)
+	}
+
+	testJournal(t, 1<<20)
+	peer := newMemoryBackend(1000)
+	n := newNode("peer", memoryPeer(t, peer).URL, true)
+	k, _ := keyFromString(contentKey("uploaded"))
+	if !n.AddFile(*k, strings.NewReader("uploaded"), "secret") {
+		t.Fatal("upload failed")
+	}
+
+	rr = httptest.NewRecorder()
+	eventsHandler(rr, httptest.NewRequest("GET", "/events/?key="+k.String(), nil), &site{})
+	var events []event
+	if err := json.Unmarshal(rr.Body.Bytes(), &events); err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].Type != eventUploaded {
+		t.Errorf("expected the upload to be recorded, got %v", events)
+	}
+
+	rr = httptest.NewRecorder()
+	eventsHandler(rr, httptest.NewRequest("GET", "/events/?limit=none", nil), &site{})
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("got %d for a bad limit", rr.Code)
+	}
+}
+
+func TestVerifyRecordsEvents(t *testing.T) {
+	j := testJournal(t, 1<<20)
+	d := newDiskBackend(t.TempDir() + "/")
+	k, _ := keyFromString(contentKey("to be damaged"))
+	_ = os.MkdirAll(d.layout.dir(d.Root, *k), 0755)
+	_ = os.WriteFile(d.layout.path(d.Root, *k), []byte("damaged"), 0644)
+	c := newCluster(newNode("local", "", true), "secret", 60)
+	_ = d.NewVerifier(c).VerifyKey(*k)
+
+	events, _ := j.Events(eventFilter{Key: k.String()})
+	if len(events) != 2 || events[0].Type != eventCorrupt || events[1].Type != eventRepairFailed {
+		t.Errorf("unexpected events: %v", events)
+	}
+}
+
+func TestJournalEventsWhileRecording(t *testing.T) {
+	j := testJournal(t, 2000)
+	k, _ := keyFromString(contentKey("busy"))
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 200; i++ {
+			recordEvent(eventReplicated, *k, "peer", "rebalance")
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		if _, err := j.Events(eventFilter{Key: k.String()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-done
+	events, err := j.Events(eventFilter{Key: k.String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 200 {
+		t.Errorf("expected 200 events, got %d", len(events))
+	}
+}
@@ -13,6 +13,14 @@ type key struct {
 }
 
 func keyFromPath(path string) (*key, error) {
+	if name := filepath.Base(path); isHash(name) {
+		// the shallow layout: sha1/ab/cd/abcd...
+		dir := filepath.Dir(path)
+		if filepath.Base(dir) != name[2:4] || filepath.Base(filepath.Dir(dir)) != name[0:2] {
+			return nil, errors.New("file is in the wrong directory")
+		}
+		return keyFromString(filepath.Base(filepath.Dir(filepath.Dir(dir))) + ":" + name)
+	}
 	dir := filepath.Dir(path)
 	parts := strings.Split(dir, "/")
 	// only want the last 20 parts
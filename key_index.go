@@ -0,0 +1,496 @@
+package main
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// an index of every key a node holds, so that counting and
+// listing them doesn't mean walking the whole directory tree.
+// it's kept in memory and backed by an append-only log of
+// changes, which gets compacted when it has grown to be mostly
+// stale entries. if the log is missing, or can't be trusted,
+// the index is rebuilt by scanning the backend.
+
+type indexEntry struct {
+	Key      string    `json:"key"`
+	Size     int64     `json:"size"`
+	Stored   time.Time `json:"stored"`
+	Verified time.Time `json:"verified"`
+	Deleted  bool      `json:"deleted,omitempty"`
+}
+
+type indexStats struct {
+	Keys       int64 `json:"keys"`
+	Bytes      int64 `json:"bytes"`
+	Unverified int64 `json:"unverified"`
+	// zero if there are unverified keys
+	OldestVerified time.Time `json:"oldest_verified"`
+}
+
+// backends that keep an index of their keys
+type indexer interface {
+	IndexStats() indexStats
+}
+
+type keyIndex struct {
+	path string
+	// finds every key the backend has, for rebuilding
+	scan func(func(indexEntry)) error
+
+	once    sync.Once
+	mu      sync.Mutex
+	entries map[string]indexEntry
+	sorted  []string
+	// for summarizing ranges of keys for merkle sync
+	digests digestTree
+	// every key, the longest since it was verified first, so AAE
+	// can take the next batch without sorting them all
+	byVerified verifyQueue
+	queued     map[string]*verifyItem
+	unverified int64
+	bytes      int64
+	log        *os.File
+	// lines in the log, live or not
+	lines int
+}
+
+func newKeyIndex(path string, scan func(func(indexEntry)) error) *keyIndex {
+	return &keyIndex{path: path, scan: scan}
+}
+
+// the backend loads the index at startup, so a rebuild doesn't
+// end up happening in the middle of the first upload. anything
+// that uses it first makes sure it's loaded, in case it wasn't
+func (x *keyIndex) load() {
+	x.once.Do(func() {
+		x.mu.Lock()
+		defer x.mu.Unlock()
+		if err := x.readLog(); err != nil {
+			if !os.IsNotExist(err) {
+				slog.Warn("key index is unreadable", "path", x.path, "op", "index", "err", err)
+			}
+			if err := x.rebuild(); err != nil {
+				slog.Error("couldn't rebuild key index", "path", x.path, "op", "index", "err", err)
+			}
+		}
+	})
+}
+
+func (x *keyIndex) reset() {
+	x.entries = make(map[string]indexEntry)
+	x.sorted = nil
+	x.digests = make(digestTree)
+	x.byVerified = nil
+	x.queued = make(map[string]*verifyItem)
+	x.unverified = 0
+	x.bytes = 0
+	x.lines = 0
+}
+
+func (x *keyIndex) readLog() error {
+	x.reset()
+	f, err := os.Open(x.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e indexEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			// a torn write at the end of the log from a crash
+			// is expected. anything else isn't
+			if scanner.Scan() {
+				return errors.New("corrupt key index")
+			}
+			break
+		}
+		x.apply(e)
+		x.lines++
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	x.sorted = make([]string, 0, len(x.entries))
+	for k := range x.entries {
+		x.sorted = append(x.sorted, k)
+	}
+	sort.Strings(x.sorted)
+	return x.openLog()
+}
+
+// update the in memory maps. doesn't touch x.sorted
+func (x *keyIndex) apply(e indexEntry) {
+	h := strings.TrimPrefix(e.Key, "sha1:")
+	old, existed := x.entries[e.Key]
+	x.requeue(old, existed, e)
+	if existed {
+		x.bytes -= old.Size
+	}
+	if e.Deleted {
+		if existed {
+			x.digests.remove(h)
+		}
+		delete(x.entries, e.Key)
+		return
+	}
+	if !existed {
+		x.digests.add(h)
+	}
+	x.entries[e.Key] = e
+	x.bytes += e.Size
+}
+
+// keep byVerified and the count of unverified keys in step with
+// a change to an entry
+func (x *keyIndex) requeue(old indexEntry, existed bool, e indexEntry) {
+	if existed && old.Verified.IsZero() {
+		x.unverified--
+	}
+	it := x.queued[e.Key]
+	if e.Deleted {
+		if it != nil {
+			heap.Remove(&x.byVerified, it.i)
+			delete(x.queued, e.Key)
+		}
+		return
+	}
+	if e.Verified.IsZero() {
+		x.unverified++
+	}
+	if it != nil {
+		if !it.verified.Equal(e.Verified) {
+			it.verified = e.Verified
+			heap.Fix(&x.byVerified, it.i)
+		}
+		return
+	}
+	it = &verifyItem{key: e.Key, verified: e.Verified}
+	x.queued[e.Key] = it
+	heap.Push(&x.byVerified, it)
+}
+
+func (x *keyIndex) openLog() error {
+	if x.log != nil {
+		x.log.Close()
+	}
+	f, err := os.OpenFile(x.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	x.log = f
+	return nil
+}
+
+// throw away what we have and scan the backend for everything
+func (x *keyIndex) Rebuild() error {
+	x.load()
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	return x.rebuild()
+}
+
+func (x *keyIndex) rebuild() error {
+	slog.Info("rebuilding key index", "path", x.path, "op", "index")
+	x.reset()
+	err := x.scan(func(e indexEntry) {
+		if _, ok := x.entries[e.Key]; !ok {
+			x.sorted = append(x.sorted, e.Key)
+		}
+		x.apply(e)
+	})
+	if err != nil {
+		return err
+	}
+	sort.Strings(x.sorted)
+	slog.Info("key index rebuilt", "path", x.path, "op", "index", "keys", len(x.entries))
+	return x.compact()
+}
+
+// write out just the live entries and switch to that
+func (x *keyIndex) compact() error {
+	tmp := x.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, k := range x.sorted {
+		if err := enc.Encode(x.entries[k]); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	// it has to be on the disk before it replaces the old log, or a
+	// crash could leave us with an empty index
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, x.path); err != nil {
+		return err
+	}
+	if err := syncDir(filepath.Dir(x.path)); err != nil {
+		return err
+	}
+	x.lines = len(x.entries)
+	return x.openLog()
+}
+
+// makes a rename or removal in the directory stick
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// flushes the log to the disk and closes it
+func (x *keyIndex) Close() error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.log == nil {
+		return nil
+	}
+	err := x.log.Sync()
+	if cerr := x.log.Close(); err == nil {
+		err = cerr
+	}
+	x.log = nil
+	return err
+}
+
+// must hold the lock
+func (x *keyIndex) append(e indexEntry) {
+	_, existed := x.entries[e.Key]
+	x.apply(e)
+	_, exists := x.entries[e.Key]
+	if exists && !existed {
+		i, _ := slices.BinarySearch(x.sorted, e.Key)
+		x.sorted = slices.Insert(x.sorted, i, e.Key)
+	} else if existed && !exists {
+		if i, found := slices.BinarySearch(x.sorted, e.Key); found {
+			x.sorted = slices.Delete(x.sorted, i, i+1)
+		}
+	}
+	if x.log == nil {
+		return
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		slog.Error("couldn't encode index entry", "key", e.Key, "op", "index", "err", err)
+		return
+	}
+	if _, err := x.log.Write(append(b, '\n')); err != nil {
+		slog.Error("couldn't write to key index", "key", e.Key, "op", "index", "err", err)
+		return
+	}
+	x.lines++
+	if x.lines > 2*len(x.entries)+1000 {
+		if err := x.compact(); err != nil {
+			slog.Error("couldn't compact key index", "path", x.path, "op", "index", "err", err)
+		}
+	}
+}
+
+func (x *keyIndex) Put(k key, size int64) {
+	x.load()
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	e := indexEntry{Key: k.String(), Size: size, Stored: time.Now()}
+	if old, ok := x.entries[e.Key]; ok {
+		// rewriting the same content doesn't make it new
+		e.Stored = old.Stored
+	}
+	x.append(e)
+}
+
+func (x *keyIndex) Delete(k key) {
+	x.load()
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if _, ok := x.entries[k.String()]; ok {
+		x.append(indexEntry{Key: k.String(), Deleted: true})
+	}
+}
+
+func (x *keyIndex) MarkVerified(k key, t time.Time) {
+	x.load()
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if e, ok := x.entries[k.String()]; ok {
+		e.Verified = t
+		x.append(e)
+	}
+}
+
+func (x *keyIndex) Has(k key) bool {
+	x.load()
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	_, ok := x.entries[k.String()]
+	return ok
+}
+
+func (x *keyIndex) Count() int64 {
+	x.load()
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	return int64(len(x.entries))
+}
+
+// keys after `after`, in order
+func (x *keyIndex) List(after string, limit int) []indexEntry {
+	x.load()
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	i := sort.SearchStrings(x.sorted, after)
+	if i < len(x.sorted) && x.sorted[i] == after {
+		i++
+	}
+	var results []indexEntry
+	for ; i < len(x.sorted); i++ {
+		if limit > 0 && len(results) >= limit {
+			break
+		}
+		results = append(results, x.entries[x.sorted[i]])
+	}
+	return results
+}
+
+// how many keys are in the range, and their digest
+func (x *keyIndex) RangeDigest(r keyRange) (int, setDigest) {
+	x.load()
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	return x.digests.sum(r, func(from string, fn func(string) bool) {
+		for i := sort.SearchStrings(x.sorted, "sha1:"+from); i < len(x.sorted); i++ {
+			if !fn(strings.TrimPrefix(x.sorted[i], "sha1:")) {
+				return
+			}
+		}
+	})
+}
+
+// the keys that have gone the longest without being checked.
+// ones that have never been checked come first
+func (x *keyIndex) LeastRecentlyVerified(limit int) []indexEntry {
+	x.load()
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	var entries []indexEntry
+	for _, it := range x.byVerified.first(limit) {
+		entries = append(entries, x.entries[it.key])
+	}
+	return entries
+}
+
+func (x *keyIndex) Stats() indexStats {
+	x.load()
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	st := indexStats{Keys: int64(len(x.entries)), Bytes: x.bytes, Unverified: x.unverified}
+	if st.Unverified == 0 && len(x.byVerified) > 0 {
+		st.OldestVerified = x.byVerified[0].verified
+	}
+	return st
+}
+
+type verifyItem struct {
+	key      string
+	verified time.Time
+	// where it is in the heap
+	i int
+}
+
+func verifiedBefore(a, b *verifyItem) bool {
+	if a.verified.Equal(b.verified) {
+		return a.key < b.key
+	}
+	return a.verified.Before(b.verified)
+}
+
+// a heap of keys by when they were last verified
+type verifyQueue []*verifyItem
+
+func (q verifyQueue) Len() int           { return len(q) }
+func (q verifyQueue) Less(i, j int) bool { return verifiedBefore(q[i], q[j]) }
+
+func (q verifyQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].i = i
+	q[j].i = j
+}
+
+func (q *verifyQueue) Push(x any) {
+	it := x.(*verifyItem)
+	it.i = len(*q)
+	*q = append(*q, it)
+}
+
+func (q *verifyQueue) Pop() any {
+	old := *q
+	it := old[len(old)-1]
+	old[len(old)-1] = nil
+	*q = old[:len(old)-1]
+	return it
+}
+
+// the first n, in order, without taking them off the heap. the
+// next one is always a child of one already taken, so only those
+// have to be looked at
+func (q verifyQueue) first(n int) []*verifyItem {
+	var results []*verifyItem
+	next := &heapPositions{q: q}
+	if len(q) > 0 {
+		heap.Push(next, 0)
+	}
+	for len(results) < n && next.Len() > 0 {
+		i := heap.Pop(next).(int)
+		results = append(results, q[i])
+		for _, c := range []int{2*i + 1, 2*i + 2} {
+			if c < len(q) {
+				heap.Push(next, c)
+			}
+		}
+	}
+	return results
+}
+
+// positions in a verifyQueue, as a heap of their own
+type heapPositions struct {
+	q   verifyQueue
+	pos []int
+}
+
+func (h *heapPositions) Len() int           { return len(h.pos) }
+func (h *heapPositions) Less(i, j int) bool { return verifiedBefore(h.q[h.pos[i]], h.q[h.pos[j]]) }
+func (h *heapPositions) Swap(i, j int)      { h.pos[i], h.pos[j] = h.pos[j], h.pos[i] }
+func (h *heapPositions) Push(x any)         { h.pos = append(h.pos, x.(int)) }
+
+func (h *heapPositions) Pop() any {
+	i := h.pos[len(h.pos)-1]
+	h.pos = h.pos[:len(h.pos)-1]
+	return i
+}
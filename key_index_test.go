@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+func testKeys(t *testing.T, strs ...string) []key {
+	var keys []key
+	for _, s := range strs {
+		k, err := keyFromString(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, *k)
+	}
+	return keys
+}
+
+func noScan(func(indexEntry)) error { return nil }
+
+func TestKeyIndexPersists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "index.log")
+	keys := testKeys(t,
+		"sha1:f48dd853820860816c75d54d0f58d47663456009",
+		"sha1:a94a8fe5ccb19ba61c4c0873d391e987982fbbd3",
+		"sha1:0000000000000000000000000000000000000000",
+	)
+	x := newKeyIndex(path, noScan)
+	x.Put(keys[0], 10)
+	x.Put(keys[1], 20)
+	x.Put(keys[2], 30)
+	x.Delete(keys[2])
+	verified := time.Now().Add(-time.Hour).Truncate(time.Second)
+	x.MarkVerified(keys[1], verified)
+
+	x = newKeyIndex(path, noScan)
+	if x.Count() != 2 {
+		t.Fatalf("expected 2 keys after reload, got %d", x.Count())
+	}
+	st := x.Stats()
+	if st.Bytes != 30 || st.Unverified != 1 {
+		t.Errorf("unexpected stats: %+v", st)
+	}
+	entries := x.List("", 0)
+	if len(entries) != 2 || entries[0].Key != keys[1].String() || entries[1].Key != keys[0].String() {
+		t.Fatalf("keys not in order: %v", entries)
+	}
+	if !entries[0].Verified.Equal(verified) {
+		t.Errorf("verification time was lost: %v", entries[0].Verified)
+	}
+	if entries := x.List(keys[1].String(), 1); len(entries) != 1 || entries[0].Key != keys[0].String() {
+		t.Errorf("paging didn't work: %v", entries)
+	}
+
+	// never verified comes first
+	lrv := x.LeastRecentlyVerified(1)
+	if len(lrv) != 1 || lrv[0].Key != keys[0].String() {
+		t.Errorf("expected the unverified key first, got %v", lrv)
+	}
+}
+
+func TestKeyIndexTornWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "index.log")
+	keys := testKeys(t, "sha1:f48dd853820860816c75d54d0f58d47663456009")
+	x := newKeyIndex(path, noScan)
+	x.Put(keys[0], 10)
+
+	f, _ := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	_, _ = f.WriteString(`{"key":"sha1:a94a8fe5`)
+	f.Close()
+
+	scanned := false
+	x = newKeyIndex(path, func(func(indexEntry)) error {
+		scanned = true
+		return nil
+	})
+	if x.Count() != 1 || scanned {
+		t.Errorf("a torn write at the end shouldn't need a rebuild")
+	}
+}
+
+func TestKeyIndexRebuildsWhenMissing(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "index.log")
+	keys := testKeys(t,
+		"sha1:f48dd853820860816c75d54d0f58d47663456009",
+		"sha1:a94a8fe5ccb19ba61c4c0873d391e987982fbbd3",
+	)
+	x := newKeyIndex(path, func(fn func(indexEntry)) error {
+		for _, k := range keys {
+			fn(indexEntry{Key: k.String(), Size: 5})
+		}
+		return nil
+	})
+	if x.Count() != 2 || x.Stats().Bytes != 10 {
+		t.Errorf("expected the index to be rebuilt from a scan: %+v", x.Stats())
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("rebuilt index should have been saved: %v", err)
+	}
+}
+
+func TestKeyIndexCompacts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "index.log")
+	keys := testKeys(t, "sha1:f48dd853820860816c75d54d0f58d47663456009")
+	x := newKeyIndex(path, noScan)
+	for i := 0; i < 2000; i++ {
+		x.MarkVerified(keys[0], time.Now())
+		x.Put(keys[0], 10)
+	}
+	if x.lines > 1100 {
+		t.Errorf("log should have been compacted, has %d lines", x.lines)
+	}
+	x = newKeyIndex(path, noScan)
+	if x.Count() != 1 {
+		t.Errorf("expected 1 key after compaction, got %d", x.Count())
+	}
+}
+
+func TestDiskBackendIndexCatchesUp(t *testing.T) {
+	tmpdir := t.TempDir()
+	backend := newDiskBackend(tmpdir + "/")
+	k, _ := keyFromString("sha1:a94a8fe5ccb19ba61c4c0873d391e987982fbbd3")
+	_ = backend.Write(*k, io.NopCloser(bytes.NewReader([]byte("test"))))
+
+	// a file that got written without making it into the index
+	other, _ := keyFromString("sha1:f48dd853820860816c75d54d0f58d47663456009")
+	dir := backend.Root + other.Algorithm + "/" + other.AsPath()
+	_ = os.MkdirAll(dir, 0755)
+	_ = os.WriteFile(dir+"/data", []byte("test data"), 0644)
+	if backend.BlobCount() != 1 {
+		t.Fatalf("expected only the indexed key to be counted")
+	}
+	if !backend.Exists(*other) || backend.BlobCount() != 2 {
+		t.Errorf("Exists should have added the file to the index")
+	}
+
+	if err := backend.RebuildIndex(); err != nil {
+		t.Fatal(err)
+	}
+	if st := backend.IndexStats(); st.Keys != 2 || st.Bytes != 13 {
+		t.Errorf("unexpected stats after rebuild: %+v", st)
+	}
+}
+
+func TestKeyIndexLeastRecentlyVerified(t *testing.T) {
+	x := newKeyIndex(filepath.Join(t.TempDir(), "index.log"), noScan)
+	var keys []key
+	for i := 0; i < 300; i++ {
+		keys = append(keys, testKeys(t, fmt.Sprintf("sha1:%040x", i*7919))...)
+		x.Put(keys[i], 1)
+	}
+	start := time.Now().Add(-time.Hour)
+	// verify them out of order, some more than once
+	for i := 0; i < 600; i++ {
+		x.MarkVerified(keys[(i*37)%250], start.Add(time.Duration(i)*time.Second))
+	}
+	x.Delete(keys[260])
+
+	want := x.List("", 0)
+	sort.Slice(want, func(i, j int) bool {
+		if want[i].Verified.Equal(want[j].Verified) {
+			return want[i].Key < want[j].Key
+		}
+		return want[i].Verified.Before(want[j].Verified)
+	})
+	for _, limit := range []int{1, 49, 100, 400} {
+		got := x.LeastRecentlyVerified(limit)
+		if len(got) != min(limit, len(want)) {
+			t.Fatalf("asked for %d, got %d", limit, len(got))
+		}
+		for i := range got {
+			if got[i].Key != want[i].Key {
+				t.Fatalf("limit %d: entry %d is %s, want %s", limit, i, got[i].Key, want[i].Key)
+			}
+		}
+	}
+	st := x.Stats()
+	if st.Unverified != 49 || !st.OldestVerified.IsZero() {
+		t.Errorf("unexpected stats: %+v", st)
+	}
+}
+
+func TestKeyIndexClose(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "index.log")
+	keys := testKeys(t, "sha1:f48dd853820860816c75d54d0f58d47663456009")
+	x := newKeyIndex(path, noScan)
+	x.Put(keys[0], 10)
+	if err := x.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := x.Close(); err != nil {
+		t.Errorf("closing twice should be fine: %v", err)
+	}
+	x = newKeyIndex(path, noScan)
+	if !x.Has(keys[0]) {
+		t.Error("expected the key to be in the log after closing")
+	}
+}
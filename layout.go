@@ -0,0 +1,137 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// how the disk backend lays files out under its root. the version
+// in use is kept in a LAYOUT file in the root, so a node never
+// runs against files it doesn't know how to find. packed files
+// (see pack_store.go) are the same in every layout.
+type diskLayout int
+
+const (
+	// sha1/ae/28/60/.../f6/99/data: a directory for every two
+	// characters of the hash
+	layoutDeep diskLayout = 1
+	// sha1/ae/28/ae28605f...f699: two levels of directories, then
+	// the file, named after the hash. far fewer inodes
+	layoutShallow diskLayout = 2
+
+	latestLayout = layoutShallow
+)
+
+const (
+	layoutFile = "LAYOUT"
+	// there while a migration is running, with the layout it's
+	// migrating to
+	layoutMigratingFile = "LAYOUT.migrating"
+)
+
+func (l diskLayout) known() bool {
+	return l >= layoutDeep && l <= latestLayout
+}
+
+// the directory the file for the key goes in
+func (l diskLayout) dir(root string, k key) string {
+	if l == layoutShallow {
+		h := string(k.Value)
+		return root + k.Algorithm + "/" + h[0:2] + "/" + h[2:4]
+	}
+	return root + k.Algorithm + "/" + k.AsPath()
+}
+
+func (l diskLayout) path(root string, k key) string {
+	if l == layoutShallow {
+		return l.dir(root, k) + "/" + string(k.Value)
+	}
+	return l.dir(root, k) + "/data"
+}
+
+func (l diskLayout) remove(root string, k key) error {
+	if l == layoutShallow {
+		return os.RemoveAll(l.path(root, k))
+	}
+	return os.RemoveAll(l.dir(root, k))
+}
+
+func isHash(s string) bool {
+	if len(s) != 40 {
+		return false
+	}
+	for _, c := range s {
+		if !strings.ContainsRune("0123456789abcdef", c) {
+			return false
+		}
+	}
+	return true
+}
+
+var errMigrationRunning = errors.New("a layout migration hasn't finished. run `cask migrate-layout` to finish it")
+
+// what layout a root uses. a root without a LAYOUT file is on
+// the deep layout if it has anything in it already, otherwise
+// it's new and gets the one asked for
+func detectLayout(root string, fresh diskLayout) (diskLayout, bool, error) {
+	if _, err := os.Stat(root + layoutMigratingFile); err == nil {
+		return 0, false, errMigrationRunning
+	}
+	data, err := os.ReadFile(root + layoutFile)
+	if err == nil {
+		v, err := strconv.Atoi(strings.TrimSpace(string(data)))
+		if err != nil {
+			return 0, true, fmt.Errorf("can't parse %s%s: %s", root, layoutFile, err)
+		}
+		return diskLayout(v), true, nil
+	}
+	if !os.IsNotExist(err) {
+		return 0, false, err
+	}
+	if _, err := os.Stat(root + "sha1"); err == nil {
+		return layoutDeep, false, nil
+	}
+	return fresh, false, nil
+}
+
+func writeLayout(root string, l diskLayout) error {
+	tmp := root + layoutFile + ".tmp"
+	if err := os.WriteFile(tmp, []byte(strconv.Itoa(int(l))+"\n"), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, root+layoutFile)
+}
+
+// finds out what layout the root is on, refusing ones we don't
+// know, and records it if it wasn't already
+func (d *diskBackend) CheckLayout(fresh diskLayout) error {
+	l, found, err := detectLayout(d.Root, fresh)
+	if err != nil {
+		return err
+	}
+	if !l.known() {
+		return fmt.Errorf("%s uses disk layout %d, but this version of cask only knows up to %d", d.Root, l, latestLayout)
+	}
+	if !found {
+		if err := writeLayout(d.Root, l); err != nil {
+			return err
+		}
+	}
+	d.layout = l
+	return nil
+}
+
+// remove directories that have been emptied out, up to (but not
+// including) stop
+func removeEmptyDirs(dir, stop string) {
+	for dir != stop && strings.HasPrefix(dir, stop) {
+		if err := os.Remove(dir); err != nil {
+			return
+		}
+		dir = filepath.Dir(dir)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+func Test_keyFromPathShallow(t *testing.T) {
+	h := "a94a8fe5ccb19ba61c4c0873d391e987982fbbd3"
+	k, err := keyFromPath("/data/sha1/a9/4a/" + h)
+	if err != nil || k.String() != "sha1:"+h {
+		t.Errorf("unexpected key: %v %v", k, err)
+	}
+	if _, err := keyFromPath("/data/sha1/a9/ff/" + h); err == nil {
+		t.Errorf("file in the wrong directory should be an error")
+	}
+}
+
+func TestCheckLayout(t *testing.T) {
+	root := t.TempDir() + "/"
+	d := newDiskBackend(root)
+	if err := d.CheckLayout(layoutShallow); err != nil || d.layout != layoutShallow {
+		t.Errorf("a new root should get the layout asked for: %v %d", err, d.layout)
+	}
+	if data, _ := os.ReadFile(root + layoutFile); strings.TrimSpace(string(data)) != "2" {
+		t.Errorf("layout wasn't recorded: %q", data)
+	}
+
+	// an old root with files and no marker is on the deep layout
+	old := t.TempDir() + "/"
+	_ = os.MkdirAll(old+"sha1", 0755)
+	d = newDiskBackend(old)
+	if err := d.CheckLayout(layoutShallow); err != nil || d.layout != layoutDeep {
+		t.Errorf("expected the deep layout: %v %d", err, d.layout)
+	}
+
+	_ = writeLayout(old, 99)
+	if err := newDiskBackend(old).CheckLayout(layoutDeep); err == nil {
+		t.Errorf("an unknown layout should be refused")
+	}
+	_ = writeLayout(old, layoutDeep)
+	_ = os.WriteFile(old+layoutMigratingFile, []byte("2\n"), 0644)
+	if err := newDiskBackend(old).CheckLayout(layoutDeep); err != errMigrationRunning {
+		t.Errorf("a half done migration should be refused, got %v", err)
+	}
+}
+
+func TestDiskBackendShallowLayout(t *testing.T) {
+	root := t.TempDir() + "/"
+	d := newDiskBackend(root)
+	_ = d.CheckLayout(layoutShallow)
+	k, _ := keyFromString(contentKey("shallow"))
+	if err := d.Write(*k, io.NopCloser(bytes.NewReader([]byte("shallow")))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(root + "sha1/" + string(k.Value[:2]) + "/" + string(k.Value[2:4]) + "/" + string(k.Value)); err != nil {
+		t.Errorf("file isn't where the shallow layout puts it: %v", err)
+	}
+	if data, err := d.Read(*k); err != nil || string(data) != "shallow" {
+		t.Errorf("unexpected read: %q %v", data, err)
+	}
+	if err := d.RebuildIndex(); err != nil || d.BlobCount() != 1 {
+		t.Errorf("index rebuild should find the file: %v %d", err, d.BlobCount())
+	}
+	if err := d.NewVerifier(nil).VerifyKey(*k); err != nil {
+		t.Errorf("verify failed: %v", err)
+	}
+	_ = d.Delete(*k)
+	if d.Exists(*k) {
+		t.Errorf("file should have been deleted")
+	}
+}
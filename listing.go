@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// listing the keys on a node, or across the whole cluster. the
+// responses are newline delimited JSON so they can be streamed
+// without holding everything in memory on either end.
+
+type keyListing struct {
+	Key  string `json:"key"`
+	Size int64  `json:"size"`
+	// which nodes have it. only for cluster listings
+	Nodes []string `json:"nodes,omitempty"`
+}
+
+// a listing that was cut short ends with one of these instead
+// of a keyListing, so it can't be mistaken for a complete one
+type incompleteListing struct {
+	Msg string `json:"error"`
+	// the nodes whose keys are missing, for cluster listings
+	Nodes []string `json:"failed_nodes,omitempty"`
+}
+
+func (l *incompleteListing) Error() string {
+	if len(l.Nodes) == 0 {
+		return l.Msg
+	}
+	return l.Msg + ": " + strings.Join(l.Nodes, ", ")
+}
+
+// how many keys to fetch at a time, from a backend or a node
+const listPageSize = 1000
+
+// every backend can list what it has stored
+type keyLister interface {
+	// keys stored, in sorted order, starting after the given
+	// key (or the beginning for ""). a limit of 0 means all.
+	List(after string, limit int) ([]keyInfo, error)
+}
+
+type keyInfo struct {
+	Key  key
+	Size int64
+}
+
+// page through everything a backend has stored
+func forEachKey(b backend, fn func(keyInfo) error) error {
+	after := ""
+	for {
+		keys, err := b.List(after, listPageSize)
+		if err != nil {
+			return err
+		}
+		for _, k := range keys {
+			if err := fn(k); err != nil {
+				return err
+			}
+		}
+		if len(keys) < listPageSize {
+			return nil
+		}
+		after = keys[len(keys)-1].Key.String()
+	}
+}
+
+func parseListParams(r *http.Request) (string, int, error) {
+	after := r.FormValue("after")
+	if after != "" {
+		if _, err := keyFromString(after); err != nil {
+			return "", 0, err
+		}
+	}
+	limit := 0
+	if l := r.FormValue("limit"); l != "" {
+		var err error
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit < 0 {
+			return "", 0, strconv.ErrSyntax
+		}
+	}
+	return after, limit, nil
+}
+
+// writes a line for each listing, flushing after every page
+type listingWriter struct {
+	w     http.ResponseWriter
+	enc   *json.Encoder
+	count int
+}
+
+func newListingWriter(w http.ResponseWriter) *listingWriter {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	return &listingWriter{w: w, enc: json.NewEncoder(w)}
+}
+
+func (lw *listingWriter) Write(l keyListing) error {
+	if err := lw.enc.Encode(l); err != nil {
+		return err
+	}
+	lw.count++
+	if lw.count%listPageSize == 0 {
+		if f, ok := lw.w.(http.Flusher); ok {
+			f.Flush()
+		}
+	}
+	return nil
+}
+
+// ends the listing with an error record
+func (lw *listingWriter) Fail(l *incompleteListing) error {
+	return lw.enc.Encode(l)
+}
+
+// streams the keys from one backend, starting after `after`.
+// a limit of 0 means everything
+func streamLocalKeys(lw *listingWriter, b backend, after string, limit int) error {
+	for {
+		page := listPageSize
+		if limit > 0 && limit-lw.count < page {
+			page = limit - lw.count
+		}
+		keys, err := b.List(after, page)
+		if err != nil {
+			return err
+		}
+		for _, k := range keys {
+			if err := lw.Write(keyListing{Key: k.Key.String(), Size: k.Size}); err != nil {
+				return err
+			}
+			after = k.Key.String()
+		}
+		if len(keys) < page || (limit > 0 && lw.count >= limit) {
+			return nil
+		}
+	}
+}
+
+// one node's keys, fetched a page at a time
+type keyCursor struct {
+	uuid  string
+	fetch func(after string, limit int) ([]keyListing, error)
+	page  []keyListing
+	after string
+	done  bool
+}
+
+func (c *keyCursor) fill() error {
+	if len(c.page) > 0 || c.done {
+		return nil
+	}
+	page, err := c.fetch(c.after, listPageSize)
+	if err != nil {
+		c.done = true
+		return err
+	}
+	c.page = page
+	if len(page) < listPageSize {
+		c.done = true
+	}
+	if len(page) > 0 {
+		c.after = page[len(page)-1].Key
+	}
+	return nil
+}
+
+func backendCursor(uuid string, b backend, after string) *keyCursor {
+	return &keyCursor{
+		uuid:  uuid,
+		after: after,
+		fetch: func(after string, limit int) ([]keyListing, error) {
+			keys, err := b.List(after, limit)
+			if err != nil {
+				return nil, err
+			}
+			var results []keyListing
+			for _, k := range keys {
+				results = append(results, keyListing{Key: k.Key.String(), Size: k.Size})
+			}
+			return results, nil
+		},
+	}
+}
+
+func nodeCursor(ctx context.Context, n node, secret, after string) *keyCursor {
+	return &keyCursor{
+		uuid:  n.UUID,
+		after: after,
+		fetch: func(after string, limit int) ([]keyListing, error) {
+			return n.ListKeys(ctx, after, limit, secret)
+		},
+	}
+}
+
+// merge the (sorted) listings from each cursor, so every key
+// only shows up once, along with which nodes have it. if any
+// of them can't be read, the listing ends with an error record
+// naming them
+func mergeKeyListings(lw *listingWriter, cursors []*keyCursor, limit int) {
+	var failed []string
+	defer func() {
+		if len(failed) > 0 {
+			_ = lw.Fail(&incompleteListing{Msg: "couldn't list keys on every node", Nodes: failed})
+		}
+	}()
+	for limit == 0 || lw.count < limit {
+		var next *keyListing
+		for _, c := range cursors {
+			if err := c.fill(); err != nil {
+				slog.Warn("couldn't list keys", "peer", c.uuid, "op", "list_keys", "err", err)
+				failed = append(failed, c.uuid)
+				continue
+			}
+			if len(c.page) > 0 && (next == nil || c.page[0].Key < next.Key) {
+				next = &keyListing{Key: c.page[0].Key, Size: c.page[0].Size}
+			}
+		}
+		if next == nil {
+			return
+		}
+		for _, c := range cursors {
+			if len(c.page) > 0 && c.page[0].Key == next.Key {
+				next.Nodes = append(next.Nodes, c.uuid)
+				c.page = c.page[1:]
+			}
+		}
+		if err := lw.Write(*next); err != nil {
+			return
+		}
+	}
+}
+
+// the keys in a listing. if it ended with an error record,
+// they come back along with an *incompleteListing
+func readKeyListings(r io.Reader) ([]keyListing, error) {
+	var results []keyListing
+	dec := json.NewDecoder(r)
+	for {
+		var l struct {
+			keyListing
+			Error  string   `json:"error"`
+			Failed []string `json:"failed_nodes"`
+		}
+		err := dec.Decode(&l)
+		if err == io.EOF {
+			return results, nil
+		}
+		if err != nil {
+			return results, err
+		}
+		if l.Error != "" {
+			return results, &incompleteListing{Msg: l.Error, Nodes: l.Failed}
+		}
+		results = append(results, l.keyListing)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+func listingSite(uuid string, keys ...string) *site {
+	n := newNode(uuid, "", true)
+	mb := &MockBackendFull{data: map[string][]byte{}}
+	for _, k := range keys {
+		mb.data[k] = []byte(k)
+	}
+	return &site{Node: n, Cluster: newCluster(n, "secret", 60), Backend: mb, ClusterSecret: "secret"}
+}
+
+func Test_localKeysHandler(t *testing.T) {
+	s := listingSite("test",
+		"sha1:f48dd853820860816c75d54d0f58d47663456009",
+		"sha1:a94a8fe5ccb19ba61c4c0873d391e987982fbbd3",
+		"sha1:0000000000000000000000000000000000000000",
+	)
+	mux := http.NewServeMux()
+	// both have to be registrable together
+	mux.HandleFunc("GET /local/{key}/", makeHandler(localHandler, s))
+	mux.HandleFunc("GET /local/keys/", makeHandler(localKeysHandler, s))
+
+	req := httptest.NewRequest("GET", "/local/keys/", nil)
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("got status %d, want %d", rr.Code, http.StatusForbidden)
+	}
+
+	req = httptest.NewRequest("GET", "/local/keys/", nil)
+	req.Header.Set("X-Cask-Cluster-Secret", "secret")
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	keys, err := readKeyListings(rr.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 3 || keys[0].Key != "sha1:0000000000000000000000000000000000000000" || keys[0].Size != 45 {
+		t.Errorf("unexpected listing: %v", keys)
+	}
+
+	req = httptest.NewRequest("GET", "/local/keys/?after=sha1:0000000000000000000000000000000000000000&limit=1", nil)
+	req.Header.Set("X-Cask-Cluster-Secret", "secret")
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	keys, _ = readKeyListings(rr.Body)
+	if len(keys) != 1 || keys[0].Key != "sha1:a94a8fe5ccb19ba61c4c0873d391e987982fbbd3" {
+		t.Errorf("paging didn't work: %v", keys)
+	}
+
+	req = httptest.NewRequest("GET", "/local/keys/?limit=lots", nil)
+	req.Header.Set("X-Cask-Cluster-Secret", "secret")
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("got status %d, want %d", rr.Code, http.StatusBadRequest)
+	}
+}
+
+func Test_clusterKeysHandler(t *testing.T) {
+	peer := listingSite("peer",
+		"sha1:a94a8fe5ccb19ba61c4c0873d391e987982fbbd3",
+		"sha1:f48dd853820860816c75d54d0f58d47663456009",
+	)
+	ts := httptest.NewServer(makeHandler(localKeysHandler, peer))
+	defer ts.Close()
+
+	s := listingSite("local",
+		"sha1:0000000000000000000000000000000000000000",
+		"sha1:a94a8fe5ccb19ba61c4c0873d391e987982fbbd3",
+	)
+	s.Cluster.AddNeighbor(*newNode("peer", ts.URL, true))
+	// a node that's down shouldn't stop the listing
+	s.Cluster.AddNeighbor(*newNode("down", "http://localhost:1", true))
+
+	req := httptest.NewRequest("GET", "/keys/", nil)
+	req.Header.Set("X-Cask-Cluster-Secret", "secret")
+	rr := httptest.NewRecorder()
+	clusterKeysHandler(rr, req, s)
+	keys, err := readKeyListings(rr.Body)
+	var incomplete *incompleteListing
+	if !errors.As(err, &incomplete) || !slices.Equal(incomplete.Nodes, []string{"down"}) {
+		t.Fatalf("the listing should say which node it couldn't read, got %v", err)
+	}
+	if len(keys) != 3 {
+		t.Fatalf("expected 3 keys, got %v", keys)
+	}
+	shared := keys[1]
+	slices.Sort(shared.Nodes)
+	if shared.Key != "sha1:a94a8fe5ccb19ba61c4c0873d391e987982fbbd3" || !slices.Equal(shared.Nodes, []string{"local", "peer"}) {
+		t.Errorf("shared key should be listed once with both nodes: %v", shared)
+	}
+	if !slices.Equal(keys[2].Nodes, []string{"peer"}) {
+		t.Errorf("unexpected nodes for %s: %v", keys[2].Key, keys[2].Nodes)
+	}
+
+	req = httptest.NewRequest("GET", "/keys/?limit=2", nil)
+	req.Header.Set("X-Cask-Cluster-Secret", "secret")
+	rr = httptest.NewRecorder()
+	clusterKeysHandler(rr, req, s)
+	keys, _ = readKeyListings(rr.Body)
+	if len(keys) != 2 {
+		t.Errorf("expected the limit to be respected, got %v", keys)
+	}
+}
+
+func Test_readKeyListingsIncomplete(t *testing.T) {
+	rr := httptest.NewRecorder()
+	lw := newListingWriter(rr)
+	_ = lw.Write(keyListing{Key: "sha1:0000000000000000000000000000000000000000"})
+	_ = lw.Fail(&incompleteListing{Msg: "couldn't list keys"})
+	keys, err := readKeyListings(rr.Body)
+	if err == nil || err.Error() != "couldn't list keys" || len(keys) != 1 {
+		t.Errorf("expected the key and then an error, got %v, %v", keys, err)
+	}
+}
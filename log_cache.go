@@ -1,47 +1,184 @@
 package main
 
 import (
+	"context"
+	"log/slog"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 )
 
+// one log entry, with its fields flattened to strings so they're
+// easy to filter on and show
+type logRecord struct {
+	Time   time.Time         `json:"time"`
+	Level  slog.Level        `json:"level"`
+	Msg    string            `json:"msg"`
+	Fields map[string]string `json:"fields,omitempty"`
+}
+
+// the message followed by its fields, sorted so it's stable
+func (r logRecord) String() string {
+	var b strings.Builder
+	b.WriteString(r.Msg)
+	keys := make([]string, 0, len(r.Fields))
+	for k := range r.Fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		b.WriteString(" " + k + "=" + r.Fields[k])
+	}
+	return b.String()
+}
+
+// which records to show. an empty field matches anything
+type logFilter struct {
+	Level     slog.Level
+	Key       string
+	RequestID string
+}
+
+func (f logFilter) matches(r logRecord) bool {
+	if r.Level < f.Level {
+		return false
+	}
+	if f.Key != "" && r.Fields["key"] != f.Key {
+		return false
+	}
+	if f.RequestID != "" && r.Fields["request_id"] != f.RequestID {
+		return false
+	}
+	return true
+}
+
 type LogCache struct {
 	mu   sync.Mutex
-	logs []string
+	logs []logRecord
 	size int
 }
 
 func newLogCache(size int) *LogCache {
 	return &LogCache{
 		size: size,
-		logs: make([]string, 0, size),
+		logs: make([]logRecord, 0, size),
 	}
 }
 
-func (lc *LogCache) Write(p []byte) (n int, err error) {
+func (lc *LogCache) add(r logRecord) {
 	lc.mu.Lock()
-	defer lc.mu.Unlock()
+	lc.logs = append(lc.logs, r)
+	if len(lc.logs) > lc.size {
+		// Keep the last `size` elements
+		lc.logs = lc.logs[len(lc.logs)-lc.size:]
+	}
+	lc.mu.Unlock()
+	// and out to anyone watching /log/stream/
+	liveFeed.Publish(feedMessage{Log: &r})
+}
 
+// raw lines are kept as INFO records with no fields
+func (lc *LogCache) Write(p []byte) (n int, err error) {
 	msg := string(p)
 	// Remove trailing newline if present for cleaner display
 	if len(msg) > 0 && msg[len(msg)-1] == '\n' {
 		msg = msg[:len(msg)-1]
 	}
-
-	lc.logs = append(lc.logs, msg)
-	if len(lc.logs) > lc.size {
-		// Keep the last `size` elements
-		lc.logs = lc.logs[len(lc.logs)-lc.size:]
-	}
-
+	lc.add(logRecord{Time: time.Now(), Level: slog.LevelInfo, Msg: msg})
 	return len(p), nil
 }
 
 func (lc *LogCache) GetLogs() []string {
+	records := lc.Records(logFilter{Level: slog.LevelDebug})
+	result := make([]string, len(records))
+	for i, r := range records {
+		result[i] = r.String()
+	}
+	return result
+}
+
+// a copy of the records that match, oldest first
+func (lc *LogCache) Records(f logFilter) []logRecord {
 	lc.mu.Lock()
 	defer lc.mu.Unlock()
-	
-	// Return a copy
-	result := make([]string, len(lc.logs))
-	copy(result, lc.logs)
+	var result []logRecord
+	for _, r := range lc.logs {
+		if f.matches(r) {
+			result = append(result, r)
+		}
+	}
 	return result
 }
+
+// a slog.Handler that keeps records in the cache
+func (lc *LogCache) Handler(level slog.Leveler) slog.Handler {
+	return &cacheHandler{lc: lc, level: level}
+}
+
+type cacheHandler struct {
+	lc     *LogCache
+	level  slog.Leveler
+	fields []slog.Attr
+	group  string
+}
+
+func (h *cacheHandler) Enabled(_ context.Context, l slog.Level) bool {
+	return l >= h.level.Level()
+}
+
+func (h *cacheHandler) Handle(_ context.Context, r slog.Record) error {
+	rec := logRecord{Time: r.Time, Level: r.Level, Msg: r.Message}
+	if len(h.fields) > 0 || r.NumAttrs() > 0 {
+		rec.Fields = make(map[string]string)
+	}
+	for _, a := range h.fields {
+		flatten(rec.Fields, "", a)
+	}
+	r.Attrs(func(a slog.Attr) bool {
+		flatten(rec.Fields, h.group, a)
+		return true
+	})
+	h.lc.add(rec)
+	return nil
+}
+
+func (h *cacheHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	h2 := *h
+	h2.fields = append([]slog.Attr{}, h.fields...)
+	for _, a := range attrs {
+		if h.group != "" {
+			a.Key = h.group + a.Key
+		}
+		h2.fields = append(h2.fields, a)
+	}
+	return &h2
+}
+
+func (h *cacheHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	h2 := *h
+	h2.group = h.group + name + "."
+	return &h2
+}
+
+// groups turn into dotted keys
+func flatten(fields map[string]string, prefix string, a slog.Attr) {
+	v := a.Value.Resolve()
+	if v.Kind() == slog.KindGroup {
+		p := prefix
+		if a.Key != "" {
+			p += a.Key + "."
+		}
+		for _, g := range v.Group() {
+			flatten(fields, p, g)
+		}
+		return
+	}
+	if a.Key == "" {
+		return
+	}
+	fields[prefix+a.Key] = v.String()
+}
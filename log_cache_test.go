@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"log/slog"
 	"testing"
 )
 
@@ -54,3 +55,25 @@ func TestLogCache(t *testing.T) {
 		t.Errorf("expected 10 bytes written, got %d", n)
 	}
 }
+
+func TestLogCacheFilter(t *testing.T) {
+	lc := newLogCache(10)
+	l := slog.New(lc.Handler(slog.LevelDebug))
+	l.Debug("looking", "key", "sha1:aaa", "request_id", "r1")
+	l.Warn("couldn't read", "key", "sha1:aaa", "request_id", "r2")
+	l.Error("disk gone", "request_id", "r2")
+
+	count := func(f logFilter) int { return len(lc.Records(f)) }
+	if n := count(logFilter{Level: slog.LevelWarn}); n != 2 {
+		t.Errorf("expected 2 warnings and up, got %d", n)
+	}
+	if n := count(logFilter{Level: slog.LevelDebug, Key: "sha1:aaa"}); n != 2 {
+		t.Errorf("expected 2 records for the key, got %d", n)
+	}
+	if n := count(logFilter{Level: slog.LevelWarn, Key: "sha1:aaa", RequestID: "r2"}); n != 1 {
+		t.Errorf("expected 1 record, got %d", n)
+	}
+	if got := lc.GetLogs()[1]; got != "couldn't read key=sha1:aaa request_id=r2" {
+		t.Errorf("unexpected line %q", got)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// logging goes through slog, to stderr and to the log cache behind
+// /log/. records carry fields like key, peer, op and request_id so
+// they can be filtered. anything that still goes through the log
+// package comes out as INFO with no fields.
+
+// every request gets an ID. it's sent on to any peers the request
+// talks to, so the logs for one upload or read can be pulled
+// together across the cluster
+const requestIDHeader = "X-Cask-Request-ID"
+
+type requestIDKey struct{}
+
+func withRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// keep the ID the caller sent, as long as it looks sane, otherwise
+// make a new one
+func incomingRequestID(r *http.Request) string {
+	id := r.Header.Get(requestIDHeader)
+	if id == "" || len(id) > 64 || strings.ContainsFunc(id, func(c rune) bool {
+		return c <= ' ' || c > '~'
+	}) {
+		return randomHex(8)
+	}
+	return id
+}
+
+// sets the headers that carry a request on to a peer
+func propagate(ctx context.Context, req *http.Request) {
+	injectTrace(ctx, req)
+	if id := requestID(ctx); id != "" {
+		req.Header.Set(requestIDHeader, id)
+	}
+}
+
+// the default logger, with the request ID on it if there is one
+func logger(ctx context.Context) *slog.Logger {
+	if id := requestID(ctx); id != "" {
+		return slog.Default().With("request_id", id)
+	}
+	return slog.Default()
+}
+
+// sends records on to several handlers
+type teeHandler []slog.Handler
+
+func (t teeHandler) Enabled(ctx context.Context, l slog.Level) bool {
+	for _, h := range t {
+		if h.Enabled(ctx, l) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t teeHandler) Handle(ctx context.Context, r slog.Record) error {
+	var errs []error
+	for _, h := range t {
+		if h.Enabled(ctx, r.Level) {
+			errs = append(errs, h.Handle(ctx, r.Clone()))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (t teeHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	out := make(teeHandler, len(t))
+	for i, h := range t {
+		out[i] = h.WithAttrs(attrs)
+	}
+	return out
+}
+
+func (t teeHandler) WithGroup(name string) slog.Handler {
+	out := make(teeHandler, len(t))
+	for i, h := range t {
+		out[i] = h.WithGroup(name)
+	}
+	return out
+}
+
+var errUnknownLogFormat = errors.New("log format has to be text or json")
+
+// level is debug, info, warn or error. format is text or json
+func newLogHandler(level, format string, lc *LogCache) (slog.Handler, error) {
+	var l slog.Level
+	if level != "" {
+		if err := l.UnmarshalText([]byte(level)); err != nil {
+			return nil, err
+		}
+	}
+	opts := &slog.HandlerOptions{Level: l}
+	var out slog.Handler
+	switch format {
+	case "", "text":
+		out = slog.NewTextHandler(os.Stderr, opts)
+	case "json":
+		out = slog.NewJSONHandler(os.Stderr, opts)
+	default:
+		return nil, errUnknownLogFormat
+	}
+	return teeHandler{out, lc.Handler(l)}, nil
+}
+
+// makes slog the default, which also sends the log package through it
+func setupLogging(level, format, node string, lc *LogCache) error {
+	h, err := newLogHandler(level, format, lc)
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(slog.New(h).With("node", node))
+	return nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"log"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+// sends the default logger to a log cache for the test
+func testLogs(t *testing.T) *LogCache {
+	lc := newLogCache(100)
+	old := slog.Default()
+	slog.SetDefault(slog.New(lc.Handler(slog.LevelDebug)))
+	t.Cleanup(func() {
+		slog.SetDefault(old)
+		log.SetOutput(os.Stderr)
+		log.SetFlags(log.LstdFlags)
+	})
+	return lc
+}
+
+func TestRequestIDPropagates(t *testing.T) {
+	var got string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Get(requestIDHeader)
+		http.NotFound(w, r)
+	}))
+	defer ts.Close()
+	n := newNode("peer", ts.URL, true)
+	k, _ := keyFromString(contentKey("anything"))
+	_, _ = n.RetrieveContext(withRequestID(context.Background(), "abc123"), *k, "secret")
+	if got != "abc123" {
+		t.Errorf("peer got request ID %q", got)
+	}
+}
+
+func TestInstrumentRequestID(t *testing.T) {
+	var seen string
+	h := instrument(func(w http.ResponseWriter, r *http.Request) {
+		seen = requestID(r.Context())
+	})
+
+	rr := httptest.NewRecorder()
+	h(rr, httptest.NewRequest("GET", "/", nil))
+	if seen == "" || rr.Header().Get(requestIDHeader) != seen {
+		t.Errorf("should make up a request ID and send it back: %q %q", seen, rr.Header().Get(requestIDHeader))
+	}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set(requestIDHeader, "from-the-caller")
+	h(httptest.NewRecorder(), req)
+	if seen != "from-the-caller" {
+		t.Errorf("should keep the caller's request ID, got %q", seen)
+	}
+
+	req = httptest.NewRequest("GET", "/", nil)
+	req.Header.Set(requestIDHeader, "bad\nid")
+	h(httptest.NewRecorder(), req)
+	if seen == "bad\nid" {
+		t.Errorf("shouldn't accept a request ID with control characters")
+	}
+}
+
+func TestPeerFailureLogged(t *testing.T) {
+	lc := testLogs(t)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "oops", 500)
+	}))
+	defer ts.Close()
+	n := newNode("broken-peer", ts.URL, true)
+	k, _ := keyFromString(contentKey("logged"))
+	n.AddFileWithHint(withRequestID(context.Background(), "req-1"), *k, strings.NewReader("logged"), "secret", "")
+
+	logs := lc.Records(logFilter{Level: slog.LevelWarn, RequestID: "req-1"})
+	if len(logs) != 1 {
+		t.Fatalf("expected one warning, got %v", logs)
+	}
+	f := logs[0].Fields
+	if f["peer"] != "broken-peer" || f["op"] != "add_file" || f["key"] != k.String() {
+		t.Errorf("missing fields: %v", f)
+	}
+}
+
+func TestLogPackageGoesThroughSlog(t *testing.T) {
+	lc := newLogCache(10)
+	h, err := newLogHandler("warn", "json", lc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := slog.New(h).With("node", "abcd1234")
+	l.Info("too quiet")
+	l.Warn("loud enough", slog.Group("disk", "root", "/tmp/"))
+	logs := lc.Records(logFilter{Level: slog.LevelDebug})
+	if len(logs) != 1 || logs[0].Fields["node"] != "abcd1234" || logs[0].Fields["disk.root"] != "/tmp/" {
+		t.Errorf("unexpected records: %v", logs)
+	}
+
+	lc = testLogs(t)
+	log.Println("an old style message")
+	if logs := lc.GetLogs(); len(logs) != 1 || logs[0] != "an old style message" {
+		t.Errorf("log package output wasn't captured: %v", logs)
+	}
+
+	if _, err := newLogHandler("loud", "", lc); err == nil {
+		t.Errorf("should reject an unknown level")
+	}
+	if _, err := newLogHandler("", "xml", lc); err == nil {
+		t.Errorf("should reject an unknown format")
+	}
+}
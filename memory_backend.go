@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"slices"
+	"sync"
+	"time"
+)
+
+// keeps everything in memory, up to MaxBytes. once it's full, the
+// least recently used files get thrown out to make room. good for a
+// caching node in front of the rest of the cluster, or for tests.
+type memoryBackend struct {
+	MaxBytes uint64
+	// only holds copies of files that the rest of the cluster has.
+	// they get filled in when they're read and don't get rebalanced
+	ReadThrough bool
+
+	mu      sync.Mutex
+	used    uint64
+	lru     *list.List
+	entries map[string]*list.Element
+	// the keys in order, for listing
+	sorted []string
+}
+
+type memoryEntry struct {
+	key  key
+	data []byte
+}
+
+var errTooBigForMemory = errors.New("file is bigger than the memory backend")
+
+func newMemoryBackend(maxBytes uint64) *memoryBackend {
+	return &memoryBackend{
+		MaxBytes: maxBytes,
+		lru:      list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+func (m *memoryBackend) String() string {
+	return "Memory"
+}
+
+func (m *memoryBackend) Write(key key, r io.ReadCloser) error {
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		slog.Error("error reading data into memory", "key", key.String(), "op", "write", "err", err)
+		return err
+	}
+	if uint64(len(data)) > m.MaxBytes {
+		return errTooBigForMemory
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.remove(key.String())
+	for m.used+uint64(len(data)) > m.MaxBytes {
+		oldest := m.lru.Back()
+		e := oldest.Value.(*memoryEntry)
+		slog.Debug("evicting from memory", "key", e.key.String(), "op", "write")
+		memoryEvictions.Inc()
+		m.remove(e.key.String())
+	}
+	m.entries[key.String()] = m.lru.PushFront(&memoryEntry{key: key, data: data})
+	m.used += uint64(len(data))
+	i, _ := slices.BinarySearch(m.sorted, key.String())
+	m.sorted = slices.Insert(m.sorted, i, key.String())
+	return nil
+}
+
+// needs the lock held
+func (m *memoryBackend) remove(k string) bool {
+	el, ok := m.entries[k]
+	if !ok {
+		return false
+	}
+	m.used -= uint64(len(el.Value.(*memoryEntry).data))
+	m.lru.Remove(el)
+	delete(m.entries, k)
+	if i, found := slices.BinarySearch(m.sorted, k); found {
+		m.sorted = slices.Delete(m.sorted, i, i+1)
+	}
+	return true
+}
+
+func (m *memoryBackend) Read(key key) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	el, ok := m.entries[key.String()]
+	if !ok {
+		return nil, errors.New("not in memory")
+	}
+	m.lru.MoveToFront(el)
+	return el.Value.(*memoryEntry).data, nil
+}
+
+// doesn't count as a use, so checking for a file won't keep it
+// around any longer
+func (m *memoryBackend) Exists(key key) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.entries[key.String()]
+	return ok
+}
+
+func (m *memoryBackend) Delete(key key) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.remove(key.String())
+	return nil
+}
+
+func (m *memoryBackend) FreeSpace() uint64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.MaxBytes - m.used
+}
+
+func (m *memoryBackend) Capacity() uint64 {
+	return m.MaxBytes
+}
+
+func (m *memoryBackend) BlobCount() int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return int64(len(m.entries))
+}
+
+func (m *memoryBackend) CachesReads() bool {
+	return m.ReadThrough
+}
+
+func (m *memoryBackend) List(after string, limit int) ([]keyInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	i, found := slices.BinarySearch(m.sorted, after)
+	if found {
+		i++
+	}
+	var results []keyInfo
+	for ; i < len(m.sorted); i++ {
+		if limit > 0 && len(results) >= limit {
+			break
+		}
+		e := m.entries[m.sorted[i]].Value.(*memoryEntry)
+		results = append(results, keyInfo{Key: e.key, Size: int64(len(e.data))})
+	}
+	return results, nil
+}
+
+// walks through everything in memory, checking it and making sure
+// it's replicated. a read-through cache only checks its copies,
+// since the rest of the cluster is looking after the originals
+func (m *memoryBackend) ActiveAntiEntropy(cluster *cluster, site site, interval int) {
+	for {
+		err := forEachKey(m, func(ki keyInfo) error {
+			l := slog.With("key", ki.Key.String(), "op", "aae")
+			if err := site.VerifyKey(ki.Key); err != nil {
+				l.Warn("AAE failed", "err", err)
+			}
+			if !m.ReadThrough && m.Exists(ki.Key) {
+				if err := site.Rebalance(ki.Key); err != nil {
+					l.Warn("AAE failed", "err", err)
+				}
+			}
+			jitter := rand.Intn(5)
+			time.Sleep(time.Duration(interval+jitter) * time.Second)
+			return nil
+		})
+		if err != nil {
+			slog.Error("couldn't list keys", "op", "aae", "err", err)
+		}
+		jitter := rand.Intn(5)
+		time.Sleep(time.Duration(interval+jitter) * time.Second)
+	}
+}
+
+type memoryVerifier struct {
+	b *memoryBackend
+	c *cluster
+}
+
+func (m *memoryBackend) NewVerifier(c *cluster) verifier {
+	return &memoryVerifier{b: m, c: c}
+}
+
+func (v *memoryVerifier) Verify(path string, key key, h string) error {
+	if key.String() == "sha1:"+h {
+		verifications.WithLabelValues("ok").Inc()
+		return nil
+	}
+	slog.Warn("corrupted file in memory", "key", key.String(), "op", "verify")
+	verifications.WithLabelValues("corrupt").Inc()
+	recordEvent(eventCorrupt, key, "", "in memory")
+	_ = v.b.Delete(key)
+	if v.b.ReadThrough {
+		// it'll get fetched again the next time someone wants it
+		return nil
+	}
+	err := v.repair(key)
+	if err != nil {
+		verifications.WithLabelValues("unrepairable").Inc()
+		recordEvent(eventRepairFailed, key, "", err.Error())
+	} else {
+		verifications.WithLabelValues("repaired").Inc()
+		recordEvent(eventRepaired, key, "", "")
+	}
+	return err
+}
+
+func (v *memoryVerifier) repair(key key) error {
+	if v.c == nil {
+		return errors.New("unrepairable file")
+	}
+	data, err := v.c.Retrieve(key)
+	if err != nil {
+		return errors.New("unrepairable file")
+	}
+	if fmt.Sprintf("sha1:%x", sha1.Sum(data)) != key.String() {
+		return errors.New("unrepairable file")
+	}
+	slog.Info("successfully repaired file", "key", key.String(), "op", "repair")
+	return v.b.Write(key, io.NopCloser(bytes.NewReader(data)))
+}
+
+func (v *memoryVerifier) VerifyKey(key key) error {
+	v.b.mu.Lock()
+	el, ok := v.b.entries[key.String()]
+	v.b.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	// not going through Read() so checking doesn't count as a use
+	data := el.Value.(*memoryEntry).data
+	return v.Verify(key.String(), key, fmt.Sprintf("%x", sha1.Sum(data)))
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// a node with a memory backend, serving the local endpoints
+func memoryPeer(t *testing.T, m *memoryBackend) *httptest.Server {
+	s := listingSite("peer")
+	s.Backend = m
+	s.MaxUploadSize = 1000
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /local/", makeHandler(handleLocalPost, s))
+	mux.HandleFunc("GET /local/{key}/", makeHandler(localHandler, s))
+	ts := httptest.NewServer(mux)
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func memoryWrite(t *testing.T, m *memoryBackend, content string) key {
+	k, _ := keyFromString(contentKey(content))
+	if err := m.Write(*k, io.NopCloser(bytes.NewReader([]byte(content)))); err != nil {
+		t.Fatal(err)
+	}
+	return *k
+}
+
+func TestMemoryBackendEvictsLeastRecentlyUsed(t *testing.T) {
+	m := newMemoryBackend(10)
+	a := memoryWrite(t, m, "aaaa")
+	b := memoryWrite(t, m, "bbbb")
+	// reading a makes b the oldest
+	if data, err := m.Read(a); err != nil || string(data) != "aaaa" {
+		t.Fatalf("unexpected read: %q %v", data, err)
+	}
+	c := memoryWrite(t, m, "cccc")
+	if m.Exists(b) {
+		t.Errorf("b should have been evicted")
+	}
+	if !m.Exists(a) || !m.Exists(c) {
+		t.Errorf("a and c should still be there")
+	}
+	if m.FreeSpace() != 2 || m.BlobCount() != 2 {
+		t.Errorf("unexpected usage: %d free, %d files", m.FreeSpace(), m.BlobCount())
+	}
+
+	// rewriting a key shouldn't count it twice
+	memoryWrite(t, m, "aaaa")
+	if m.FreeSpace() != 2 {
+		t.Errorf("expected 2 bytes free, got %d", m.FreeSpace())
+	}
+
+	k, _ := keyFromString(contentKey("too big for it"))
+	if err := m.Write(*k, io.NopCloser(bytes.NewReader([]byte("too big for it")))); err != errTooBigForMemory {
+		t.Errorf("expected errTooBigForMemory, got %v", err)
+	}
+	if !m.Exists(a) {
+		t.Errorf("a file that can't fit shouldn't evict anything")
+	}
+
+	_ = m.Delete(a)
+	if m.Exists(a) || m.FreeSpace() != 6 {
+		t.Errorf("delete didn't free up space: %d", m.FreeSpace())
+	}
+}
+
+func TestMemoryBackendList(t *testing.T) {
+	m := newMemoryBackend(1000)
+	for _, s := range []string{"one", "two", "three"} {
+		memoryWrite(t, m, s)
+	}
+	all, _ := m.List("", 0)
+	if len(all) != 3 {
+		t.Fatalf("expected 3 keys, got %v", all)
+	}
+	for i := 1; i < len(all); i++ {
+		if all[i-1].Key.String() >= all[i].Key.String() {
+			t.Errorf("keys not in order: %v", all)
+		}
+	}
+	page, _ := m.List(all[0].Key.String(), 1)
+	if len(page) != 1 || page[0].Key.String() != all[1].Key.String() {
+		t.Errorf("paging didn't work: %v", page)
+	}
+	// writing one again shouldn't list it twice, and deleting one
+	// should take it out
+	memoryWrite(t, m, "two")
+	_ = m.Delete(all[0].Key)
+	rest, _ := m.List("", 0)
+	if len(rest) != 2 || rest[0].Key.String() != all[1].Key.String() {
+		t.Errorf("unexpected listing after changes: %v", rest)
+	}
+}
+
+func TestMemoryVerifierRepairs(t *testing.T) {
+	peer := newMemoryBackend(1000)
+	good := memoryWrite(t, peer, "the real thing")
+	ts := memoryPeer(t, peer)
+
+	m := newMemoryBackend(1000)
+	n := newNode("local", "", true)
+	c := newCluster(n, "secret", 60)
+	c.AddNeighbor(*newNode("peer", ts.URL, true))
+	// stored under the wrong key, as if it got corrupted
+	_ = m.Write(good, io.NopCloser(bytes.NewReader([]byte("something else"))))
+
+	v := m.NewVerifier(c)
+	if err := v.VerifyKey(good); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := m.Read(good); string(data) != "the real thing" {
+		t.Errorf("file wasn't repaired: %q", data)
+	}
+
+	// a cache just drops it
+	m.ReadThrough = true
+	_ = m.Write(good, io.NopCloser(bytes.NewReader([]byte("something else"))))
+	if err := v.VerifyKey(good); err != nil {
+		t.Fatal(err)
+	}
+	if m.Exists(good) {
+		t.Errorf("corrupted cache entry should have been dropped")
+	}
+}
+
+func TestMemoryBackendReadThrough(t *testing.T) {
+	peer := newMemoryBackend(1000)
+	k := memoryWrite(t, peer, "cache me")
+	ts := memoryPeer(t, peer)
+
+	cache := newMemoryBackend(1000)
+	cache.ReadThrough = true
+	n := newNode("cache", "", false)
+	c := newCluster(n, "secret", 60)
+	c.AddNeighbor(*newNode("peer", ts.URL, true))
+	s := &site{Node: n, Cluster: c, Backend: cache, Replication: 1, MaxReplication: 1}
+	s.verifier = cache.NewVerifier(c)
+	s.rebalancer = newRebalancer(c, *s)
+
+	req := httptest.NewRequest("GET", "/file/"+k.String()+"/", nil)
+	req.SetPathValue("key", k.String())
+	rr := httptest.NewRecorder()
+	fileHandler(rr, req, s)
+	if rr.Code != http.StatusOK || rr.Body.String() != "cache me" {
+		t.Fatalf("unexpected response: %d %q", rr.Code, rr.Body.String())
+	}
+	if !cache.Exists(k) {
+		t.Fatalf("file should have been cached")
+	}
+
+	// served from memory now, even with the peer gone
+	ts.Close()
+	rr = httptest.NewRecorder()
+	fileHandler(rr, req, s)
+	if rr.Code != http.StatusOK || rr.Body.String() != "cache me" {
+		t.Errorf("expected a cache hit: %d %q", rr.Code, rr.Body.String())
+	}
+}
+
+func TestMemoryBackendRebalance(t *testing.T) {
+	// two real nodes, without touching the filesystem
+	peer := newMemoryBackend(1000)
+	ts := memoryPeer(t, peer)
+
+	m := newMemoryBackend(1000)
+	k := memoryWrite(t, m, "replicate me")
+	n := newNode("local", "", true)
+	c := newCluster(n, "secret", 60)
+	c.AddNeighbor(*newNode("peer", ts.URL, true))
+	s := site{Node: n, Cluster: c, Backend: m, Replication: 2, MaxReplication: 2}
+	r := newRebalancer(c, s)
+	if err := r.Rebalance(k); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := peer.Read(k); err != nil || string(data) != "replicate me" {
+		t.Errorf("file wasn't replicated to the peer: %q %v", data, err)
+	}
+}
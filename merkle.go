@@ -0,0 +1,471 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"math/rand"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// replica sets are kept in sync by comparing hash trees over
+// the parts of the ring that two nodes both own. each node
+// summarizes a range of keys as a digest, plus digests for
+// each of `merkleFanout` equal sub-ranges. if the digests for
+// a range match, everything in it is already in sync. if not,
+// only the sub-ranges that differ are looked at, until they
+// are small enough to just swap lists of keys.
+
+const (
+	merkleFanout = 16
+	// ranges with at most this many keys come with the keys
+	merkleLeafSize = 64
+)
+
+// keys strictly after Start, up to and including End. an empty
+// Start is the beginning of the keyspace, an empty End is the
+// end of it. both are hex sha1s, without the "sha1:"
+type keyRange struct {
+	Start string `json:"start"`
+	End   string `json:"end"`
+}
+
+func (r keyRange) String() string {
+	return "(" + r.Start + ", " + r.End + "]"
+}
+
+func (r keyRange) contains(h string) bool {
+	return h > r.Start && (r.End == "" || h <= r.End)
+}
+
+type rangeSummary struct {
+	keyRange
+	Count    int            `json:"count"`
+	Digest   string         `json:"digest"`
+	Children []rangeSummary `json:"children,omitempty"`
+	// only filled in for leaves
+	Leaf bool     `json:"leaf"`
+	Keys []string `json:"keys,omitempty"`
+}
+
+var maxHash = new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 160), big.NewInt(1))
+
+func validRangeBound(s string) bool {
+	if s == "" {
+		return true
+	}
+	if len(s) != 40 {
+		return false
+	}
+	_, ok := new(big.Int).SetString(s, 16)
+	return ok
+}
+
+// split the range into merkleFanout roughly equal parts. nil if
+// it's too narrow to split
+func (r keyRange) split() []keyRange {
+	lo := big.NewInt(0)
+	if r.Start != "" {
+		lo.SetString(r.Start, 16)
+	}
+	hi := new(big.Int).Set(maxHash)
+	if r.End != "" {
+		hi.SetString(r.End, 16)
+	}
+	width := new(big.Int).Sub(hi, lo)
+	if width.Cmp(big.NewInt(merkleFanout)) < 0 {
+		return nil
+	}
+	children := make([]keyRange, merkleFanout)
+	start := r.Start
+	for i := 1; i < merkleFanout; i++ {
+		b := new(big.Int).Mul(width, big.NewInt(int64(i)))
+		b.Div(b, big.NewInt(merkleFanout))
+		b.Add(b, lo)
+		end := fmt.Sprintf("%040x", b)
+		children[i-1] = keyRange{start, end}
+		start = end
+	}
+	children[merkleFanout-1] = keyRange{start, r.End}
+	return children
+}
+
+// walk through the keys the backend has in the range, in order
+func forEachKeyInRange(b backend, r keyRange, fn func(string) error) error {
+	after := ""
+	if r.Start != "" {
+		after = "sha1:" + r.Start
+	}
+	for {
+		keys, err := b.List(after, 1000)
+		if err != nil {
+			return err
+		}
+		for _, ki := range keys {
+			h := strings.TrimPrefix(ki.Key.String(), "sha1:")
+			if !r.contains(h) {
+				return nil
+			}
+			if err := fn(h); err != nil {
+				return err
+			}
+		}
+		if len(keys) < 1000 {
+			return nil
+		}
+		after = keys[len(keys)-1].Key.String()
+	}
+}
+
+// a range's digest is the xor of the sha1s of its keys. the order
+// doesn't matter, so it can be kept up to date one key at a time
+// instead of being worked out from a list of every key
+type setDigest [sha1.Size]byte
+
+func keyDigest(h string) setDigest {
+	return sha1.Sum([]byte(h))
+}
+
+func (d *setDigest) toggle(o setDigest) {
+	for i := range d {
+		d[i] ^= o[i]
+	}
+}
+
+func (d setDigest) String() string {
+	return hex.EncodeToString(d[:])
+}
+
+// digests for every hex prefix of a key up to digestTreeDepth
+// characters long. any range can be added up from the prefixes
+// that fit inside it, plus the few keys at its edges
+const digestTreeDepth = 4
+
+type digestNode struct {
+	count  int
+	digest setDigest
+}
+
+type digestTree map[string]digestNode
+
+func (t digestTree) add(h string) {
+	t.update(h, 1)
+}
+
+func (t digestTree) remove(h string) {
+	t.update(h, -1)
+}
+
+func (t digestTree) update(h string, delta int) {
+	d := keyDigest(h)
+	for l := 0; l <= digestTreeDepth && l <= len(h); l++ {
+		n := t[h[:l]]
+		n.count += delta
+		n.digest.toggle(d)
+		if n.count <= 0 {
+			delete(t, h[:l])
+			continue
+		}
+		t[h[:l]] = n
+	}
+}
+
+// walk calls fn with the keys from `from` on, in order, until fn
+// returns false. it's only used for the edges of the range
+func (t digestTree) sum(r keyRange, walk func(from string, fn func(string) bool)) (int, setDigest) {
+	count := 0
+	var d setDigest
+	var visit func(p string)
+	visit = func(p string) {
+		n, ok := t[p]
+		if !ok {
+			return
+		}
+		lo := p + strings.Repeat("0", 40-len(p))
+		hi := p + strings.Repeat("f", 40-len(p))
+		if hi <= r.Start || (r.End != "" && lo > r.End) {
+			return
+		}
+		if lo > r.Start && (r.End == "" || hi <= r.End) {
+			count += n.count
+			d.toggle(n.digest)
+			return
+		}
+		if len(p) == digestTreeDepth {
+			walk(p, func(h string) bool {
+				if !strings.HasPrefix(h, p) {
+					return false
+				}
+				if r.contains(h) {
+					count++
+					d.toggle(keyDigest(h))
+				}
+				return true
+			})
+			return
+		}
+		for _, c := range "0123456789abcdef" {
+			visit(p + string(c))
+		}
+	}
+	visit("")
+	return count, d
+}
+
+// backends that keep their digests up to date as keys are written
+// and deleted, so a range can be summarized without listing it
+type rangeDigester interface {
+	RangeDigest(r keyRange) (int, setDigest)
+}
+
+func summarizeRange(b backend, r keyRange) (rangeSummary, error) {
+	children := r.split()
+	digests := make([]setDigest, len(children))
+	summary := rangeSummary{keyRange: r}
+	for _, c := range children {
+		summary.Children = append(summary.Children, rangeSummary{keyRange: c})
+	}
+	var root setDigest
+	var keys []string
+	rd, indexed := b.(rangeDigester)
+	if indexed {
+		for i, c := range children {
+			summary.Children[i].Count, digests[i] = rd.RangeDigest(c)
+			summary.Count += summary.Children[i].Count
+		}
+		if len(children) == 0 {
+			summary.Count, root = rd.RangeDigest(r)
+		}
+	} else {
+		err := forEachKeyInRange(b, r, func(h string) error {
+			summary.Count++
+			if summary.Count <= merkleLeafSize || len(children) == 0 {
+				keys = append(keys, h)
+			}
+			if len(children) == 0 {
+				root.toggle(keyDigest(h))
+				return nil
+			}
+			i := sort.Search(len(children), func(i int) bool {
+				return children[i].End == "" || h <= children[i].End
+			})
+			summary.Children[i].Count++
+			digests[i].toggle(keyDigest(h))
+			return nil
+		})
+		if err != nil {
+			return summary, err
+		}
+	}
+	for i := range summary.Children {
+		summary.Children[i].Digest = digests[i].String()
+		root.toggle(digests[i])
+	}
+	summary.Digest = root.String()
+	if summary.Count <= merkleLeafSize || len(children) == 0 {
+		if indexed {
+			// only a few, so listing them is cheap
+			err := forEachKeyInRange(b, r, func(h string) error {
+				keys = append(keys, h)
+				return nil
+			})
+			if err != nil {
+				return summary, err
+			}
+		}
+		summary.Leaf = true
+		summary.Keys = keys
+	}
+	return summary, nil
+}
+
+// for each other node, the parts of the ring where it and this
+// node are both in the replica set
+func sharedRanges(ring ringEntryList, self string, replication int) map[string][]keyRange {
+	peers := make(map[string][]keyRange)
+	if len(ring) == 0 {
+		return peers
+	}
+	seen := map[string]bool{}
+	for _, e := range ring {
+		seen[e.Node.UUID] = true
+	}
+	// start from the second entry so the arc that wraps around
+	// the end of the keyspace comes last and can be merged
+	for j := 1; j <= len(ring); j++ {
+		i := j % len(ring)
+		prev := ring[j-1].Hash
+		// every key in (prev, ring[i].Hash] has the same replica set
+		owners := replicaSet(withoutDraining(hashOrder("sha1:"+prev, len(seen), ring)), replication)
+		if !slices.Contains(owners, self) {
+			continue
+		}
+		arcs := []keyRange{{prev, ring[i].Hash}}
+		if i == 0 {
+			arcs = []keyRange{{prev, ""}, {"", ring[i].Hash}}
+		}
+		for _, uuid := range owners {
+			if uuid != self {
+				peers[uuid] = appendRange(peers[uuid], arcs...)
+			}
+		}
+	}
+	return peers
+}
+
+// adjacent arcs get merged so there are fewer trees to compare
+func appendRange(ranges []keyRange, add ...keyRange) []keyRange {
+	for _, r := range add {
+		if len(ranges) > 0 && ranges[len(ranges)-1].End == r.Start && r.Start != "" {
+			ranges[len(ranges)-1].End = r.End
+			continue
+		}
+		ranges = append(ranges, r)
+	}
+	return ranges
+}
+
+func withoutDraining(nodes []node) []node {
+	var results []node
+	for _, n := range nodes {
+		if !n.Draining {
+			results = append(results, n)
+		}
+	}
+	return results
+}
+
+// periodically compare trees with every node we share data with
+func (s site) MerkleAntiEntropy(interval int) {
+	for {
+		jitter := rand.Intn(5)
+		time.Sleep(time.Duration(interval+jitter) * time.Second)
+		s.syncReplicaSets()
+	}
+}
+
+func (s site) syncReplicaSets() {
+	// one ID for the whole pass, so its logs on the peers can be
+	// pulled together
+	ctx := withRequestID(context.Background(), randomHex(8))
+	peers := sharedRanges(classRing(s.Cluster.Ring(), s.self().class()), s.Node.UUID, s.Replication)
+	for uuid, ranges := range peers {
+		n, ok := s.Cluster.FindNeighborByUUID(uuid)
+		if !ok || n.Unhealthy() {
+			continue
+		}
+		l := logger(ctx).With("peer", uuid, "op", "merkle_sync")
+		repaired := 0
+		for _, r := range ranges {
+			c, err := s.syncRange(ctx, *n, r)
+			repaired += c
+			if err != nil {
+				l.Warn("merkle sync failed", "range", r.String(), "err", err)
+				break
+			}
+		}
+		if repaired > 0 {
+			l.Info("merkle sync repaired keys", "repaired", repaired)
+		}
+	}
+}
+
+// bring this node and n into agreement over the range. returns
+// how many keys had to be copied one way or the other
+func (s site) syncRange(ctx context.Context, n node, r keyRange) (int, error) {
+	merkleRangesCompared.Inc()
+	local, err := summarizeRange(s.Backend, r)
+	if err != nil {
+		return 0, err
+	}
+	remote, err := n.RangeSummary(ctx, r, s.ClusterSecret)
+	if err != nil {
+		return 0, err
+	}
+	if local.Digest == remote.Digest {
+		return 0, nil
+	}
+	if local.Leaf && remote.Leaf {
+		return s.repairRange(ctx, n, local.Keys, remote.Keys), nil
+	}
+	if len(local.Children) != len(remote.Children) {
+		return 0, errors.New("mismatched range summaries")
+	}
+	repaired := 0
+	for i := range local.Children {
+		if local.Children[i].Digest == remote.Children[i].Digest {
+			continue
+		}
+		c, err := s.syncRange(ctx, n, local.Children[i].keyRange)
+		repaired += c
+		if err != nil {
+			return repaired, err
+		}
+	}
+	return repaired, nil
+}
+
+// each side gets a copy of whatever the other is missing
+func (s site) repairRange(ctx context.Context, n node, local, remote []string) int {
+	l := logger(ctx).With("peer", n.UUID, "op", "merkle_sync")
+	have := make(map[string]bool)
+	for _, h := range remote {
+		have[h] = true
+	}
+	repaired := 0
+	for _, h := range local {
+		if have[h] {
+			delete(have, h)
+			continue
+		}
+		k, err := keyFromString("sha1:" + h)
+		if err != nil || !n.Writeable || n.Draining || s.migrated(*k) {
+			continue
+		}
+		data, err := s.Backend.Read(*k)
+		if err != nil {
+			continue
+		}
+		if n.AddFileWithHint(ctx, *k, bytes.NewReader(data), s.ClusterSecret, "") {
+			l.Info("merkle sync pushed", "key", k.String())
+			merkleKeysRepaired.Inc()
+			repaired++
+		}
+	}
+	if self := s.self(); !self.Writeable || self.Draining {
+		return repaired
+	}
+	// what's left is only on the other node
+	for h := range have {
+		k, err := keyFromString("sha1:" + h)
+		if err != nil || s.migrated(*k) {
+			continue
+		}
+		found, data, err := n.CheckFile(*k, s.ClusterSecret)
+		if !found {
+			continue
+		}
+		// never store a bad copy over what may be our only chance
+		// of getting a good one from somewhere else
+		if err != nil || !doublecheckReplica(data, *k) {
+			l.Warn("merkle sync got a corrupt copy", "key", k.String())
+			continue
+		}
+		if err := s.Backend.Write(*k, io.NopCloser(bytes.NewReader(data))); err != nil {
+			l.Error("merkle sync couldn't write", "key", k.String(), "err", err)
+			continue
+		}
+		l.Info("merkle sync pulled", "key", k.String())
+		merkleKeysRepaired.Inc()
+		repaired++
+	}
+	return repaired
+}
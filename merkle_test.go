@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func contentKey(content string) string {
+	return fmt.Sprintf("sha1:%x", sha1.Sum([]byte(content)))
+}
+
+func Test_keyRangeSplit(t *testing.T) {
+	for _, r := range []keyRange{
+		{},
+		{"8000000000000000000000000000000000000000", ""},
+		{"", "0000000000000000000000000000000000000100"},
+	} {
+		children := r.split()
+		if len(children) != merkleFanout {
+			t.Fatalf("expected %d children, got %d", merkleFanout, len(children))
+		}
+		if children[0].Start != r.Start || children[len(children)-1].End != r.End {
+			t.Errorf("children of %s don't cover it: %v", r, children)
+		}
+		for i := 1; i < len(children); i++ {
+			if children[i].Start != children[i-1].End || children[i].Start <= children[i-1].Start {
+				t.Errorf("children of %s aren't contiguous: %v", r, children)
+			}
+		}
+	}
+
+	narrow := keyRange{"0000000000000000000000000000000000000001", "0000000000000000000000000000000000000005"}
+	if children := narrow.split(); children != nil {
+		t.Errorf("shouldn't split a range that narrow: %v", children)
+	}
+}
+
+func Test_summarizeRange(t *testing.T) {
+	a := &MockBackendFull{data: map[string][]byte{}}
+	b := &MockBackendFull{data: map[string][]byte{}}
+	for i := 0; i < 200; i++ {
+		a.data[contentKey(fmt.Sprint(i))] = []byte(fmt.Sprint(i))
+		b.data[contentKey(fmt.Sprint(i))] = []byte(fmt.Sprint(i))
+	}
+
+	sa, err := summarizeRange(a, keyRange{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sb, _ := summarizeRange(b, keyRange{})
+	if sa.Digest != sb.Digest || sa.Count != 200 {
+		t.Errorf("same keys should give the same summary: %+v %+v", sa, sb)
+	}
+	if sa.Leaf || len(sa.Keys) != 0 {
+		t.Error("a range with that many keys shouldn't come with them")
+	}
+
+	b.data[contentKey("extra")] = []byte("extra")
+	sb, _ = summarizeRange(b, keyRange{})
+	if sa.Digest == sb.Digest {
+		t.Error("different keys should give a different digest")
+	}
+	differ := 0
+	for i := range sa.Children {
+		if sa.Children[i].Digest != sb.Children[i].Digest {
+			differ++
+		}
+	}
+	if differ != 1 {
+		t.Errorf("only one child should differ, got %d", differ)
+	}
+
+	// only part of the keyspace
+	half := keyRange{"", "8000000000000000000000000000000000000000"}
+	s, _ := summarizeRange(a, half)
+	for _, h := range s.Keys {
+		if !half.contains(h) {
+			t.Errorf("%s is outside %s", h, half)
+		}
+	}
+	if s.Count == 0 || s.Count == 200 {
+		t.Errorf("expected roughly half the keys, got %d", s.Count)
+	}
+}
+
+func Test_sharedRanges(t *testing.T) {
+	n := newNode("a", "http://localhost:1000", true)
+	c := newCluster(n, "secret", 60)
+	c.AddNeighbor(*newNode("b", "http://localhost:1001", true))
+	c.AddNeighbor(*newNode("c", "http://localhost:1002", true))
+	c.AddNeighbor(*newNode("d", "http://localhost:1003", true))
+
+	peers := sharedRanges(c.Ring(), "a", 2)
+	if len(peers) == 0 {
+		t.Fatal("expected to share ranges with someone")
+	}
+	for i := 0; i < 500; i++ {
+		k := contentKey(fmt.Sprint(i))
+		owners := replicaSet(c.ReadOrder(k), 2)
+		sort.Strings(owners)
+		for _, uuid := range []string{"b", "c", "d"} {
+			shared := owners[0] == "a" && owners[1] == uuid
+			inRange := false
+			for _, r := range peers[uuid] {
+				if r.contains(k[len("sha1:"):]) {
+					inRange = true
+				}
+			}
+			if shared != inRange {
+				t.Errorf("%s: owners %v, but in shared range with %s: %v", k, owners, uuid, inRange)
+			}
+		}
+	}
+}
+
+func Test_syncRange(t *testing.T) {
+	peerNode := newNode("peer", "", true)
+	peer := &site{
+		Node:          peerNode,
+		Cluster:       newCluster(peerNode, "secret", 60),
+		Backend:       &MockBackendFull{data: map[string][]byte{}},
+		ClusterSecret: "secret",
+		MaxUploadSize: 1024,
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /aae/range/", makeHandler(aaeRangeHandler, peer))
+	mux.HandleFunc("GET /local/{key}/", makeHandler(localHandler, peer))
+	mux.HandleFunc("POST /local/", makeHandler(handleLocalPost, peer))
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+	peerNode.BaseURL = ts.URL
+
+	n := newNode("local", "http://localhost:1000", true)
+	local := &site{
+		Node:          n,
+		Cluster:       newCluster(n, "secret", 60),
+		Backend:       &MockBackendFull{data: map[string][]byte{}},
+		ClusterSecret: "secret",
+	}
+	mine := local.Backend.(*MockBackendFull).data
+	theirs := peer.Backend.(*MockBackendFull).data
+	for i := 0; i < 300; i++ {
+		content := fmt.Sprint(i)
+		if i%50 != 1 {
+			mine[contentKey(content)] = []byte(content)
+		}
+		if i%50 != 0 {
+			theirs[contentKey(content)] = []byte(content)
+		}
+	}
+
+	repaired, err := local.syncRange(context.Background(), *peerNode, keyRange{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if repaired != 12 {
+		t.Errorf("expected 12 keys to be repaired, got %d", repaired)
+	}
+	if len(mine) != 300 || len(theirs) != 300 {
+		t.Errorf("both sides should have everything now: %d and %d", len(mine), len(theirs))
+	}
+
+	repaired, err = local.syncRange(context.Background(), *peerNode, keyRange{})
+	if err != nil || repaired != 0 {
+		t.Errorf("nothing left to repair, got %d, %v", repaired, err)
+	}
+}
+
+func Test_syncRangeSkipsCorruptCopies(t *testing.T) {
+	peerNode := newNode("peer", "", true)
+	peer := &site{
+		Node:          peerNode,
+		Cluster:       newCluster(peerNode, "secret", 60),
+		Backend:       &MockBackendFull{data: map[string][]byte{}},
+		ClusterSecret: "secret",
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /aae/range/", makeHandler(aaeRangeHandler, peer))
+	mux.HandleFunc("GET /local/{key}/", makeHandler(localHandler, peer))
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+	peerNode.BaseURL = ts.URL
+
+	n := newNode("local", "http://localhost:1000", true)
+	local := &site{
+		Node:          n,
+		Cluster:       newCluster(n, "secret", 60),
+		Backend:       &MockBackendFull{data: map[string][]byte{}},
+		ClusterSecret: "secret",
+	}
+	theirs := peer.Backend.(*MockBackendFull).data
+	theirs[contentKey("good")] = []byte("good")
+	theirs[contentKey("bad")] = []byte("rotten")
+
+	repaired, err := local.syncRange(context.Background(), *peerNode, keyRange{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mine := local.Backend.(*MockBackendFull).data
+	if repaired != 1 || string(mine[contentKey("good")]) != "good" {
+		t.Errorf("expected the good copy to be pulled, got %d", repaired)
+	}
+	if _, ok := mine[contentKey("bad")]; ok {
+		t.Error("a corrupt copy shouldn't have been stored")
+	}
+}
+
+func Test_aaeRangeHandlerNeedsSecret(t *testing.T) {
+	n := newNode("test", "http://localhost:1000", true)
+	s := &site{Node: n, Cluster: newCluster(n, "secret", 60), Backend: &MockBackendFull{}}
+	req := httptest.NewRequest("GET", "/aae/range/", nil)
+	rr := httptest.NewRecorder()
+	aaeRangeHandler(rr, req, s)
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("got status %d, want %d", rr.Code, http.StatusForbidden)
+	}
+
+	req = httptest.NewRequest("GET", "/aae/range/?start=nothex", nil)
+	req.Header.Set("X-Cask-Cluster-Secret", "secret")
+	rr = httptest.NewRecorder()
+	aaeRangeHandler(rr, req, s)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("got status %d, want %d", rr.Code, http.StatusBadRequest)
+	}
+}
+
+func Test_summarizeRangeIndexed(t *testing.T) {
+	d := newDiskBackend(t.TempDir() + "/")
+	m := &MockBackendFull{data: map[string][]byte{}}
+	for i := 0; i < 500; i++ {
+		content := fmt.Sprint(i)
+		k, _ := keyFromString(contentKey(content))
+		if err := d.Write(*k, io.NopCloser(strings.NewReader(content))); err != nil {
+			t.Fatal(err)
+		}
+		m.data[k.String()] = []byte(content)
+	}
+	for i := 0; i < 500; i += 7 {
+		k, _ := keyFromString(contentKey(fmt.Sprint(i)))
+		_ = d.Delete(*k)
+		delete(m.data, k.String())
+	}
+
+	for _, r := range []keyRange{
+		{},
+		{"", "8000000000000000000000000000000000000000"},
+		{"3a00000000000000000000000000000000000000", "3a0f000000000000000000000000000000000000"},
+		{"e000000000000000000000000000000000000000", ""},
+	} {
+		indexed, err := summarizeRange(d, r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		scanned, _ := summarizeRange(m, r)
+		if indexed.Digest != scanned.Digest || indexed.Count != scanned.Count || indexed.Leaf != scanned.Leaf {
+			t.Errorf("%s: the index and a scan disagree: %d %s, %d %s", r, indexed.Count, indexed.Digest, scanned.Count, scanned.Digest)
+		}
+		for i := range indexed.Children {
+			if indexed.Children[i].Digest != scanned.Children[i].Digest {
+				t.Errorf("%s: child %d differs", r, i)
+			}
+		}
+		if len(indexed.Keys) != len(scanned.Keys) {
+			t.Errorf("%s: got %d keys, want %d", r, len(indexed.Keys), len(scanned.Keys))
+		}
+	}
+}
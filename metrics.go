@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// keeps track of what a handler sent back
+type statusWriter struct {
+	http.ResponseWriter
+	code  int
+	bytes int64
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// so streaming handlers still work
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+type countingReader struct {
+	io.ReadCloser
+	bytes int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.bytes += int64(n)
+	return n, err
+}
+
+// records requests, how long they took and the bytes in and out,
+// labelled with the route pattern they matched. each request also
+// gets a request ID and a span, carrying on the ones the caller sent
+func instrument(fn http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		route := r.Pattern
+		if route == "" {
+			route = "unmatched"
+		}
+		id := incomingRequestID(r)
+		w.Header().Set(requestIDHeader, id)
+		ctx, sp := startSpanKind(withRequestID(extractTrace(r), id), route, spanServer)
+		sp.SetAttr("cask.request_id", id)
+		r = r.WithContext(ctx)
+		sw := &statusWriter{ResponseWriter: w}
+		body := &countingReader{ReadCloser: r.Body}
+		if r.Body != nil {
+			r.Body = body
+		}
+		fn(sw, r)
+
+		if sw.code == 0 {
+			sw.code = http.StatusOK
+		}
+		code := strconv.Itoa(sw.code)
+		httpRequests.WithLabelValues(route, code).Inc()
+		httpDuration.WithLabelValues(route, code).Observe(time.Since(start).Seconds())
+		httpBytesIn.WithLabelValues(route).Add(float64(body.bytes))
+		httpBytesOut.WithLabelValues(route).Add(float64(sw.bytes))
+
+		logger(ctx).Debug("request", "route", route, "code", sw.code,
+			"duration", time.Since(start), "path", r.URL.Path)
+		sp.SetAttr("http.status_code", code)
+		var err error
+		if sw.code >= 500 {
+			err = errors.New(http.StatusText(sw.code))
+		}
+		sp.Finish(err)
+	}
+}
+
+// a call to another node, timed for the metrics and traced
+type peerCall struct {
+	ctx   context.Context
+	peer  string
+	op    string
+	key   string
+	start time.Time
+	span  *span
+}
+
+// use it like:
+//
+//	ctx, call := startPeerCall(ctx, n.UUID, "retrieve")
+//	defer call.end(&err)
+func startPeerCall(ctx context.Context, peer, op string) (context.Context, *peerCall) {
+	ctx, sp := startSpanKind(ctx, "peer "+op, spanClient)
+	sp.SetAttr("cask.peer", peer)
+	return ctx, &peerCall{ctx: ctx, peer: peer, op: op, start: time.Now(), span: sp}
+}
+
+// for calls about one file
+func (c *peerCall) forKey(k key) {
+	c.key = k.String()
+	c.span.SetAttr("cask.key", c.key)
+}
+
+func (c *peerCall) end(err *error) {
+	peerDuration.WithLabelValues(c.peer, c.op).Observe(time.Since(c.start).Seconds())
+	var e error
+	// the node not having a file isn't a failure
+	if err != nil && *err != nil && *err != errNotFound {
+		peerErrors.WithLabelValues(c.peer, c.op).Inc()
+		e = *err
+		l := logger(c.ctx).With("peer", c.peer, "op", c.op)
+		if c.key != "" {
+			l = l.With("key", c.key)
+		}
+		l.Warn("peer call failed", "err", e)
+	}
+	c.span.Finish(e)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func Test_instrument(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /echo/{thing}/", instrument(func(w http.ResponseWriter, r *http.Request) {
+		b := make([]byte, 100)
+		n, _ := r.Body.Read(b)
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write(b[:n])
+		_, _ = w.Write(b[:n])
+	}))
+	route := "POST /echo/{thing}/"
+	before := counterValue(httpRequests.WithLabelValues(route, "201"))
+	in := counterValue(httpBytesIn.WithLabelValues(route))
+	out := counterValue(httpBytesOut.WithLabelValues(route))
+
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("POST", "/echo/a/", strings.NewReader("hello")))
+	if rr.Code != http.StatusCreated || rr.Body.String() != "hellohello" {
+		t.Fatalf("unexpected response: %d %q", rr.Code, rr.Body.String())
+	}
+	if counterValue(httpRequests.WithLabelValues(route, "201"))-before != 1 {
+		t.Errorf("request wasn't counted under its route")
+	}
+	if counterValue(httpBytesIn.WithLabelValues(route))-in != 5 || counterValue(httpBytesOut.WithLabelValues(route))-out != 10 {
+		t.Errorf("bytes in and out weren't counted")
+	}
+}
+
+func Test_observePeer(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "broken") {
+			http.Error(w, "oops", 500)
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	defer ts.Close()
+	n := newNode("peer-metrics", ts.URL, true)
+	k, _ := keyFromString(contentKey("whatever"))
+	_, _ = n.Retrieve(*k, "secret")
+	if counterValue(peerErrors.WithLabelValues("peer-metrics", "retrieve")) != 0 {
+		t.Errorf("a 404 shouldn't count as an error")
+	}
+	n.BaseURL = ts.URL + "/broken"
+	_, _ = n.Status(context.Background(), 0)
+	if counterValue(peerErrors.WithLabelValues("peer-metrics", "status")) != 1 {
+		t.Errorf("a failed status request should count as an error")
+	}
+}
+
+func Test_verifyOutcomes(t *testing.T) {
+	d := newDiskBackend(t.TempDir() + "/")
+	k, _ := keyFromString(contentKey("to be damaged"))
+	_ = os.MkdirAll(d.layout.dir(d.Root, *k), 0755)
+	_ = os.WriteFile(d.layout.path(d.Root, *k), []byte("damaged"), 0644)
+	c := newCluster(newNode("local", "", true), "secret", 60)
+
+	corrupt := counterValue(verifications.WithLabelValues("corrupt"))
+	unrepairable := counterValue(verifications.WithLabelValues("unrepairable"))
+	if err := d.NewVerifier(c).VerifyKey(*k); err == nil {
+		t.Errorf("there's nowhere to repair it from")
+	}
+	if counterValue(verifications.WithLabelValues("corrupt"))-corrupt != 1 ||
+		counterValue(verifications.WithLabelValues("unrepairable"))-unrepairable != 1 {
+		t.Errorf("outcome wasn't counted")
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"crypto/sha1"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+type migrationStats struct {
+	Moved       int
+	Skipped     int
+	Quarantined int
+}
+
+// moves every file under root over to a different layout, in
+// place. the node has to be stopped while this runs. each file is
+// checked against its hash first; ones that don't match get moved
+// to root/quarantine/ instead. files are renamed one at a time, so
+// if it gets interrupted, running it again picks up where it left
+// off. until it finishes, the node refuses to start.
+func migrateLayout(root string, to diskLayout) (migrationStats, error) {
+	var stats migrationStats
+	if !strings.HasSuffix(root, "/") {
+		root += "/"
+	}
+	if !to.known() {
+		return stats, fmt.Errorf("don't know disk layout %d", to)
+	}
+	if data, err := os.ReadFile(root + layoutMigratingFile); err == nil {
+		// resuming
+		if v, _ := strconv.Atoi(strings.TrimSpace(string(data))); diskLayout(v) != to {
+			return stats, fmt.Errorf("a migration to layout %s is already underway, finish that first", strings.TrimSpace(string(data)))
+		}
+	} else {
+		from, _, err := detectLayout(root, to)
+		if err != nil {
+			return stats, err
+		}
+		if from == to {
+			slog.Info("already on layout", "root", root, "layout", int(to), "op", "migrate")
+			return stats, writeLayout(root, to)
+		}
+		if !from.known() {
+			return stats, fmt.Errorf("%s is on disk layout %d, which this version of cask doesn't know", root, from)
+		}
+		if err := os.WriteFile(root+layoutMigratingFile, []byte(strconv.Itoa(int(to))+"\n"), 0644); err != nil {
+			return stats, err
+		}
+	}
+
+	top := root + "sha1"
+	err := filepath.WalkDir(top, func(path string, e fs.DirEntry, err error) error {
+		if err != nil {
+			if path == top && os.IsNotExist(err) {
+				return filepath.SkipAll
+			}
+			if os.IsNotExist(err) {
+				// a directory we emptied out and removed
+				return nil
+			}
+			return err
+		}
+		if e.IsDir() {
+			return nil
+		}
+		k, err := keyFromPath(path)
+		if name := e.Name(); name != "data" && !isHash(name) {
+			err = errors.New("not a stored file")
+		}
+		if err != nil {
+			slog.Warn("skipping", "path", path, "op", "migrate", "err", err)
+			stats.Skipped++
+			return nil
+		}
+		dest := to.path(root, *k)
+		if path == filepath.Clean(dest) {
+			// already moved
+			return nil
+		}
+		ok, err := blobMatches(path, *k)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			slog.Warn("doesn't match its hash, quarantining it", "path", path, "op", "migrate")
+			if err := os.MkdirAll(root+"quarantine", 0755); err != nil {
+				return err
+			}
+			if err := os.Rename(path, root+"quarantine/"+k.String()); err != nil {
+				return err
+			}
+			stats.Quarantined++
+		} else {
+			if err := os.MkdirAll(to.dir(root, *k), 0755); err != nil {
+				return err
+			}
+			if err := os.Rename(path, dest); err != nil {
+				return err
+			}
+			stats.Moved++
+			if stats.Moved%10000 == 0 {
+				slog.Info("moved files so far", "moved", stats.Moved, "op", "migrate")
+			}
+		}
+		removeEmptyDirs(filepath.Dir(path), top)
+		return nil
+	})
+	if err != nil {
+		return stats, err
+	}
+	if stats.Quarantined > 0 {
+		// the index still has the quarantined keys in it. it gets
+		// rebuilt on startup
+		if err := os.Remove(root + "index.log"); err != nil && !os.IsNotExist(err) {
+			return stats, err
+		}
+	}
+	if err := writeLayout(root, to); err != nil {
+		return stats, err
+	}
+	return stats, os.Remove(root + layoutMigratingFile)
+}
+
+func blobMatches(path string, k key) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	h := sha1.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return false, err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)) == string(k.Value), nil
+}
+
+// cask migrate-layout [-root dir] [-to version]
+func migrateLayoutCommand(args []string) int {
+	flags := flag.NewFlagSet("migrate-layout", flag.ContinueOnError)
+	root := flags.String("root", os.Getenv("CASK_DISK_BACKEND_ROOT"), "disk backend root to migrate")
+	to := flags.Int("to", int(latestLayout), "layout version to migrate to")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *root == "" {
+		fmt.Fprintln(os.Stderr, "need a -root to migrate")
+		return 2
+	}
+	stats, err := migrateLayout(*root, diskLayout(*to))
+	slog.Info("migration finished", "moved", stats.Moved, "quarantined", stats.Quarantined, "skipped", stats.Skipped, "op", "migrate")
+	if err != nil {
+		slog.Error("migration failed", "op", "migrate", "err", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"testing"
+)
+
+func TestMigrateLayout(t *testing.T) {
+	root := t.TempDir() + "/"
+	d := newDiskBackend(root)
+	_ = d.CheckLayout(layoutDeep)
+	var keys []key
+	for i := 0; i < 10; i++ {
+		content := fmt.Sprintf("file %d", i)
+		k, _ := keyFromString(contentKey(content))
+		_ = d.Write(*k, io.NopCloser(bytes.NewReader([]byte(content))))
+		keys = append(keys, *k)
+	}
+	// one that's gone bad
+	_ = os.WriteFile(layoutDeep.path(root, keys[9]), []byte("garbage"), 0644)
+	// and one that was already moved before an earlier run got
+	// interrupted
+	_ = os.MkdirAll(layoutShallow.dir(root, keys[0]), 0755)
+	_ = os.Rename(layoutDeep.path(root, keys[0]), layoutShallow.path(root, keys[0]))
+	_ = os.WriteFile(root+layoutMigratingFile, []byte("2\n"), 0644)
+
+	stats, err := migrateLayout(root, layoutShallow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Moved != 8 || stats.Quarantined != 1 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+	if _, err := os.Stat(root + layoutMigratingFile); !os.IsNotExist(err) {
+		t.Errorf("migrating marker should be gone")
+	}
+	if _, err := os.Stat(root + "quarantine/" + keys[9].String()); err != nil {
+		t.Errorf("bad file should be in quarantine: %v", err)
+	}
+	if _, err := os.Stat(root + "sha1/" + keys[1].AsPath()[:8]); !os.IsNotExist(err) {
+		t.Errorf("old directories should have been cleaned up")
+	}
+
+	d = newDiskBackend(root)
+	if err := d.CheckLayout(layoutDeep); err != nil || d.layout != layoutShallow {
+		t.Fatalf("root should be on the shallow layout now: %v %d", err, d.layout)
+	}
+	if d.BlobCount() != 9 {
+		t.Errorf("expected 9 keys in the rebuilt index, got %d", d.BlobCount())
+	}
+	for i, k := range keys[:9] {
+		if data, err := d.Read(k); err != nil || string(data) != fmt.Sprintf("file %d", i) {
+			t.Errorf("lost %s: %q %v", k, data, err)
+		}
+	}
+
+	// and back again
+	if _, err := migrateLayout(root, layoutDeep); err != nil {
+		t.Fatal(err)
+	}
+	d = newDiskBackend(root)
+	if data, err := d.Read(keys[3]); d.layout != layoutDeep || err != nil || string(data) != "file 3" {
+		t.Errorf("migrating back didn't work: %q %v", data, err)
+	}
+	if _, err := migrateLayout(root, 99); err == nil {
+		t.Errorf("unknown layout should be an error")
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+)
+
+// a file that's kept as identical copies in several places, so a
+// JBOD node doesn't lose its hints or access times along with one
+// of its disks. if writing to a copy fails, that copy is left
+// alone until the whole file is next rewritten.
+type mirroredFile struct {
+	paths []string
+	// open for appending. nil where a copy has failed
+	files []*os.File
+}
+
+var errNoCopies = errors.New("couldn't write to any copy")
+
+// empty paths are skipped. with none, nothing is saved
+func newMirroredFile(paths ...string) *mirroredFile {
+	m := &mirroredFile{}
+	for _, p := range paths {
+		if p != "" {
+			m.paths = append(m.paths, p)
+		}
+	}
+	m.files = make([]*os.File, len(m.paths))
+	return m
+}
+
+func (m *mirroredFile) enabled() bool {
+	return len(m.paths) > 0
+}
+
+// the most complete copy. they only differ if one of them missed
+// some writes, so that's the biggest one
+func (m *mirroredFile) Read() ([]byte, error) {
+	var best []byte
+	err := error(os.ErrNotExist)
+	found := false
+	for _, p := range m.paths {
+		b, rerr := os.ReadFile(p)
+		if rerr != nil {
+			// a missing copy is less interesting than a broken one
+			if os.IsNotExist(err) {
+				err = rerr
+			}
+			continue
+		}
+		if !found || len(b) > len(best) {
+			best = b
+			found = true
+		}
+	}
+	if !found {
+		return nil, err
+	}
+	return best, nil
+}
+
+// replace every copy with data. each goes through a temp file so
+// a crash can't leave a half written one. only fails if none of
+// them could be written
+func (m *mirroredFile) Rewrite(data []byte) error {
+	written := 0
+	for i, p := range m.paths {
+		if m.files[i] != nil {
+			m.files[i].Close()
+			m.files[i] = nil
+		}
+		tmp := p + ".tmp"
+		if err := os.WriteFile(tmp, data, 0644); err != nil {
+			slog.Error("couldn't write", "path", p, "err", err)
+			continue
+		}
+		if err := os.Rename(tmp, p); err != nil {
+			slog.Error("couldn't write", "path", p, "err", err)
+			continue
+		}
+		f, err := os.OpenFile(p, os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			slog.Error("couldn't open", "path", p, "err", err)
+			continue
+		}
+		m.files[i] = f
+		written++
+	}
+	if written == 0 && m.enabled() {
+		return errNoCopies
+	}
+	return nil
+}
+
+// add to the end of every copy that's still working
+func (m *mirroredFile) Append(b []byte) error {
+	written := 0
+	for i, f := range m.files {
+		if f == nil {
+			continue
+		}
+		if _, err := f.Write(b); err != nil {
+			slog.Error("couldn't write, leaving it until it's rewritten", "path", m.paths[i], "err", err)
+			f.Close()
+			m.files[i] = nil
+			continue
+		}
+		written++
+	}
+	if written == 0 && m.enabled() {
+		return errNoCopies
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_mirroredFile(t *testing.T) {
+	a := filepath.Join(t.TempDir(), "hints.json")
+	b := filepath.Join(t.TempDir(), "hints.json")
+	m := newMirroredFile(a, "", b)
+	if len(m.paths) != 2 {
+		t.Fatalf("empty paths should be skipped: %v", m.paths)
+	}
+	if err := m.Rewrite([]byte("one\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Append([]byte("two\n")); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{a, b} {
+		if data, _ := os.ReadFile(p); string(data) != "one\ntwo\n" {
+			t.Errorf("%s has %q", p, data)
+		}
+	}
+
+	// losing one copy doesn't lose the file
+	_ = os.Remove(a)
+	if data, err := m.Read(); err != nil || string(data) != "one\ntwo\n" {
+		t.Errorf("expected the other copy, got %q, %v", data, err)
+	}
+	// the most complete copy wins
+	_ = os.WriteFile(a, []byte("one\n"), 0644)
+	if data, _ := m.Read(); string(data) != "one\ntwo\n" {
+		t.Errorf("expected the longer copy, got %q", data)
+	}
+
+	// a copy somewhere that's gone away is skipped
+	m = newMirroredFile(filepath.Join(t.TempDir(), "gone", "hints.json"), a)
+	if err := m.Rewrite([]byte("three\n")); err != nil {
+		t.Fatalf("one working copy should be enough: %s", err)
+	}
+	if data, _ := os.ReadFile(a); string(data) != "three\n" {
+		t.Errorf("unexpected contents %q", data)
+	}
+
+	if newMirroredFile("").enabled() {
+		t.Error("with no paths, nothing should be saved")
+	}
+	if _, err := newMirroredFile(filepath.Join(t.TempDir(), "missing")).Read(); !os.IsNotExist(err) {
+		t.Errorf("expected a not exist error, got %v", err)
+	}
+}
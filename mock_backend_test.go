@@ -2,6 +2,7 @@ package main
 
 import (
 	"io"
+	"sort"
 )
 
 type MockBackend struct {
@@ -16,6 +17,9 @@ func (m MockBackend) Delete(key key) error                  { return nil }
 func (m MockBackend) ActiveAntiEntropy(c *cluster, s site, i int) {}
 func (m MockBackend) NewVerifier(c *cluster) verifier       { return &MockVerifier{} }
 func (m MockBackend) FreeSpace() uint64                     { return m.freeSpace }
+func (m MockBackend) List(after string, limit int) ([]keyInfo, error) {
+	return nil, nil
+}
 
 type MockBackendFull struct {
 	MockBackend
@@ -58,6 +62,25 @@ func (m *MockBackendFull) Write(k key, r io.ReadCloser) error {
 
 func (m *MockBackendFull) FreeSpace() uint64 { return 1000 }
 
+func (m *MockBackendFull) List(after string, limit int) ([]keyInfo, error) {
+	var keys []string
+	for k := range m.data {
+		if k > after {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	var results []keyInfo
+	for _, k := range keys {
+		if limit > 0 && len(results) >= limit {
+			break
+		}
+		kk, _ := keyFromString(k)
+		results = append(results, keyInfo{Key: *kk, Size: int64(len(m.data[k]))})
+	}
+	return results, nil
+}
+
 type MockVerifier struct{}
 
 func (m *MockVerifier) Verify(path string, k key, h string) error { return nil }
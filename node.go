@@ -2,14 +2,18 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha1"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"math"
 	"math/rand"
 	"mime/multipart"
 	"net/http"
+	"net/url"
+	"sync/atomic"
 	"time"
 )
 
@@ -19,6 +23,16 @@ type node struct {
 	Writeable  bool      `json:"writeable"`
 	LastSeen   time.Time `json:"last_seen"`
 	LastFailed time.Time `json:"last_failed"`
+	FreeSpace  uint64    `json:"free_space"`
+	Capacity   uint64    `json:"capacity"`
+	BlobCount  int64     `json:"blob_count"`
+	Load       float64   `json:"load"`
+	Weight     float64   `json:"weight"`
+	Zone       string    `json:"zone"`
+	Rack       string    `json:"rack"`
+	Draining   bool      `json:"draining"`
+	// hot or cold. see tiering.go
+	StorageClass string `json:"storage_class"`
 }
 
 func newNode(uuid, baseURL string, writeable bool) *node {
@@ -42,16 +56,26 @@ func (n node) AddFileURL() string {
 }
 
 func (n *node) AddFile(key key, f io.Reader, secret string) bool {
-	resp, err := postFile(f, n.AddFileURL(), secret)
+	return n.AddFileWithHint(context.Background(), key, f, secret, "")
+}
+
+// write a file to the node on behalf of another node (hintFor)
+// that should have had it but was unavailable
+func (n *node) AddFileWithHint(ctx context.Context, key key, f io.Reader, secret, hintFor string) bool {
+	ctx, call := startPeerCall(ctx, n.UUID, "add_file")
+	call.forKey(key)
+	resp, err := postFileWithHint(ctx, f, n.AddFileURL(), secret, hintFor)
+	failed := err
+	if err == nil && resp.StatusCode != 200 {
+		failed = errors.New(resp.Status)
+	}
+	// logs it if it failed
+	call.end(&failed)
 	if err != nil {
-		log.Println("postFile returned false")
-		log.Println(err)
 		return false
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != 200 {
-		log.Println("didn't get a 200")
-		log.Println(resp.StatusCode)
 		return false
 	}
 
@@ -65,6 +89,10 @@ func (n node) Unhealthy() bool {
 }
 
 func postFile(f io.Reader, targetURL, secret string) (*http.Response, error) {
+	return postFileWithHint(context.Background(), f, targetURL, secret, "")
+}
+
+func postFileWithHint(ctx context.Context, f io.Reader, targetURL, secret, hintFor string) (*http.Response, error) {
 	bodyBuf := bytes.NewBufferString("")
 	bodyWriter := multipart.NewWriter(bodyBuf)
 	fileWriter, err := bodyWriter.CreateFormFile("file", "file.dat")
@@ -80,18 +108,41 @@ func postFile(f io.Reader, targetURL, secret string) (*http.Response, error) {
 	bodyWriter.Close()
 	contentType := bodyWriter.FormDataContentType()
 	c := http.Client{}
-	req, err := http.NewRequest("POST", targetURL, bodyBuf)
+	req, err := http.NewRequestWithContext(ctx, "POST", targetURL, bodyBuf)
 	if err != nil {
 		return nil, err
 	}
+	propagate(ctx, req)
 	req.Header.Set("Content-Type", contentType)
 	req.Header.Set("X-Cask-Cluster-Secret", secret)
+	if hintFor != "" {
+		req.Header.Set("X-Cask-Hint-For", hintFor)
+	}
 
 	return c.Do(req)
 }
 
 func (n node) HashKeys() []string {
-	keys := make([]string, replicas)
+	return n.hashKeysN(n.VirtualNodes())
+}
+
+// number of positions the node claims on the ring, scaled by
+// its configured weight. an unset weight counts as 1.
+func (n node) VirtualNodes() int {
+	if n.Weight <= 0 {
+		return replicas
+	}
+	v := int(math.Round(float64(replicas) * n.Weight))
+	if v < 1 {
+		v = 1
+	}
+	return v
+}
+
+// the first count ring positions for the node. positions are
+// stable, so a node that grows its count keeps the ones it had.
+func (n node) hashKeysN(count int) []string {
+	keys := make([]string, count)
 	h := sha1.New()
 	for i := range keys {
 		h.Reset()
@@ -101,16 +152,26 @@ func (n node) HashKeys() []string {
 	return keys
 }
 
+var errNotFound = errors.New("404, probably")
+
 func (n node) retrieveURL(key key) string {
 	return n.BaseURL + "/local/" + key.String() + "/"
 }
 
 func (n *node) Retrieve(key key, secret string) ([]byte, error) {
+	return n.RetrieveContext(context.Background(), key, secret)
+}
+
+func (n *node) RetrieveContext(ctx context.Context, key key, secret string) (_ []byte, err error) {
+	ctx, call := startPeerCall(ctx, n.UUID, "retrieve")
+	call.forKey(key)
+	defer call.end(&err)
 	c := http.Client{}
-	req, err := http.NewRequest("GET", n.retrieveURL(key), nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", n.retrieveURL(key), nil)
 	if err != nil {
 		return nil, err
 	}
+	propagate(ctx, req)
 	req.Header.Set("X-Cask-Cluster-Secret", secret)
 	resp, err := c.Do(req)
 
@@ -119,7 +180,7 @@ func (n *node) Retrieve(key key, secret string) ([]byte, error) {
 	}
 	defer resp.Body.Close()
 	if resp.Status != "200 OK" {
-		return nil, errors.New("404, probably")
+		return nil, errNotFound
 	}
 	b, _ := io.ReadAll(resp.Body)
 	return b, nil
@@ -135,14 +196,19 @@ type pingResponse struct {
 }
 
 func timedHeadRequest(url string, duration time.Duration, secret string) (resp *http.Response, err error) {
+	return timedHeadRequestContext(context.Background(), url, duration, secret)
+}
+
+func timedHeadRequestContext(ctx context.Context, url string, duration time.Duration, secret string) (resp *http.Response, err error) {
 	rc := make(chan pingResponse, 1)
 	go func() {
 		c := http.Client{}
-		req, err := http.NewRequest("HEAD", url, nil)
+		req, err := http.NewRequestWithContext(ctx, "HEAD", url, nil)
 		if err != nil {
 			rc <- pingResponse{nil, err}
 			return
 		}
+		propagate(ctx, req)
 		req.Header.Set("X-Cask-Cluster-Secret", secret)
 		resp, err := c.Do(req)
 		rc <- pingResponse{resp, err}
@@ -158,8 +224,15 @@ func timedHeadRequest(url string, duration time.Duration, secret string) (resp *
 }
 
 func (n *node) RetrieveInfo(key key, secret string) (bool, error) {
+	return n.RetrieveInfoContext(context.Background(), key, secret)
+}
+
+func (n *node) RetrieveInfoContext(ctx context.Context, key key, secret string) (_ bool, err error) {
+	ctx, call := startPeerCall(ctx, n.UUID, "retrieve_info")
+	call.forKey(key)
+	defer call.end(&err)
 	url := n.retrieveInfoURL(key)
-	resp, err := timedHeadRequest(url, 1*time.Second, secret)
+	resp, err := timedHeadRequestContext(ctx, url, 1*time.Second, secret)
 	if err != nil {
 		// TODO: n.LastFailed = time.Now()
 		return false, err
@@ -176,12 +249,128 @@ func (n *node) processRetrieveInfoResponse(resp *http.Response) (bool, error) {
 	}
 	defer resp.Body.Close()
 	if resp.Status != "200 OK" {
-		return false, errors.New("404, probably")
+		return false, errNotFound
 	}
 	_, _ = io.ReadAll(resp.Body)
 	return true, nil
 }
 
+// whether the node has the key and, if it knows, when it last
+// served a read of it. a zero time means it doesn't know
+func (n *node) LastRead(key key, secret string) (found bool, last time.Time, err error) {
+	ctx, call := startPeerCall(context.Background(), n.UUID, "last_read")
+	call.forKey(key)
+	defer call.end(&err)
+	resp, err := timedHeadRequestContext(ctx, n.retrieveInfoURL(key), 1*time.Second, secret)
+	if err != nil {
+		return false, last, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return false, last, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return false, last, fmt.Errorf("info request failed: %s", resp.Status)
+	}
+	if h := resp.Header.Get("X-Cask-Last-Read"); h != "" {
+		last, err = time.Parse(time.RFC3339Nano, h)
+	}
+	return true, last, err
+}
+
+// tell the node to drop its hot copy of a key that's been moved
+// to the cold nodes. it refuses if it has read the key recently
+func (n *node) DropColdCopy(key key, secret string) (err error) {
+	ctx, call := startPeerCall(context.Background(), n.UUID, "drop_cold_copy")
+	call.forKey(key)
+	defer call.end(&err)
+	c := http.Client{Timeout: 10 * time.Second}
+	req, err := http.NewRequestWithContext(ctx, "DELETE", n.retrieveInfoURL(key), nil)
+	if err != nil {
+		return err
+	}
+	propagate(ctx, req)
+	req.Header.Set("X-Cask-Cluster-Secret", secret)
+	resp, err := c.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("drop request failed: %s", resp.Status)
+	}
+	return nil
+}
+
+// ask the node for its merkle summary of a range of keys
+func (n node) RangeSummary(ctx context.Context, r keyRange, secret string) (summary rangeSummary, err error) {
+	ctx, call := startPeerCall(ctx, n.UUID, "range_summary")
+	defer call.end(&err)
+	c := http.Client{Timeout: 30 * time.Second}
+	u := n.BaseURL + "/aae/range/?start=" + url.QueryEscape(r.Start) + "&end=" + url.QueryEscape(r.End)
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return summary, err
+	}
+	propagate(ctx, req)
+	req.Header.Set("X-Cask-Cluster-Secret", secret)
+	resp, err := c.Do(req)
+	if err != nil {
+		return summary, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return summary, fmt.Errorf("range summary request failed: %s", resp.Status)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&summary)
+	return summary, err
+}
+
+// a page of the keys stored on the node
+func (n node) ListKeys(ctx context.Context, after string, limit int, secret string) (_ []keyListing, err error) {
+	ctx, call := startPeerCall(ctx, n.UUID, "list_keys")
+	defer call.end(&err)
+	c := http.Client{Timeout: 30 * time.Second}
+	u := n.BaseURL + "/local/keys/?after=" + url.QueryEscape(after) + "&limit=" + fmt.Sprint(limit)
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	propagate(ctx, req)
+	req.Header.Set("X-Cask-Cluster-Secret", secret)
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("key listing request failed: %s", resp.Status)
+	}
+	return readKeyListings(resp.Body)
+}
+
+// what the node's /status/ says
+func (n node) Status(ctx context.Context, timeout time.Duration) (st nodeStatus, err error) {
+	ctx, call := startPeerCall(ctx, n.UUID, "status")
+	defer call.end(&err)
+	c := http.Client{Timeout: timeout}
+	req, err := http.NewRequestWithContext(ctx, "GET", n.BaseURL+"/status/", nil)
+	if err != nil {
+		return st, err
+	}
+	propagate(ctx, req)
+	resp, err := c.Do(req)
+	if err != nil {
+		return st, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return st, fmt.Errorf("status request failed: %s", resp.Status)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&st)
+	return st, err
+}
+
 type nodeHeartbeat struct {
 	UUID      string `json:"uuid"`
 	BaseURL   string `json:"base_url"`
@@ -213,20 +402,55 @@ func doublecheckReplica(f []byte, key key) bool {
 func (n *node) updateFreeSpaceStatus(minFreeSpace uint64, backend backend) {
 	freeSpace := backend.FreeSpace()
 	diskFreeSpace.Set(float64(freeSpace))
+	n.FreeSpace = freeSpace
+	if cr, ok := backend.(capacityReporter); ok {
+		n.Capacity = cr.Capacity()
+		n.BlobCount = cr.BlobCount()
+	}
 	if n.Writeable {
 		if freeSpace < minFreeSpace {
 			n.Writeable = false
+			publishClusterEvent(clusterReadOnly, *n, "low on space")
 		}
 	} else {
 		if freeSpace > minFreeSpace {
 			n.Writeable = true
+			publishClusterEvent(clusterWriteable, *n, "")
 		}
 	}
 }
 
-func (n *node) WatchFreeSpace(minFreeSpace uint64, backend backend) {
+// counts requests served by this node so that a load figure
+// can be gossiped along with the capacity numbers
+var requestCounter atomic.Uint64
+
+// requests per second over the elapsed period
+func (n *node) updateLoad(requests uint64, elapsed time.Duration) {
+	if elapsed < time.Second {
+		return
+	}
+	n.Load = float64(requests) / elapsed.Seconds()
+}
+
+// works on a copy of our node, since the backend can be slow,
+// and then hands the results over to the cluster
+func (c *cluster) WatchFreeSpace(minFreeSpace uint64, backend backend) {
+	last := time.Now()
 	for {
+		n := c.Self()
 		n.updateFreeSpaceStatus(minFreeSpace, backend)
+		now := time.Now()
+		n.updateLoad(requestCounter.Swap(0), now.Sub(last))
+		last = now
+		c.UpdateSelf(func(m *node) {
+			m.FreeSpace = n.FreeSpace
+			m.Capacity = n.Capacity
+			m.BlobCount = n.BlobCount
+			m.Writeable = n.Writeable
+			m.Load = n.Load
+		})
+		// let the rest of the cluster know
+		updateGossipMeta()
 		baseTime := 300
 		jitter := rand.Intn(5)
 		time.Sleep(time.Duration((baseTime*3)+jitter) * time.Second)
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"io"
 	"net/http"
@@ -498,4 +499,34 @@ func Test_postFile(t *testing.T) {
 									if err == nil {
 										t.Error("postFile should fail on read error")
 									}
-								}
\ No newline at end of file
+								}
+
+func Test_updateLoad(t *testing.T) {
+	n := newNode("testuuid", "http://localhost:1000", true)
+	n.updateLoad(600, time.Minute)
+	if n.Load != 10 {
+		t.Errorf("expected a load of 10, got %f", n.Load)
+	}
+	// too short a period to say anything useful
+	n.updateLoad(600, time.Millisecond)
+	if n.Load != 10 {
+		t.Errorf("load shouldn't change, got %f", n.Load)
+	}
+}
+
+func Test_RangeSummaryPassesRequestID(t *testing.T) {
+	var got string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Get(requestIDHeader)
+		_, _ = w.Write([]byte(`{"leaf":true}`))
+	}))
+	defer ts.Close()
+	n := newNode("peer", ts.URL, true)
+	ctx := withRequestID(context.Background(), "sync-pass")
+	if _, err := n.RangeSummary(ctx, keyRange{}, "secret"); err != nil {
+		t.Fatal(err)
+	}
+	if got != "sync-pass" {
+		t.Errorf("request ID didn't reach the peer: %q", got)
+	}
+}
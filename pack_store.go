@@ -0,0 +1,402 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"log/slog"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// small files, packed together into append-only segment files so
+// they don't each need their own stack of directories. each record
+// in a segment is a header, then the data:
+//
+//	key length (2 bytes), key, flags (1 byte),
+//	data length (4 bytes), crc32 of the data (4 bytes)
+//
+// deleting a key appends a tombstone. which segment and offset
+// each live key is at is kept in memory, and rebuilt by reading
+// through the segments on startup. segments that end up mostly
+// dead get compacted: the live records are copied to the end of
+// the newest segment and the old one is removed.
+type packStore struct {
+	dir string
+	// files bigger than this don't get packed
+	Threshold int64
+	// start a new segment once the current one gets this big
+	SegmentSize int64
+
+	mu       sync.Mutex
+	segments map[int]*packSegment
+	active   int
+	locs     map[string]packLoc
+	// for deleted keys, the segment that still has their last
+	// write. the tombstone has to be kept until that's gone
+	tombstones map[string]int
+}
+
+type packSegment struct {
+	f    *os.File
+	size int64
+	// bytes taken up by records that are still live
+	live int64
+}
+
+type packLoc struct {
+	segment int
+	// where the record starts
+	offset int64
+	size   int64
+	crc    uint32
+}
+
+const (
+	packFlagPut       = 0
+	packFlagTombstone = 1
+	// compact segments that are less than this much live
+	packCompactRatio = 0.5
+)
+
+var errPackCorrupt = errors.New("packed file failed its checksum")
+
+func packHeaderSize(k string) int64 {
+	return int64(2 + len(k) + 1 + 4 + 4)
+}
+
+func (l packLoc) recordSize(k string) int64 {
+	return packHeaderSize(k) + l.size
+}
+
+func segmentName(id int) string {
+	return fmt.Sprintf("segment-%08d.pack", id)
+}
+
+func newPackStore(dir string, threshold, segmentSize int64) (*packStore, error) {
+	p := &packStore{
+		dir:         dir,
+		Threshold:   threshold,
+		SegmentSize: segmentSize,
+		segments:    make(map[int]*packSegment),
+		locs:        make(map[string]packLoc),
+		tombstones:  make(map[string]int),
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	names, err := filepath.Glob(filepath.Join(dir, "segment-*.pack"))
+	if err != nil {
+		return nil, err
+	}
+	var ids []int
+	for _, name := range names {
+		var id int
+		if _, err := fmt.Sscanf(filepath.Base(name), "segment-%08d.pack", &id); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		if err := p.load(id); err != nil {
+			return nil, err
+		}
+	}
+	if len(ids) == 0 {
+		if err := p.newSegment(1); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// read through a segment, keeping track of where everything is.
+// a record that got cut off at the end of a segment (we crashed
+// while writing it) is chopped off
+func (p *packStore) load(id int) error {
+	f, err := os.OpenFile(filepath.Join(p.dir, segmentName(id)), os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	seg := &packSegment{f: f}
+	p.segments[id] = seg
+	p.active = id
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	var offset int64
+	for offset < info.Size() {
+		k, flags, loc, err := p.readHeader(f, offset)
+		if err != nil || offset+loc.recordSize(k) > info.Size() {
+			slog.Warn("truncating torn record", "segment", segmentName(id), "offset", offset, "op", "pack")
+			if err := f.Truncate(offset); err != nil {
+				return err
+			}
+			break
+		}
+		loc.segment = id
+		p.apply(k, flags, loc)
+		offset += loc.recordSize(k)
+	}
+	seg.size = offset
+	return nil
+}
+
+func (p *packStore) readHeader(f *os.File, offset int64) (string, byte, packLoc, error) {
+	var kl [2]byte
+	if _, err := f.ReadAt(kl[:], offset); err != nil {
+		return "", 0, packLoc{}, err
+	}
+	klen := int(binary.BigEndian.Uint16(kl[:]))
+	rest := make([]byte, klen+1+4+4)
+	if _, err := f.ReadAt(rest, offset+2); err != nil {
+		return "", 0, packLoc{}, err
+	}
+	k := string(rest[:klen])
+	if _, err := keyFromString(k); err != nil {
+		return "", 0, packLoc{}, err
+	}
+	loc := packLoc{
+		offset: offset,
+		size:   int64(binary.BigEndian.Uint32(rest[klen+1:])),
+		crc:    binary.BigEndian.Uint32(rest[klen+5:]),
+	}
+	return k, rest[klen], loc, nil
+}
+
+// update the in-memory state for a record. needs the lock held
+func (p *packStore) apply(k string, flags byte, loc packLoc) {
+	old, had := p.locs[k]
+	if had {
+		p.segments[old.segment].live -= old.recordSize(k)
+	}
+	if flags == packFlagTombstone {
+		delete(p.locs, k)
+		if had {
+			p.tombstones[k] = old.segment
+		}
+		return
+	}
+	delete(p.tombstones, k)
+	p.locs[k] = loc
+	p.segments[loc.segment].live += loc.recordSize(k)
+}
+
+func (p *packStore) newSegment(id int) error {
+	f, err := os.OpenFile(filepath.Join(p.dir, segmentName(id)), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	p.segments[id] = &packSegment{f: f}
+	p.active = id
+	return nil
+}
+
+// needs the lock held
+func (p *packStore) append(k string, flags byte, data []byte) error {
+	seg := p.segments[p.active]
+	if seg.size >= p.SegmentSize {
+		if err := p.newSegment(p.active + 1); err != nil {
+			return err
+		}
+		seg = p.segments[p.active]
+	}
+	loc := packLoc{
+		segment: p.active,
+		offset:  seg.size,
+		size:    int64(len(data)),
+		crc:     crc32.ChecksumIEEE(data),
+	}
+	rec := make([]byte, 0, loc.recordSize(k))
+	rec = binary.BigEndian.AppendUint16(rec, uint16(len(k)))
+	rec = append(rec, k...)
+	rec = append(rec, flags)
+	rec = binary.BigEndian.AppendUint32(rec, uint32(len(data)))
+	rec = binary.BigEndian.AppendUint32(rec, loc.crc)
+	rec = append(rec, data...)
+	if _, err := seg.f.WriteAt(rec, seg.size); err != nil {
+		return err
+	}
+	seg.size += int64(len(rec))
+	p.apply(k, flags, loc)
+	return nil
+}
+
+func (p *packStore) Put(key key, data []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if loc, ok := p.locs[key.String()]; ok && loc.crc == crc32.ChecksumIEEE(data) {
+		// the same thing is already here. unless it's been
+		// damaged, there's no need for another copy
+		if _, err := p.get(key.String(), loc); err == nil {
+			return nil
+		}
+	}
+	return p.append(key.String(), packFlagPut, data)
+}
+
+// needs the lock held
+func (p *packStore) get(k string, loc packLoc) ([]byte, error) {
+	data := make([]byte, loc.size)
+	if _, err := p.segments[loc.segment].f.ReadAt(data, loc.offset+packHeaderSize(k)); err != nil {
+		return nil, err
+	}
+	if crc32.ChecksumIEEE(data) != loc.crc {
+		return data, errPackCorrupt
+	}
+	return data, nil
+}
+
+// returns false if the key isn't packed
+func (p *packStore) Get(key key) ([]byte, bool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	loc, ok := p.locs[key.String()]
+	if !ok {
+		return nil, false, nil
+	}
+	data, err := p.get(key.String(), loc)
+	return data, true, err
+}
+
+func (p *packStore) Has(key key) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, ok := p.locs[key.String()]
+	return ok
+}
+
+func (p *packStore) Delete(key key) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.locs[key.String()]; !ok {
+		return nil
+	}
+	return p.append(key.String(), packFlagTombstone, nil)
+}
+
+func (p *packStore) forEach(fn func(k string, size int64)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for k, loc := range p.locs {
+		fn(k, loc.size)
+	}
+}
+
+// the segments that are mostly dead, oldest first. the one being
+// written to is left alone
+func (p *packStore) compactable() []int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var ids []int
+	for id, seg := range p.segments {
+		if id != p.active && float64(seg.live) < float64(seg.size)*packCompactRatio {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+// copies what's still live in a segment to the end of the newest
+// one and removes it. returns how many bytes were reclaimed
+func (p *packStore) compactSegment(id int) (int64, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	seg, ok := p.segments[id]
+	if !ok || id == p.active {
+		return 0, nil
+	}
+	reclaimed := seg.size - seg.live
+	// the live records get copied to the end of this one, and any
+	// that get opened after it
+	first := p.active
+	var offset int64
+	for offset < seg.size {
+		k, flags, loc, err := p.readHeader(seg.f, offset)
+		if err != nil {
+			return 0, err
+		}
+		loc.segment = id
+		offset += loc.recordSize(k)
+		if flags == packFlagTombstone {
+			// only needed while the write it deleted is still
+			// around in an older segment
+			s, ok := p.tombstones[k]
+			if ok && p.segments[s] == nil {
+				delete(p.tombstones, k)
+			} else if ok && s < id {
+				if err := p.append(k, packFlagTombstone, nil); err != nil {
+					return 0, err
+				}
+			}
+			continue
+		}
+		if cur, ok := p.locs[k]; !ok || cur.segment != id || cur.offset != loc.offset {
+			continue
+		}
+		data, err := p.get(k, loc)
+		if err != nil {
+			slog.Warn("dropping key while compacting", "key", k, "op", "pack", "err", err)
+			p.segments[id].live -= loc.recordSize(k)
+			delete(p.locs, k)
+			continue
+		}
+		if err := p.append(k, packFlagPut, data); err != nil {
+			return 0, err
+		}
+	}
+	// the copies have to be on the disk before the only other
+	// copy goes away
+	for i := first; i <= p.active; i++ {
+		if err := p.segments[i].f.Sync(); err != nil {
+			return 0, err
+		}
+	}
+	if err := syncDir(p.dir); err != nil {
+		return 0, err
+	}
+	seg.f.Close()
+	delete(p.segments, id)
+	if err := os.Remove(filepath.Join(p.dir, segmentName(id))); err != nil {
+		return 0, err
+	}
+	return reclaimed, nil
+}
+
+func (p *packStore) Compact() {
+	for _, id := range p.compactable() {
+		reclaimed, err := p.compactSegment(id)
+		if err != nil {
+			slog.Error("couldn't compact", "segment", segmentName(id), "op", "pack", "err", err)
+			continue
+		}
+		slog.Info("compacted", "segment", segmentName(id), "reclaimed", reclaimed, "op", "pack")
+		packBytesReclaimed.Add(float64(reclaimed))
+	}
+}
+
+func (p *packStore) CompactEvery(interval int) {
+	for {
+		jitter := rand.Intn(5)
+		time.Sleep(time.Duration(interval+jitter) * time.Second)
+		p.Compact()
+	}
+}
+
+// the made up path that packed keys are verified under, since
+// they don't have a file of their own
+func (p *packStore) path(key key) string {
+	return p.dir + key.String()
+}
+
+func (p *packStore) owns(path string) bool {
+	return strings.HasPrefix(path, p.dir)
+}
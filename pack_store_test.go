@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func packPut(t *testing.T, p *packStore, content string) key {
+	k, _ := keyFromString(contentKey(content))
+	if err := p.Put(*k, []byte(content)); err != nil {
+		t.Fatal(err)
+	}
+	return *k
+}
+
+func TestPackStorePersists(t *testing.T) {
+	dir := t.TempDir() + "/"
+	p, err := newPackStore(dir, 100, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := packPut(t, p, "one")
+	b := packPut(t, p, "two")
+	c := packPut(t, p, "three")
+	_ = p.Delete(b)
+	// writing the same thing again shouldn't add anything
+	size := p.segments[p.active].size
+	packPut(t, p, "one")
+	if p.segments[p.active].size != size {
+		t.Errorf("rewriting an unchanged key appended a record")
+	}
+
+	p, err = newPackStore(dir, 100, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Has(b) {
+		t.Errorf("deleted key came back")
+	}
+	for k, want := range map[*key]string{&a: "one", &c: "three"} {
+		data, ok, err := p.Get(*k)
+		if !ok || err != nil || string(data) != want {
+			t.Errorf("got %q %v %v, want %q", data, ok, err, want)
+		}
+	}
+}
+
+func TestPackStoreTornWrite(t *testing.T) {
+	dir := t.TempDir() + "/"
+	p, _ := newPackStore(dir, 100, 1024)
+	a := packPut(t, p, "one")
+	size := p.segments[p.active].size
+
+	f, _ := os.OpenFile(filepath.Join(dir, segmentName(p.active)), os.O_APPEND|os.O_WRONLY, 0644)
+	_, _ = f.Write([]byte{0, 45, 's', 'h', 'a'})
+	f.Close()
+
+	p, err := newPackStore(dir, 100, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !p.Has(a) || p.segments[p.active].size != size {
+		t.Errorf("torn record should have been chopped off")
+	}
+	b := packPut(t, p, "two")
+	if data, _, err := p.Get(b); err != nil || string(data) != "two" {
+		t.Errorf("couldn't write after a torn record: %q %v", data, err)
+	}
+}
+
+func TestPackStoreDetectsCorruption(t *testing.T) {
+	dir := t.TempDir() + "/"
+	p, _ := newPackStore(dir, 100, 1024)
+	a := packPut(t, p, "some data")
+	loc := p.locs[a.String()]
+	_, _ = p.segments[loc.segment].f.WriteAt([]byte("X"), loc.offset+packHeaderSize(a.String()))
+	if _, _, err := p.Get(a); err != errPackCorrupt {
+		t.Errorf("expected errPackCorrupt, got %v", err)
+	}
+	// a good copy replaces it
+	packPut(t, p, "some data")
+	if data, _, err := p.Get(a); err != nil || string(data) != "some data" {
+		t.Errorf("corrupt record wasn't replaced: %q %v", data, err)
+	}
+}
+
+func TestPackStoreCompacts(t *testing.T) {
+	dir := t.TempDir() + "/"
+	// tiny segments so there are lots of them
+	p, _ := newPackStore(dir, 100, 200)
+	var keys []key
+	for i := 0; i < 40; i++ {
+		keys = append(keys, packPut(t, p, fmt.Sprintf("file %d", i)))
+	}
+	for i, k := range keys {
+		if i%4 != 0 {
+			_ = p.Delete(k)
+		}
+	}
+	before := len(p.segments)
+	p.Compact()
+	if len(p.segments) >= before {
+		t.Errorf("expected fewer segments after compacting, had %d, now %d", before, len(p.segments))
+	}
+
+	p, err := newPackStore(dir, 100, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, k := range keys {
+		if i%4 == 0 {
+			if data, _, err := p.Get(k); err != nil || string(data) != fmt.Sprintf("file %d", i) {
+				t.Errorf("lost %s in compaction: %q %v", k, data, err)
+			}
+		} else if p.Has(k) {
+			t.Errorf("%s came back after compaction", k)
+		}
+	}
+}
+
+func TestDiskBackendPacksSmallFiles(t *testing.T) {
+	d := newDiskBackend(t.TempDir() + "/")
+	if err := d.EnablePacks(10, 1024); err != nil {
+		t.Fatal(err)
+	}
+	small, _ := keyFromString(contentKey("tiny"))
+	big, _ := keyFromString(contentKey("not so tiny at all"))
+	_ = d.Write(*small, io.NopCloser(bytes.NewReader([]byte("tiny"))))
+	_ = d.Write(*big, io.NopCloser(bytes.NewReader([]byte("not so tiny at all"))))
+
+	if _, err := os.Stat(d.Root + small.Algorithm + "/" + small.AsPath()); !os.IsNotExist(err) {
+		t.Errorf("small file shouldn't get a directory")
+	}
+	if !d.packed(*small) || d.packed(*big) {
+		t.Errorf("only the small file should be packed")
+	}
+	for k, want := range map[*key]string{small: "tiny", big: "not so tiny at all"} {
+		if data, err := d.Read(*k); err != nil || string(data) != want {
+			t.Errorf("got %q %v, want %q", data, err, want)
+		}
+	}
+	if err := d.RebuildIndex(); err != nil {
+		t.Fatal(err)
+	}
+	if st := d.IndexStats(); st.Keys != 2 || st.Bytes != 22 {
+		t.Errorf("packed files should be in the index: %+v", st)
+	}
+
+	// a damaged packed file gets repaired from another node
+	peer := newMemoryBackend(1000)
+	memoryWrite(t, peer, "tiny")
+	ts := memoryPeer(t, peer)
+	n := newNode("local", "", true)
+	c := newCluster(n, "secret", 60)
+	c.AddNeighbor(*newNode("peer", ts.URL, true))
+	loc := d.packs.locs[small.String()]
+	_, _ = d.packs.segments[loc.segment].f.WriteAt([]byte("X"), loc.offset+packHeaderSize(small.String()))
+	if err := d.NewVerifier(c).VerifyKey(*small); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := d.Read(*small); err != nil || string(data) != "tiny" {
+		t.Errorf("packed file wasn't repaired: %q %v", data, err)
+	}
+
+	_ = d.Delete(*small)
+	if d.Exists(*small) {
+		t.Errorf("packed file should have been deleted")
+	}
+}
@@ -2,12 +2,13 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"errors"
-	"log"
 )
 
 type rebalanceRequest struct {
 	Key        key
+	ctx        context.Context
 	chResponse chan error
 }
 
@@ -26,13 +27,17 @@ func newRebalancer(c *cluster, s site) *rebalancer {
 
 func (r *rebalancer) run() {
 	for req := range r.chR {
-		req.chResponse <- r.doRebalance(req.Key)
+		req.chResponse <- r.doRebalance(req.ctx, req.Key)
 	}
 }
 
 func (r *rebalancer) Rebalance(key key) error {
+	return r.RebalanceContext(context.Background(), key)
+}
+
+func (r *rebalancer) RebalanceContext(ctx context.Context, key key) error {
 	resp := make(chan error)
-	req := rebalanceRequest{key, resp}
+	req := rebalanceRequest{key, ctx, resp}
 	r.chR <- req
 	return <-resp
 }
@@ -40,53 +45,82 @@ func (r *rebalancer) Rebalance(key key) error {
 // check that the file is stored in at least Replication nodes
 // and, if at all possible, those should be the ones at the front
 // of the list
-func (r rebalancer) doRebalance(key key) error {
+func (r rebalancer) doRebalance(ctx context.Context, key key) (err error) {
+	ctx, sp := startSpan(ctx, "rebalance")
+	sp.SetAttr("cask.key", key.String())
+	defer func() { sp.Finish(err) }()
+	l := logger(ctx).With("key", key.String(), "op", "rebalance")
 	if r.c == nil {
-		log.Println("can't rebalance on a nil cluster")
+		l.Error("can't rebalance on a nil cluster")
 		return errors.New("nil cluster")
 	}
 	rebalances.Inc()
-	nodesToCheck := r.c.ReadOrder(key.String())
-	satisfied, deleteLocal, foundReplicas := r.checkNodesForRebalance(key, nodesToCheck)
+	if r.s.migrated(key) {
+		// nobody's read it here for a while and the cold nodes
+		// have it, so it's not coming back to the hot tier
+		return nil
+	}
+	nodesToCheck := r.c.ClassOrder(key.String(), r.c.Myself.class())
+	satisfied, deleteLocal, foundReplicas := r.checkNodesForRebalance(ctx, key, nodesToCheck)
 	if !satisfied {
 		rebalanceFailures.Inc()
-		log.Printf("could not replicate %s to %d nodes", key, r.s.Replication)
+		l.Warn("could not replicate to enough nodes", "replicas", foundReplicas, "want", r.s.Replication)
 	} else {
 		rebalanceNoops.Inc()
-		log.Printf("%s has full replica set (%d of %d)\n", key, foundReplicas, r.s.Replication)
+		l.Debug("has full replica set", "replicas", foundReplicas, "want", r.s.Replication)
 	}
-	if satisfied && deleteLocal {
+	if satisfied && deleteLocal && !r.holdingHint(key) {
 		rebalanceDeletes.Inc()
-		r.cleanUpExcessReplica(key)
+		r.cleanUpExcessReplica(ctx, key)
 	}
 	return nil
 }
 
-func (r rebalancer) checkNodesForRebalance(key key, nodesToCheck []node) (bool, bool, int) {
+func (r rebalancer) checkNodesForRebalance(ctx context.Context, key key, nodesToCheck []node) (bool, bool, int) {
 	var satisfied = false
 	var foundReplicas = 0
 	var deleteLocal = true
+	// replicas all sitting in the same zone or rack don't
+	// count as a full set if they could be spread out
+	domains := newDomainTracker(nodesToCheck, r.s.Replication)
+	draining := r.c.Self().Draining
 
 	for _, n := range nodesToCheck {
+		if n.Draining {
+			// copies on a draining node are going away, so
+			// they don't count
+			continue
+		}
 		if n.UUID == r.c.Myself.UUID {
 			deleteLocal = false
 			foundReplicas++
-		} else {
-			foundReplicas = foundReplicas + r.retrieveReplica(key, n, satisfied)
+			domains.add(n)
+		} else if r.retrieveReplica(ctx, key, n, satisfied || !r.wantCopy(n, domains, foundReplicas)) > 0 {
+			foundReplicas++
+			domains.add(n)
 		}
-		if foundReplicas >= r.s.Replication {
+		if foundReplicas >= r.s.Replication && domains.satisfied() {
 			satisfied = true
 		}
 		if foundReplicas >= r.s.MaxReplication {
 
-			return satisfied, deleteLocal, foundReplicas
+			return satisfied, deleteLocal && !draining, foundReplicas
 		}
 	}
-	return satisfied, deleteLocal, foundReplicas
+	// a draining node hangs on to everything until it is removed
+	return satisfied, deleteLocal && !draining, foundReplicas
 }
 
-func (r rebalancer) retrieveReplica(key key, n node, satisfied bool) int {
-	local, err := n.RetrieveInfo(key, r.c.secret)
+// a new copy only goes on a node in a zone or rack that is already
+// covered if there's still room for it after every missing domain
+// gets one. otherwise it'd be pushed to every node down the list
+// until the domains were covered
+func (r rebalancer) wantCopy(n node, domains *domainTracker, found int) bool {
+	return domains.adds(n) || found+domains.missing() < r.s.Replication
+}
+
+func (r rebalancer) retrieveReplica(ctx context.Context, key key, n node, satisfied bool) int {
+	local, err := n.RetrieveInfoContext(ctx, key, r.c.secret)
 	if err == nil && local {
 		return 1
 	}
@@ -94,31 +128,40 @@ func (r rebalancer) retrieveReplica(key key, n node, satisfied bool) int {
 		return 0
 	}
 	if !satisfied {
+		l := logger(ctx).With("key", key.String(), "peer", n.UUID, "op", "rebalance")
 		b, err := r.s.Backend.Read(key)
 		buf := bytes.NewBuffer(b)
 
 		if err != nil {
-			log.Printf("error reading from backend")
+			l.Error("error reading from backend", "err", err)
 			return 0
 		}
-		if n.AddFile(key, buf, r.c.secret) {
-			log.Printf("replicated %s\n", key)
+		if n.AddFileWithHint(ctx, key, buf, r.c.secret, "") {
+			l.Info("replicated")
+			recordEvent(eventReplicated, key, n.UUID, "rebalance")
 			return 1
 		}
-		log.Println("write to the node failed, but what can we do?")
+		l.Warn("write to the node failed, but what can we do?")
 	}
 
 	return 0
 }
 
+// we're holding the copy for a node that's down. it has to stay
+// until it has been handed off
+func (r rebalancer) holdingHint(key key) bool {
+	return r.c.handoff != nil && r.c.handoff.store.Holding(key)
+}
+
 // our node is not at the front of the list, so
 // we have an excess copy. clean that up and make room!
-func (r rebalancer) cleanUpExcessReplica(key key) {
+func (r rebalancer) cleanUpExcessReplica(ctx context.Context, key key) {
+	l := logger(ctx).With("key", key.String(), "op", "rebalance")
 	err := r.s.Backend.Delete(key)
 	if err != nil {
-		log.Printf("could not clear out excess replica: %s\n", key)
-		log.Println(err.Error())
+		l.Error("could not clear out excess replica", "err", err)
 	} else {
-		log.Printf("cleared excess replica: %s\n", key)
+		l.Info("cleared excess replica")
+		recordEvent(eventDeleted, key, "", "rebalance")
 	}
 }
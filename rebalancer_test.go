@@ -1,9 +1,11 @@
 package main
 
 import (
+	"context"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"sync"
 	"testing"
 	"time"
 )
@@ -21,7 +23,7 @@ func Test_newRebalancer(t *testing.T) {
 func Test_Rebalance_NilCluster(t *testing.T) {
 	r := rebalancer{c: nil}
 	k, _ := keyFromString("sha1:da39a3ee5e6b4b0d3255bfef95601890afd80709")
-	err := r.doRebalance(*k)
+	err := r.doRebalance(context.Background(), *k)
 	if err == nil {
 		t.Error("expected error on nil cluster")
 	}
@@ -109,7 +111,7 @@ func Test_Rebalance_DeleteLocal(t *testing.T) {
 	r := rebalancer{c: c, s: s}
 	
 	k, _ := keyFromString("sha1:da39a3ee5e6b4b0d3255bfef95601890afd80709")
-	r.cleanUpExcessReplica(*k)
+	r.cleanUpExcessReplica(context.Background(), *k)
 	
 	if mb.deletedKey != "sha1:da39a3ee5e6b4b0d3255bfef95601890afd80709" {
 		t.Error("Delete was not called on backend")
@@ -139,7 +141,7 @@ func Test_Rebalance_ReplicateToNeighbor_Fail(t *testing.T) {
 	k, _ := keyFromString("sha1:da39a3ee5e6b4b0d3255bfef95601890afd80709")
 	
 	// Should fail to satisfy replication but still complete
-	err := r.doRebalance(*k)
+	err := r.doRebalance(context.Background(), *k)
 	if err != nil {
 		t.Errorf("doRebalance failed: %v", err)
 	}
@@ -164,7 +166,7 @@ func Test_Rebalance_BackendReadError(t *testing.T) {
 	r := rebalancer{c: c, s: s}
 	k, _ := keyFromString("sha1:da39a3ee5e6b4b0d3255bfef95601890afd80709")
 	
-	err := r.doRebalance(*k)
+	err := r.doRebalance(context.Background(), *k)
 	if err != nil {
 		t.Errorf("doRebalance failed: %v", err)
 	}
@@ -175,7 +177,7 @@ func Test_cleanUpExcessReplica_Error(t *testing.T) {
 	s := site{Backend: mb}
 	r := rebalancer{s: s}
 	k, _ := keyFromString("sha1:da39a3ee5e6b4b0d3255bfef95601890afd80709")
-	r.cleanUpExcessReplica(*k)
+	r.cleanUpExcessReplica(context.Background(), *k)
 }
 
 type MockBackendError struct {
@@ -191,7 +193,93 @@ func Test_retrieveReplica_UnwriteableNode(t *testing.T) {
 	c := &cluster{secret: "secret"}
 	r := rebalancer{c: c}
 	k, _ := keyFromString("sha1:da39a3ee5e6b4b0d3255bfef95601890afd80709")
-	if r.retrieveReplica(*k, *n, false) != 0 {
+	if r.retrieveReplica(context.Background(), *k, *n, false) != 0 {
 		t.Error("should return 0 for unwriteable node")
 	}
-}
\ No newline at end of file
+}
+func Test_Rebalance_SpreadsAcrossZones(t *testing.T) {
+	// same zone as us, already has a copy
+	sameZone := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer sameZone.Close()
+	// other zone, doesn't have it
+	var pushed bool
+	otherZone := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" {
+			pushed = true
+			_, _ = w.Write([]byte("sha1:da39a3ee5e6b4b0d3255bfef95601890afd80709"))
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer otherZone.Close()
+
+	n := newNode("testuuid", "http://localhost:1000", true)
+	n.Zone = "a"
+	c := newCluster(n, "secret", 60)
+	c.AddNeighbor(node{UUID: "same", BaseURL: sameZone.URL, Writeable: true, Zone: "a"})
+	c.AddNeighbor(node{UUID: "other", BaseURL: otherZone.URL, Writeable: true, Zone: "b"})
+
+	mb := &MockBackendFull{
+		data: map[string][]byte{
+			"sha1:da39a3ee5e6b4b0d3255bfef95601890afd80709": []byte(""),
+		},
+	}
+	s := site{Node: n, Cluster: c, Backend: mb, Replication: 2, MaxReplication: 3}
+	r := rebalancer{c: c, s: s}
+	k, _ := keyFromString("sha1:da39a3ee5e6b4b0d3255bfef95601890afd80709")
+
+	// two copies in zone a isn't enough when there's a zone b
+	satisfied, _, _ := r.checkNodesForRebalance(context.Background(), *k, []node{
+		*n,
+		{UUID: "same", BaseURL: sameZone.URL, Writeable: true, Zone: "a"},
+		{UUID: "other", BaseURL: otherZone.URL, Writeable: true, Zone: "b"},
+	})
+	if !satisfied {
+		t.Error("should have been satisfied after pushing to zone b")
+	}
+	if !pushed {
+		t.Error("expected a copy to be pushed to the other zone")
+	}
+}
+
+func Test_Rebalance_OnlyPushesToNewZones(t *testing.T) {
+	k, _ := keyFromString("sha1:da39a3ee5e6b4b0d3255bfef95601890afd80709")
+	pushes := map[string]int{}
+	var mu sync.Mutex
+	peer := func(name string) *httptest.Server {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == "POST" {
+				mu.Lock()
+				pushes[name]++
+				mu.Unlock()
+				_, _ = w.Write([]byte(k.String()))
+				return
+			}
+			w.WriteHeader(http.StatusNotFound)
+		}))
+		t.Cleanup(ts.Close)
+		return ts
+	}
+	n := newNode("testuuid", "http://localhost:1000", true)
+	n.Zone = "a"
+	nodes := []node{
+		*n,
+		{UUID: "a2", BaseURL: peer("a2").URL, Writeable: true, Zone: "a"},
+		{UUID: "a3", BaseURL: peer("a3").URL, Writeable: true, Zone: "a"},
+		{UUID: "b1", BaseURL: peer("b1").URL, Writeable: true, Zone: "b"},
+	}
+	c := newCluster(n, "secret", 60)
+	mb := &MockBackendFull{data: map[string][]byte{k.String(): []byte("")}}
+	s := site{Node: n, Cluster: c, Backend: mb, Replication: 2, MaxReplication: 4}
+	r := rebalancer{c: c, s: s}
+
+	satisfied, _, found := r.checkNodesForRebalance(context.Background(), *k, nodes)
+	if !satisfied || found != 2 {
+		t.Errorf("expected 2 copies in two zones, got %d (%v)", found, satisfied)
+	}
+	if pushes["a2"] != 0 || pushes["a3"] != 0 || pushes["b1"] != 1 {
+		t.Errorf("should only push to the zone without a copy: %v", pushes)
+	}
+}
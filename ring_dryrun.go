@@ -0,0 +1,172 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// what would happen to data placement if node weights were changed
+
+type nodeShare struct {
+	UUID          string  `json:"uuid"`
+	CurrentWeight float64 `json:"current_weight"`
+	NewWeight     float64 `json:"new_weight"`
+	CurrentShare  float64 `json:"current_share"`
+	NewShare      float64 `json:"new_share"`
+}
+
+type ringMovement struct {
+	Replication int `json:"replication"`
+	// fraction of all replicas that would have to be copied
+	// to a new node
+	MovedFraction       float64     `json:"moved_fraction"`
+	EstimatedBlobsMoved int64       `json:"estimated_blobs_moved"`
+	EstimatedBytesMoved uint64      `json:"estimated_bytes_moved"`
+	Nodes               []nodeShare `json:"nodes"`
+}
+
+// parse "uuid:weight,uuid:weight"
+func parseWeights(s string) (map[string]float64, error) {
+	weights := make(map[string]float64)
+	if s == "" {
+		return weights, nil
+	}
+	for _, part := range strings.Split(s, ",") {
+		i := strings.LastIndex(part, ":")
+		if i < 1 {
+			return nil, errors.New("weights must be uuid:weight pairs")
+		}
+		w, err := strconv.ParseFloat(part[i+1:], 64)
+		if err != nil || w <= 0 {
+			return nil, errors.New("invalid weight for " + part[:i])
+		}
+		weights[part[:i]] = w
+	}
+	return weights, nil
+}
+
+func (c *cluster) WeightChangeDryRun(weights map[string]float64, replication int) (ringMovement, error) {
+	current := c.NeighborsInclusive()
+	proposed := make([]node, len(current))
+	copy(proposed, current)
+	for uuid := range weights {
+		found := false
+		for i := range proposed {
+			if proposed[i].UUID == uuid {
+				proposed[i].Weight = weights[uuid]
+				found = true
+			}
+		}
+		if !found {
+			return ringMovement{}, errors.New("unknown node " + uuid)
+		}
+	}
+	moved, shares := compareRings(
+		neighborsToRing(current, c.CapacityWeighted),
+		neighborsToRing(proposed, c.CapacityWeighted),
+		len(current), replication)
+	m := ringMovement{Replication: replication, MovedFraction: moved}
+
+	// the gossiped blob counts and disk usage are for all the
+	// replicas, so that's what the fraction applies to
+	var blobs int64
+	var used uint64
+	for i, n := range current {
+		blobs += n.BlobCount
+		if n.Capacity > n.FreeSpace {
+			used += n.Capacity - n.FreeSpace
+		}
+		m.Nodes = append(m.Nodes, nodeShare{
+			UUID:          n.UUID,
+			CurrentWeight: weightOrDefault(n.Weight),
+			NewWeight:     weightOrDefault(proposed[i].Weight),
+			CurrentShare:  shares[n.UUID][0],
+			NewShare:      shares[n.UUID][1],
+		})
+	}
+	m.EstimatedBlobsMoved = int64(math.Round(m.MovedFraction * float64(blobs)))
+	m.EstimatedBytesMoved = uint64(math.Round(m.MovedFraction * float64(used)))
+	return m, nil
+}
+
+func weightOrDefault(w float64) float64 {
+	if w <= 0 {
+		return 1
+	}
+	return w
+}
+
+// every key between two adjacent positions (from either ring)
+// gets the same node order, so we only need to look at each
+// of those arcs once and weight it by its length. returns the
+// fraction of replicas that would move and the share of the
+// keyspace each node holds a replica of, before and after.
+func compareRings(before, after ringEntryList, size, replication int) (float64, map[string][2]float64) {
+	var positions []string
+	for _, r := range before {
+		positions = append(positions, r.Hash)
+	}
+	for _, r := range after {
+		positions = append(positions, r.Hash)
+	}
+	sort.Strings(positions)
+
+	shares := make(map[string][2]float64)
+	var moved float64
+	for i, p := range positions {
+		next := positions[(i+1)%len(positions)]
+		length := arcLength(p, next)
+		if length == 0 {
+			continue
+		}
+		b := replicaSet(hashOrder("sha1:"+p, size, before), replication)
+		a := replicaSet(hashOrder("sha1:"+p, size, after), replication)
+		for _, uuid := range b {
+			s := shares[uuid]
+			s[0] += length
+			shares[uuid] = s
+		}
+		var newCopies int
+		for _, uuid := range a {
+			s := shares[uuid]
+			s[1] += length
+			shares[uuid] = s
+			if !slices.Contains(b, uuid) {
+				newCopies++
+			}
+		}
+		moved += length * float64(newCopies)
+	}
+
+	if replication > 0 {
+		moved = moved / float64(replication)
+	}
+	return moved, shares
+}
+
+func replicaSet(nodes []node, replication int) []string {
+	var uuids []string
+	for _, n := range nodes {
+		if len(uuids) >= replication {
+			break
+		}
+		if n.UUID != "" {
+			uuids = append(uuids, n.UUID)
+		}
+	}
+	return uuids
+}
+
+// fraction of the keyspace from one ring position up to the
+// next, going around the end if need be. the first 64 bits of
+// the hash are plenty of precision.
+func arcLength(from, to string) float64 {
+	f, _ := strconv.ParseUint(from[:16], 16, 64)
+	t, _ := strconv.ParseUint(to[:16], 16, 64)
+	// unsigned arithmetic takes care of wrapping around
+	return float64(t-f) / math.Pow(2, 64)
+}
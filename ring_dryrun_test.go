@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func Test_parseWeights(t *testing.T) {
+	w, err := parseWeights("a:2,b:0.5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w["a"] != 2 || w["b"] != 0.5 {
+		t.Errorf("wrong weights: %v", w)
+	}
+	for _, bad := range []string{"a", ":2", "a:x", "a:0", "a:-1"} {
+		if _, err := parseWeights(bad); err == nil {
+			t.Errorf("expected an error for %q", bad)
+		}
+	}
+}
+
+func Test_VirtualNodes(t *testing.T) {
+	n := node{UUID: "a"}
+	if n.VirtualNodes() != replicas {
+		t.Errorf("unset weight should give %d, got %d", replicas, n.VirtualNodes())
+	}
+	n.Weight = 2
+	if n.VirtualNodes() != 2*replicas {
+		t.Errorf("expected %d, got %d", 2*replicas, n.VirtualNodes())
+	}
+	if len(n.HashKeys()) != 2*replicas {
+		t.Errorf("HashKeys should follow the weight")
+	}
+	n.Weight = 0.001
+	if n.VirtualNodes() != 1 {
+		t.Errorf("should never drop below one, got %d", n.VirtualNodes())
+	}
+}
+
+func Test_compareRings(t *testing.T) {
+	nodes := []node{{UUID: "a"}, {UUID: "b"}, {UUID: "c"}}
+	r := neighborsToRing(nodes, false)
+
+	// no change, nothing moves, and with full replication
+	// everyone holds everything
+	moved, shares := compareRings(r, r, 3, 3)
+	if moved != 0 {
+		t.Errorf("nothing should move, got %f", moved)
+	}
+	for _, n := range nodes {
+		if math.Abs(shares[n.UUID][0]-1) > 1e-9 {
+			t.Errorf("%s should hold everything, got %f", n.UUID, shares[n.UUID][0])
+		}
+	}
+
+	// with replication of one, the shares add up to the whole ring
+	moved, shares = compareRings(r, r, 3, 1)
+	var total float64
+	for _, s := range shares {
+		total += s[0]
+	}
+	if moved != 0 || math.Abs(total-1) > 1e-9 {
+		t.Errorf("shares should add up to 1, got %f", total)
+	}
+
+	// giving a node more weight takes data from the others
+	heavier := []node{{UUID: "a", Weight: 3}, {UUID: "b"}, {UUID: "c"}}
+	moved, shares = compareRings(r, neighborsToRing(heavier, false), 3, 1)
+	if moved <= 0 || moved >= 1 {
+		t.Errorf("some data should move, got %f", moved)
+	}
+	if shares["a"][1] <= shares["a"][0] {
+		t.Errorf("a should gain share: %v", shares["a"])
+	}
+}
+
+func Test_ringDryRunHandler(t *testing.T) {
+	n := newNode("a", "http://localhost:1000", true)
+	c := newCluster(n, "secret", 60)
+	c.AddNeighbor(node{UUID: "b", Writeable: true, BlobCount: 100})
+	s := &site{Node: n, Cluster: c, Replication: 1}
+
+	req := httptest.NewRequest("GET", "/ring/dryrun/?weights=a:2", nil)
+	rr := httptest.NewRecorder()
+	ringDryRunHandler(rr, req, s)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", rr.Code, http.StatusOK)
+	}
+	var m ringMovement
+	if err := json.Unmarshal(rr.Body.Bytes(), &m); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Nodes) != 2 {
+		t.Errorf("expected 2 nodes, got %d", len(m.Nodes))
+	}
+	if m.MovedFraction <= 0 {
+		t.Error("expected some data to move")
+	}
+	if m.EstimatedBlobsMoved <= 0 {
+		t.Error("expected an estimate of blobs moved")
+	}
+
+	req = httptest.NewRequest("GET", "/ring/dryrun/?weights=nope:2", nil)
+	rr = httptest.NewRecorder()
+	ringDryRunHandler(rr, req, s)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("got status %d, want %d", rr.Code, http.StatusBadRequest)
+	}
+}
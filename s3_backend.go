@@ -1,9 +1,19 @@
 package main
 
 import (
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/mitchellh/goamz/aws"
@@ -11,24 +21,136 @@ import (
 )
 
 type s3Backend struct {
-	AccessKey  string
-	SecretKey  string
 	BucketName string
-	bucket     *s3.Bucket
+	// prepended to every object name, so the bucket can be
+	// shared with other things
+	Prefix string
+	// swapped for one with fresh credentials every so often. see
+	// RefreshAuth
+	bucket *atomic.Pointer[s3.Bucket]
+	// where the credentials come from, and whether they can change
+	getAuth    func() (aws.Auth, error)
+	staticAuth bool
+	region     aws.Region
+
+	// zero means no limit
+	QuotaBytes   uint64
+	QuotaObjects int64
+	usage        *s3Usage
+}
+
+// what's stored in the bucket (under our prefix). worked out
+// from a full listing every so often and kept roughly up to
+// date in between
+type s3Usage struct {
+	once    sync.Once
+	mu      sync.Mutex
+	bytes   int64
+	objects int64
+}
+
+type s3Config struct {
+	// if these aren't set, credentials come from the usual
+	// places: ~/.aws/credentials, the AWS_* environment
+	// variables, or the instance role
+	AccessKey string
+	SecretKey string
+	Bucket    string
+	// eg, "eu-west-1". defaults to us-east-1. only the regions goamz
+	// knows about. it only signs with SigV2, so the ones that want
+	// SigV4 (eu-central-1 and newer) won't work anyway
+	Region string
+	// for S3 compatible stores (MinIO, Ceph RGW, etc). eg,
+	// "https://minio.example.com:9000"
+	Endpoint string
+	// put the bucket name in the hostname instead of the path.
+	// goamz lowercases the bucket name when it does this
+	VirtualHosted bool
+	Prefix        string
+
+	QuotaBytes   uint64
+	QuotaObjects int64
+}
+
+func newS3Backend(c s3Config) (*s3Backend, error) {
+	region, err := s3Region(c)
+	if err != nil {
+		return nil, err
+	}
+	s := &s3Backend{
+		BucketName: c.Bucket,
+		Prefix:     c.Prefix,
+		bucket:     &atomic.Pointer[s3.Bucket]{},
+		getAuth: func() (aws.Auth, error) {
+			return aws.GetAuth(c.AccessKey, c.SecretKey)
+		},
+		staticAuth:   c.AccessKey != "" && c.SecretKey != "",
+		region:       region,
+		QuotaBytes:   c.QuotaBytes,
+		QuotaObjects: c.QuotaObjects,
+		usage:        &s3Usage{},
+	}
+	if err := s.refreshAuth(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// how often to fetch the credentials again
+const s3AuthRefresh = time.Minute
+
+// credentials from an instance role or STS run out after a few
+// hours. new ones turn up a while before the old ones expire, so
+// fetching them again every so often means we never sign with a
+// stale set. keys that were configured never change
+func (s s3Backend) RefreshAuth(interval time.Duration) {
+	if s.staticAuth {
+		return
+	}
+	for {
+		time.Sleep(interval)
+		if err := s.refreshAuth(); err != nil {
+			// keep using the old ones. they may still work
+			slog.Warn("couldn't refresh S3 credentials", "op", "refresh_auth", "err", err)
+		}
+	}
 }
 
-func newS3Backend(accessKey, secretKey, bucket string) *s3Backend {
-	auth := aws.Auth{
-		AccessKey: accessKey,
-		SecretKey: secretKey,
+func (s s3Backend) refreshAuth() error {
+	auth, err := s.getAuth()
+	if err != nil {
+		return err
 	}
-	// TODO: allow configuration of buckets in other regions
-	useast := aws.USEast
+	s.bucket.Store(s3.New(auth, s.region).Bucket(s.BucketName))
+	return nil
+}
 
-	connection := s3.New(auth, useast)
-	mybucket := connection.Bucket(bucket)
+func s3Region(c s3Config) (aws.Region, error) {
+	region := aws.USEast
+	if c.Region != "" {
+		r, ok := aws.Regions[c.Region]
+		if !ok {
+			return region, fmt.Errorf("unknown S3 region %q", c.Region)
+		}
+		region = r
+	}
+	if c.Endpoint != "" {
+		region.S3Endpoint = strings.TrimSuffix(c.Endpoint, "/")
+	}
+	region.S3BucketEndpoint = ""
+	if c.VirtualHosted {
+		u, err := url.Parse(region.S3Endpoint)
+		if err != nil || u.Host == "" {
+			return region, fmt.Errorf("invalid S3 endpoint %q", region.S3Endpoint)
+		}
+		region.S3BucketEndpoint = u.Scheme + "://${bucket}." + u.Host
+	}
+	return region, nil
+}
 
-	return &s3Backend{accessKey, secretKey, bucket, mybucket}
+// object name for a key
+func (s s3Backend) path(key key) string {
+	return s.Prefix + key.String()
 }
 
 func (s s3Backend) String() string {
@@ -38,26 +160,60 @@ func (s s3Backend) String() string {
 func (s *s3Backend) Write(key key, r io.ReadCloser) error {
 	b, err := io.ReadAll(r)
 	if err != nil {
-		log.Println("error writing into buffer")
-		log.Println(err)
+		slog.Error("error writing into buffer", "key", key.String(), "op", "write", "err", err)
 		return err
 	}
 
-	err = s.bucket.Put(key.String(), b, "application/octet", s3.BucketOwnerFull)
+	// keys are content addressed, so writing over one that's
+	// already there (a repair, or the same file uploaded twice)
+	// doesn't use any more space
+	existed, headErr := s.stored(key)
+	err = s.put(key, b)
 	if err != nil {
-		log.Println("uh oh. couldn't write to bucket")
-		log.Println(err)
+		slog.Error("uh oh. couldn't write to bucket", "key", key.String(), "op", "write", "err", err)
 		return err
 	}
+	if headErr == nil && !existed {
+		// if we couldn't tell, the next recount will sort it out
+		s.usage.add(int64(len(b)), 1)
+	}
 	return nil
 }
 
+// whether the object is there. anything but a 404 is an error
+func (s s3Backend) stored(key key) (bool, error) {
+	resp, err := s.bucket.Load().Head(s.path(key))
+	var s3err *s3.Error
+	if errors.As(err, &s3err) && s3err.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	return true, nil
+}
+
+// S3 checks the upload against the MD5 we send. the checksums
+// are also kept in the object's metadata so AAE can check them
+// without downloading anything
+func (s *s3Backend) put(key key, b []byte) error {
+	sum := md5.Sum(b)
+	headers := map[string][]string{
+		"Content-Type":    {"application/octet"},
+		"Content-MD5":     {base64.StdEncoding.EncodeToString(sum[:])},
+		"x-amz-meta-md5":  {fmt.Sprintf("%x", sum)},
+		"x-amz-meta-sha1": {fmt.Sprintf("%x", sha1.Sum(b))},
+	}
+	return s.bucket.Load().PutHeader(s.path(key), b, headers, s3.BucketOwnerFull)
+}
+
 func (s s3Backend) Read(key key) ([]byte, error) {
-	return s.bucket.Get(key.String())
+	return s.bucket.Load().Get(s.path(key))
 }
 
 func (s s3Backend) Exists(key key) bool {
-	ls, err := s.bucket.List(key.String(), "", "", 1)
+	ls, err := s.bucket.Load().List(s.path(key), "", "", 1)
 	if err != nil {
 		return false
 	}
@@ -65,57 +221,319 @@ func (s s3Backend) Exists(key key) bool {
 }
 
 func (s *s3Backend) Delete(key key) error {
-	return s.bucket.Del(key.String())
+	ls, err := s.bucket.Load().List(s.path(key), "", "", 1)
+	if err != nil {
+		return err
+	}
+	if len(ls.Contents) == 0 || ls.Contents[0].Key != s.path(key) {
+		// already gone
+		return nil
+	}
+	err = s.bucket.Load().Del(s.path(key))
+	if err == nil {
+		s.usage.add(-ls.Contents[0].Size, -1)
+	}
+	return err
+}
+
+// where AAE saves how far through the bucket it has got, so it
+// can pick up from there after a restart. it's not a valid key,
+// so it never shows up in listings
+const s3AAEMarkerPath = "_cask/aae-marker"
+
+// how often AAE saves its place
+const s3AAEMarkerEvery = 100
+
+// the longest AAE will wait before retrying a failed listing
+const s3MaxListBackoff = 5 * time.Minute
+
+func (s *s3Backend) loadAAEMarker() string {
+	b, err := s.bucket.Load().Get(s.Prefix + s3AAEMarkerPath)
+	if err != nil {
+		return ""
+	}
+	return string(b)
+}
+
+func (s *s3Backend) saveAAEMarker(marker string) {
+	err := s.bucket.Load().Put(s.Prefix+s3AAEMarkerPath, []byte(marker), "text/plain", s3.BucketOwnerFull)
+	if err != nil {
+		slog.Warn("couldn't save AAE marker", "op", "aae", "err", err)
+	}
 }
 
 func (s *s3Backend) ActiveAntiEntropy(cluster *cluster, site site, interval int) {
-	log.Println("S3 AAE starting")
-	// S3 backend doesn't need verification, just rebalancing
+	l := slog.With("op", "aae")
+	l.Info("S3 AAE starting")
+	marker := s.loadAAEMarker()
+	if marker != "" {
+		l.Info("AAE resuming", "after", marker)
+	}
+	backoff := time.Second
+	visited := 0
 	for {
-		log.Println("AAE starting at the top")
-
-		res, err := s.bucket.List("", "", "", 1000)
+		res, err := s.bucket.Load().List(s.Prefix, "", marker, 1000)
 		if err != nil {
-			log.Fatal(err)
+			l.Warn("AAE couldn't list bucket", "err", err, "retry_in", backoff)
+			time.Sleep(backoff)
+			backoff = min(backoff*2, s3MaxListBackoff)
+			continue
 		}
+		backoff = time.Second
 
-		n := len(res.Contents)
-		idxes := rand.Perm(n)
-		for _, i := range idxes {
-			v := res.Contents[i]
+		for _, v := range res.Contents {
 			jitter := rand.Intn(5)
 			time.Sleep(time.Duration(interval+jitter) * time.Second)
+			marker = v.Key
 
-			key, err := keyFromString(v.Key)
+			key, err := keyFromString(strings.TrimPrefix(v.Key, s.Prefix))
 			if err != nil {
 				continue
 			}
+			err = site.VerifyKey(*key)
+			if err != nil {
+				l.Warn("couldn't verify", "key", key.String(), "err", err)
+			}
 			err = site.Rebalance(*key)
 			if err != nil {
-				log.Println(err)
+				l.Warn("couldn't rebalance", "key", key.String(), "err", err)
 			}
+			visited++
+			if visited%s3AAEMarkerEvery == 0 {
+				s.saveAAEMarker(marker)
+			}
+		}
+		if !res.IsTruncated || len(res.Contents) == 0 {
+			l.Info("AAE starting at the top")
+			marker = ""
+			s.saveAAEMarker(marker)
+			// an empty bucket would have us listing it as fast as S3
+			// answers, so wait before the next pass
+			jitter := rand.Intn(5)
+			time.Sleep(time.Duration(interval+jitter) * time.Second)
 		}
 	}
+}
+
+// what fraction of checks download the whole file and rehash
+// it, rather than trusting the checksums S3 has
+const s3RehashChance = 0.01
 
+var (
+	errS3NoChecksums = errors.New("no checksums stored")
+	errS3Corrupt     = errors.New("checksum mismatch")
+)
+
+// checks what S3 knows about the object against the key,
+// without downloading it
+func (s s3Backend) checkMetadata(k key) error {
+	resp, err := s.bucket.Load().Head(s.path(k))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	storedSHA1 := resp.Header.Get("x-amz-meta-sha1")
+	storedMD5 := resp.Header.Get("x-amz-meta-md5")
+	if storedSHA1 == "" || storedMD5 == "" {
+		return errS3NoChecksums
+	}
+	if "sha1:"+storedSHA1 != k.String() {
+		return errS3Corrupt
+	}
+	// multipart uploads get an ETag that isn't the MD5 of the
+	// contents. those have a "-" in them
+	etag := strings.Trim(resp.Header.Get("ETag"), `"`)
+	if !strings.Contains(etag, "-") && etag != storedMD5 {
+		return errS3Corrupt
+	}
+	return nil
 }
 
-type s3Verifier struct{}
+type s3Verifier struct {
+	b s3Backend
+	c *cluster
+}
 
 func (v *s3Verifier) Verify(path string, key key, h string) error {
-	// S3 doesn't need verification
-	return nil
+	if key.String() == "sha1:"+h {
+		verifications.WithLabelValues("ok").Inc()
+		return nil
+	}
+	return v.repair(key)
 }
 
 func (v *s3Verifier) VerifyKey(key key) error {
-	// S3 doesn't need verification
+	err := v.b.checkMetadata(key)
+	noChecksums := err == errS3NoChecksums
+	switch err {
+	case nil:
+		if rand.Float64() >= s3RehashChance {
+			verifications.WithLabelValues("ok").Inc()
+			return nil
+		}
+	case errS3NoChecksums:
+		// written before we started storing them
+	case errS3Corrupt:
+		slog.Warn("checksums don't match", "key", key.String(), "op", "verify")
+		return v.repair(key)
+	default:
+		// couldn't get to S3. that's not the file's fault
+		return err
+	}
+
+	data, err := v.b.Read(key)
+	if err != nil {
+		return err
+	}
+	if !doublecheckReplica(data, key) {
+		slog.Warn("corrupted file", "key", key.String(), "op", "verify")
+		return v.repair(key)
+	}
+	verifications.WithLabelValues("ok").Inc()
+	if noChecksums {
+		// it's good, so store it again with checksums
+		return v.b.put(key, data)
+	}
 	return nil
 }
 
+// replace our copy with a good one from another node
+func (v *s3Verifier) repair(key key) error {
+	verifications.WithLabelValues("corrupt").Inc()
+	recordEvent(eventCorrupt, key, "", "in S3")
+	if v.c == nil {
+		verifications.WithLabelValues("unrepairable").Inc()
+		recordEvent(eventRepairFailed, key, "", "nil cluster")
+		return errors.New("nil cluster")
+	}
+	for _, n := range v.c.ReadOrder(key.String()) {
+		if n.UUID == v.c.Myself.UUID {
+			continue
+		}
+		found, data, err := n.CheckFile(key, v.c.secret)
+		if found && err == nil {
+			if err := v.b.put(key, data); err != nil {
+				slog.Error("error replacing the file", "key", key.String(), "peer", n.UUID, "op", "repair", "err", err)
+				continue
+			}
+			slog.Info("successfully repaired", "key", key.String(), "peer", n.UUID, "op", "repair")
+			verifications.WithLabelValues("repaired").Inc()
+			recordEvent(eventRepaired, key, n.UUID, "")
+			return nil
+		}
+	}
+	verifications.WithLabelValues("unrepairable").Inc()
+	recordEvent(eventRepairFailed, key, "", "no good copies found")
+	return errors.New("no good copies found")
+}
+
 func (s s3Backend) NewVerifier(c *cluster) verifier {
-	return &s3Verifier{}
+	return &s3Verifier{b: s, c: c}
 }
 
+// what FreeSpace reports when there's no quota. big, but not
+// so big that adding a few of them up overflows
+const s3Unlimited = 1 << 50
+
+// quota minus usage. with an object quota, the objects left are
+// turned into bytes using the average object size so far
 func (s s3Backend) FreeSpace() uint64 {
-	// TODO: this is just dummied out for now
-	return 1000000000
+	s.usage.once.Do(s.refreshUsage)
+	bytes, objects := s.usage.get()
+	free := uint64(s3Unlimited)
+	if s.QuotaBytes > 0 {
+		free = 0
+		if uint64(bytes) < s.QuotaBytes {
+			free = s.QuotaBytes - uint64(bytes)
+		}
+	}
+	if s.QuotaObjects > 0 {
+		left := max(s.QuotaObjects-objects, 0)
+		avg := int64(1)
+		if objects > 0 {
+			avg = max(bytes/objects, 1)
+		}
+		free = min(free, uint64(left*avg))
+	}
+	return free
+}
+
+func (s s3Backend) Capacity() uint64 {
+	return s.QuotaBytes
+}
+
+func (s s3Backend) BlobCount() int64 {
+	s.usage.once.Do(s.refreshUsage)
+	_, objects := s.usage.get()
+	return objects
+}
+
+// count up everything in the bucket
+func (s s3Backend) refreshUsage() {
+	var bytes, objects int64
+	err := forEachKey(&s, func(k keyInfo) error {
+		bytes += k.Size
+		objects++
+		return nil
+	})
+	if err != nil {
+		slog.Error("couldn't work out S3 usage", "op", "usage", "err", err)
+		return
+	}
+	s.usage.mu.Lock()
+	s.usage.bytes = bytes
+	s.usage.objects = objects
+	s.usage.mu.Unlock()
+	slog.Info("S3 usage", "op", "usage", "objects", objects, "bytes", bytes)
+}
+
+// keep the usage from drifting too far from what's really there
+func (s s3Backend) WatchUsage(interval time.Duration) {
+	for {
+		s.usage.once.Do(s.refreshUsage)
+		time.Sleep(interval)
+		s.refreshUsage()
+	}
+}
+
+func (u *s3Usage) add(bytes, objects int64) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.bytes += bytes
+	u.objects += objects
+}
+
+func (u *s3Usage) get() (int64, int64) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.bytes, u.objects
+}
+
+func (s s3Backend) List(after string, limit int) ([]keyInfo, error) {
+	var results []keyInfo
+	marker := ""
+	if after != "" {
+		marker = s.Prefix + after
+	}
+	for {
+		max := 1000
+		if limit > 0 && limit-len(results) < max {
+			max = limit - len(results)
+		}
+		res, err := s.bucket.Load().List(s.Prefix, "", marker, max)
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range res.Contents {
+			marker = v.Key
+			k, err := keyFromString(strings.TrimPrefix(v.Key, s.Prefix))
+			if err != nil {
+				continue
+			}
+			results = append(results, keyInfo{Key: *k, Size: v.Size})
+		}
+		if !res.IsTruncated || len(res.Contents) == 0 || (limit > 0 && len(results) >= limit) {
+			return results, nil
+		}
+	}
 }
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// just enough of S3 to test against. path style addressing only
+type fakeS3 struct {
+	bucket string
+
+	mu      sync.Mutex
+	objects map[string]fakeS3Object
+}
+
+type fakeS3Object struct {
+	data []byte
+	meta http.Header
+}
+
+type fakeS3Contents struct {
+	Key  string
+	Size int64
+	ETag string
+}
+
+type fakeS3List struct {
+	XMLName     xml.Name `xml:"ListBucketResult"`
+	Name        string
+	Prefix      string
+	Marker      string
+	MaxKeys     int
+	IsTruncated bool
+	Contents    []fakeS3Contents
+}
+
+func newFakeS3(bucket string) *fakeS3 {
+	return &fakeS3{bucket: bucket, objects: make(map[string]fakeS3Object)}
+}
+
+func etag(data []byte) string {
+	return fmt.Sprintf("\"%x\"", md5.Sum(data))
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	path := strings.TrimPrefix(r.URL.Path, "/"+f.bucket)
+	path = strings.TrimPrefix(path, "/")
+	if path == "" && r.Method == "GET" {
+		f.list(w, r)
+		return
+	}
+	switch r.Method {
+	case "PUT":
+		data, _ := io.ReadAll(r.Body)
+		if m := r.Header.Get("Content-MD5"); m != "" {
+			sum := md5.Sum(data)
+			if m != base64.StdEncoding.EncodeToString(sum[:]) {
+				http.Error(w, "<Error><Code>BadDigest</Code></Error>", http.StatusBadRequest)
+				return
+			}
+		}
+		meta := make(http.Header)
+		for k, v := range r.Header {
+			if strings.HasPrefix(strings.ToLower(k), "x-amz-meta-") {
+				meta[k] = v
+			}
+		}
+		f.objects[path] = fakeS3Object{data: data, meta: meta}
+	case "GET", "HEAD":
+		o, ok := f.objects[path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte("<Error><Code>NoSuchKey</Code></Error>"))
+			return
+		}
+		for k, v := range o.meta {
+			w.Header()[k] = v
+		}
+		w.Header().Set("ETag", etag(o.data))
+		if r.Method == "GET" {
+			_, _ = w.Write(o.data)
+		}
+	case "DELETE":
+		delete(f.objects, path)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, r *http.Request) {
+	prefix := r.FormValue("prefix")
+	marker := r.FormValue("marker")
+	max := 1000
+	if m, err := strconv.Atoi(r.FormValue("max-keys")); err == nil && m > 0 && m < max {
+		max = m
+	}
+	var keys []string
+	for k := range f.objects {
+		if strings.HasPrefix(k, prefix) && k > marker {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	res := fakeS3List{Name: f.bucket, Prefix: prefix, Marker: marker, MaxKeys: max}
+	if len(keys) > max {
+		keys = keys[:max]
+		res.IsTruncated = true
+	}
+	for _, k := range keys {
+		o := f.objects[k]
+		res.Contents = append(res.Contents, fakeS3Contents{Key: k, Size: int64(len(o.data)), ETag: etag(o.data)})
+	}
+	b, _ := xml.Marshal(res)
+	_, _ = w.Write(b)
+}
+
+// put an object in directly, bypassing the backend
+func (f *fakeS3) set(path string, data []byte, meta http.Header) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.objects[path] = fakeS3Object{data: data, meta: meta}
+}
+
+func testS3Backend(t *testing.T) (*s3Backend, *fakeS3) {
+	return testS3BackendWithPrefix(t, "")
+}
+
+func testS3BackendWithPrefix(t *testing.T, prefix string) (*s3Backend, *fakeS3) {
+	f := newFakeS3("test")
+	ts := httptest.NewServer(f)
+	t.Cleanup(ts.Close)
+	b, err := newS3Backend(s3Config{
+		AccessKey: "access",
+		SecretKey: "secret",
+		Bucket:    "test",
+		Endpoint:  ts.URL,
+		Prefix:    prefix,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b, f
+}
+
+func TestS3BackendWriteStoresChecksums(t *testing.T) {
+	b, _ := testS3Backend(t)
+	content := []byte("test data")
+	k, _ := keyFromString(contentKey("test data"))
+	if err := b.Write(*k, io.NopCloser(bytes.NewReader(content))); err != nil {
+		t.Fatal(err)
+	}
+	data, err := b.Read(*k)
+	if err != nil || !bytes.Equal(data, content) {
+		t.Fatalf("read back %q, %v", data, err)
+	}
+	if err := b.checkMetadata(*k); err != nil {
+		t.Errorf("checksums should match: %v", err)
+	}
+	if !b.Exists(*k) {
+		t.Error("key should exist")
+	}
+}
+
+func TestS3BackendListPages(t *testing.T) {
+	b, f := testS3Backend(t)
+	for i := 0; i < 2500; i++ {
+		f.set(contentKey(fmt.Sprint(i)), []byte(fmt.Sprint(i)), nil)
+	}
+	// not a key, so it shouldn't be listed
+	f.set(s3AAEMarkerPath, []byte("x"), nil)
+
+	keys, err := b.List("", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2500 {
+		t.Errorf("expected all 2500 keys, got %d", len(keys))
+	}
+	keys, _ = b.List("", 1500)
+	if len(keys) != 1500 {
+		t.Errorf("expected 1500 keys, got %d", len(keys))
+	}
+}
+
+func TestS3AAEMarker(t *testing.T) {
+	b, _ := testS3Backend(t)
+	if m := b.loadAAEMarker(); m != "" {
+		t.Errorf("expected no marker to start with, got %q", m)
+	}
+	b.saveAAEMarker("sha1:a94a8fe5ccb19ba61c4c0873d391e987982fbbd3")
+	if m := b.loadAAEMarker(); m != "sha1:a94a8fe5ccb19ba61c4c0873d391e987982fbbd3" {
+		t.Errorf("marker didn't survive: %q", m)
+	}
+}
+
+func TestS3VerifierRepairs(t *testing.T) {
+	b, f := testS3Backend(t)
+	content := []byte("test data")
+	k, _ := keyFromString(contentKey("test data"))
+
+	// a peer with a good copy
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(content)
+	}))
+	defer ts.Close()
+	n := newNode("local", "http://localhost:1000", true)
+	c := newCluster(n, "secret", 60)
+	c.AddNeighbor(*newNode("peer", ts.URL, true))
+	v := b.NewVerifier(c)
+
+	// stored checksums that don't match the key
+	f.set(k.String(), []byte("something else"), http.Header{
+		"X-Amz-Meta-Sha1": {"0000000000000000000000000000000000000000"},
+		"X-Amz-Meta-Md5":  {fmt.Sprintf("%x", md5.Sum([]byte("something else")))},
+	})
+	if err := v.VerifyKey(*k); err != nil {
+		t.Fatalf("should have been repaired: %v", err)
+	}
+	if data, _ := b.Read(*k); !bytes.Equal(data, content) {
+		t.Errorf("expected the good copy, got %q", data)
+	}
+	if err := b.checkMetadata(*k); err != nil {
+		t.Errorf("repaired copy should have good checksums: %v", err)
+	}
+
+	// no checksums, and the content doesn't match either
+	f.set(k.String(), []byte("corrupt"), nil)
+	if err := v.VerifyKey(*k); err != nil {
+		t.Fatalf("should have been repaired: %v", err)
+	}
+	if data, _ := b.Read(*k); !bytes.Equal(data, content) {
+		t.Errorf("expected the good copy, got %q", data)
+	}
+
+	// no checksums, but the content is fine. it gets them added
+	f.set(k.String(), content, nil)
+	if err := v.VerifyKey(*k); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.checkMetadata(*k); err != nil {
+		t.Errorf("checksums should have been added: %v", err)
+	}
+}
+
+func TestS3BackendPrefix(t *testing.T) {
+	b, f := testS3BackendWithPrefix(t, "cask/")
+	f.set("unrelated", []byte("not ours"), nil)
+	k, _ := keyFromString(contentKey("test data"))
+	if err := b.Write(*k, io.NopCloser(bytes.NewReader([]byte("test data")))); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := f.objects["cask/"+k.String()]; !ok {
+		t.Errorf("object should have been stored under the prefix")
+	}
+	if !b.Exists(*k) {
+		t.Error("key should exist")
+	}
+	if err := b.checkMetadata(*k); err != nil {
+		t.Error(err)
+	}
+	keys, err := b.List("", 0)
+	if err != nil || len(keys) != 1 || keys[0].Key.String() != k.String() {
+		t.Errorf("unexpected listing: %v %v", keys, err)
+	}
+	b.saveAAEMarker(k.String())
+	if _, ok := f.objects["cask/"+s3AAEMarkerPath]; !ok {
+		t.Errorf("AAE marker should be under the prefix too")
+	}
+	if err := b.Delete(*k); err != nil || b.Exists(*k) {
+		t.Errorf("delete didn't work: %v", err)
+	}
+}
+
+func Test_s3Region(t *testing.T) {
+	r, err := s3Region(s3Config{})
+	if err != nil || r.Name != "us-east-1" || r.S3BucketEndpoint != "" {
+		t.Errorf("path style should be the default: %+v %v", r, err)
+	}
+	r, _ = s3Region(s3Config{Region: "eu-west-1"})
+	if r.S3Endpoint != "https://s3-eu-west-1.amazonaws.com" || r.S3BucketEndpoint != "" {
+		t.Errorf("unexpected eu-west-1 region: %+v", r)
+	}
+	if _, err := s3Region(s3Config{Region: "eu-south-2"}); err == nil {
+		t.Error("expected a region goamz doesn't know to be rejected")
+	}
+	r, _ = s3Region(s3Config{VirtualHosted: true})
+	if r.S3BucketEndpoint != "https://${bucket}.s3.amazonaws.com" {
+		t.Errorf("unexpected virtual hosted region: %+v", r)
+	}
+	r, _ = s3Region(s3Config{Endpoint: "http://minio.local:9000/", VirtualHosted: true})
+	if r.S3Endpoint != "http://minio.local:9000" || r.S3BucketEndpoint != "http://${bucket}.minio.local:9000" {
+		t.Errorf("unexpected custom endpoint: %+v", r)
+	}
+	if _, err := s3Region(s3Config{Endpoint: "not a url", VirtualHosted: true}); err == nil {
+		t.Error("expected an invalid endpoint to be rejected")
+	}
+}
+
+func TestS3CredentialsFromEnvironment(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("AWS_CREDENTIAL_FILE", "")
+	t.Setenv("AWS_ACCESS_KEY_ID", "fromenv")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secretfromenv")
+	b, err := newS3Backend(s3Config{Bucket: "test", Endpoint: "http://localhost:9000"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.bucket.Load().S3.Auth.AccessKey != "fromenv" {
+		t.Errorf("expected credentials from the environment, got %q", b.bucket.Load().S3.Auth.AccessKey)
+	}
+
+	// as if they'd been rotated
+	t.Setenv("AWS_ACCESS_KEY_ID", "rotated")
+	if err := b.refreshAuth(); err != nil {
+		t.Fatal(err)
+	}
+	if b.bucket.Load().S3.Auth.AccessKey != "rotated" {
+		t.Errorf("expected the new credentials to be picked up, got %q", b.bucket.Load().S3.Auth.AccessKey)
+	}
+	if b.staticAuth {
+		t.Error("credentials from the environment can change")
+	}
+}
+
+func TestS3BackendQuota(t *testing.T) {
+	b, f := testS3Backend(t)
+	if b.FreeSpace() != s3Unlimited {
+		t.Errorf("without a quota, free space should be unlimited")
+	}
+
+	f.set(contentKey("a"), make([]byte, 100), nil)
+	f.set(contentKey("b"), make([]byte, 300), nil)
+	b.QuotaBytes = 1000
+	b.refreshUsage()
+	if free := b.FreeSpace(); free != 600 {
+		t.Errorf("expected 600 bytes free, got %d", free)
+	}
+	if b.BlobCount() != 2 || b.Capacity() != 1000 {
+		t.Errorf("unexpected count/capacity: %d %d", b.BlobCount(), b.Capacity())
+	}
+
+	k, _ := keyFromString(contentKey("test data"))
+	_ = b.Write(*k, io.NopCloser(bytes.NewReader(make([]byte, 200))))
+	if free := b.FreeSpace(); free != 400 {
+		t.Errorf("writes should count against the quota, got %d free", free)
+	}
+	_ = b.Write(*k, io.NopCloser(bytes.NewReader(make([]byte, 200))))
+	if free := b.FreeSpace(); free != 400 || b.BlobCount() != 3 {
+		t.Errorf("writing the same key again shouldn't count twice, got %d free", free)
+	}
+	_ = b.Delete(*k)
+	_ = b.Delete(*k)
+	if free := b.FreeSpace(); free != 600 {
+		t.Errorf("deletes should free up space, got %d free", free)
+	}
+
+	// two objects left at 200 bytes each on average
+	b.QuotaObjects = 4
+	if free := b.FreeSpace(); free != 400 {
+		t.Errorf("expected the object quota to limit it to 400, got %d", free)
+	}
+	b.QuotaObjects = 2
+	if free := b.FreeSpace(); free != 0 {
+		t.Errorf("no objects left, so no space left, got %d", free)
+	}
+}
+
+func TestS3BackendGoesReadOnlyOverQuota(t *testing.T) {
+	b, f := testS3Backend(t)
+	f.set(contentKey("a"), make([]byte, 100), nil)
+	b.QuotaBytes = 150
+	n := newNode("test", "http://localhost:1000", true)
+	n.updateFreeSpaceStatus(100, b)
+	if n.Writeable {
+		t.Error("node should have gone read-only")
+	}
+	if n.Capacity != 150 || n.BlobCount != 1 {
+		t.Errorf("capacity and count should be reported: %d %d", n.Capacity, n.BlobCount)
+	}
+}
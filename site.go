@@ -1,5 +1,7 @@
 package main
 
+import "context"
+
 type site struct {
 	Node           *node
 	Cluster        *cluster
@@ -11,7 +13,10 @@ type site struct {
 	MaxUploadSize  int64
 	verifier       verifier
 	rebalancer     *rebalancer
+	drainer        *drainer
 	LogCache       *LogCache
+	Tiering        *tierPolicy
+	health         *healthCache
 }
 
 func newSite(n *node, c *cluster, b backend, replication, maxReplication int, clusterSecret string, aaeInterval int, maxUploadSize int64, logCache *LogCache) *site {
@@ -36,12 +41,25 @@ func newSite(n *node, c *cluster, b backend, replication, maxReplication int, cl
 		AAEInterval:    aaeInterval,
 		MaxUploadSize:  maxUploadSize,
 		LogCache:       logCache,
+		// off until it's configured
+		Tiering: newTierPolicy(0, false, ""),
+		health:  &healthCache{},
 	}
 	s.verifier = b.NewVerifier(c)
 	s.rebalancer = newRebalancer(c, *s)
+	s.drainer = newDrainer(s)
 	return s
 }
 
+// a copy of our node that's safe to read while the cluster
+// might be changing it
+func (s site) self() node {
+	if s.Cluster == nil {
+		return *s.Node
+	}
+	return s.Cluster.Self()
+}
+
 func (s site) ActiveAntiEntropy() {
 	// it's the backend's responsibility
 	s.Backend.ActiveAntiEntropy(s.Cluster, s, s.AAEInterval)
@@ -51,10 +69,26 @@ func (s site) Rebalance(key key) error {
 	return s.rebalancer.Rebalance(key)
 }
 
+func (s site) RebalanceContext(ctx context.Context, key key) error {
+	return s.rebalancer.RebalanceContext(ctx, key)
+}
+
 func (s site) Verify(path string, key key, h string) error {
-	return s.verifier.Verify(path, key, h)
+	_, sp := startSpan(context.Background(), "verify")
+	sp.SetAttr("cask.key", key.String())
+	err := s.verifier.Verify(path, key, h)
+	sp.Finish(err)
+	return err
 }
 
 func (s site) VerifyKey(key key) error {
-	return s.verifier.VerifyKey(key)
+	return s.VerifyKeyContext(context.Background(), key)
+}
+
+func (s site) VerifyKeyContext(ctx context.Context, key key) error {
+	_, sp := startSpan(ctx, "verify")
+	sp.SetAttr("cask.key", key.String())
+	err := s.verifier.VerifyKey(key)
+	sp.Finish(err)
+	return err
 }
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// what GET /status/ returns. the same things the cluster info
+// page shows, for scripts to use
+type nodeStatus struct {
+	Node           node             `json:"node"`
+	Backend        string           `json:"backend"`
+	FreeSpace      uint64           `json:"free_space"`
+	Capacity       uint64           `json:"capacity,omitempty"`
+	BlobCount      int64            `json:"blob_count,omitempty"`
+	Replication    int              `json:"replication"`
+	MaxReplication int              `json:"max_replication"`
+	AAEInterval    int              `json:"aae_interval"`
+	AAE            *indexStats      `json:"aae,omitempty"`
+	Rebalance      rebalanceCounts  `json:"rebalance"`
+	RingVersion    uint64           `json:"ring_version"`
+	Neighbors      []neighborStatus `json:"neighbors"`
+}
+
+type rebalanceCounts struct {
+	Attempts float64 `json:"attempts"`
+	Failures float64 `json:"failures"`
+	Noops    float64 `json:"noops"`
+	Deletes  float64 `json:"deletes"`
+}
+
+type neighborStatus struct {
+	UUID         string    `json:"uuid"`
+	BaseURL      string    `json:"base_url"`
+	Writeable    bool      `json:"writeable"`
+	Healthy      bool      `json:"healthy"`
+	Draining     bool      `json:"draining"`
+	StorageClass string    `json:"storage_class"`
+	LastSeen     time.Time `json:"last_seen"`
+	LastFailed   time.Time `json:"last_failed"`
+	FreeSpace    uint64    `json:"free_space"`
+	Zone         string    `json:"zone"`
+}
+
+func counterValue(c prometheus.Counter) float64 {
+	var m dto.Metric
+	if err := c.Write(&m); err != nil {
+		return 0
+	}
+	return m.GetCounter().GetValue()
+}
+
+func (s *site) Status() nodeStatus {
+	st := nodeStatus{
+		Node:           s.self(),
+		Backend:        s.Backend.String(),
+		FreeSpace:      s.Backend.FreeSpace(),
+		Replication:    s.Replication,
+		MaxReplication: s.MaxReplication,
+		AAEInterval:    s.AAEInterval,
+		Rebalance: rebalanceCounts{
+			Attempts: counterValue(rebalances),
+			Failures: counterValue(rebalanceFailures),
+			Noops:    counterValue(rebalanceNoops),
+			Deletes:  counterValue(rebalanceDeletes),
+		},
+		Neighbors: []neighborStatus{},
+	}
+	st.Node.StorageClass = st.Node.class()
+	if cr, ok := s.Backend.(capacityReporter); ok {
+		st.Capacity = cr.Capacity()
+		st.BlobCount = cr.BlobCount()
+	}
+	if x, ok := s.Backend.(indexer); ok {
+		is := x.IndexStats()
+		st.AAE = &is
+	}
+	_, st.RingVersion = s.Cluster.currentRing()
+	for _, n := range s.Cluster.GetNeighbors() {
+		st.Neighbors = append(st.Neighbors, neighborStatus{
+			UUID:         n.UUID,
+			BaseURL:      n.BaseURL,
+			Writeable:    n.Writeable,
+			Healthy:      !n.Unhealthy(),
+			Draining:     n.Draining,
+			StorageClass: n.class(),
+			LastSeen:     n.LastSeen,
+			LastFailed:   n.LastFailed,
+			FreeSpace:    n.FreeSpace,
+			Zone:         n.Zone,
+		})
+	}
+	sort.Slice(st.Neighbors, func(i, j int) bool {
+		return st.Neighbors[i].UUID < st.Neighbors[j].UUID
+	})
+	return st
+}
+
+func statusHandler(w http.ResponseWriter, r *http.Request, s *site) {
+	b, err := json.Marshal(s.Status())
+	if err != nil {
+		http.Error(w, "json error", 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(b)
+}
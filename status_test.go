@@ -0,0 +1,45 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func Test_statusHandler(t *testing.T) {
+	n := newNode("local", "http://localhost:1000", true)
+	c := newCluster(n, "secret", 60)
+	up := newNode("up", "http://localhost:1001", true)
+	up.LastSeen = time.Now()
+	down := newNode("down", "http://localhost:1002", false)
+	down.LastFailed = time.Now()
+	c.AddNeighbor(*up)
+	c.AddNeighbor(*down)
+	d := newDiskBackend(t.TempDir() + "/")
+	s := newSite(n, c, d, 2, 3, "secret", 5, 1000, nil)
+
+	req := httptest.NewRequest("GET", "/status/", nil)
+	rr := httptest.NewRecorder()
+	statusHandler(rr, req, s)
+	if rr.Code != http.StatusOK || rr.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("unexpected response: %d %q", rr.Code, rr.Header().Get("Content-Type"))
+	}
+	var st nodeStatus
+	if err := json.Unmarshal(rr.Body.Bytes(), &st); err != nil {
+		t.Fatal(err)
+	}
+	if st.Node.UUID != "local" || st.Backend != "Disk" || st.Replication != 2 || st.MaxReplication != 3 {
+		t.Errorf("unexpected node status: %+v", st)
+	}
+	if st.AAE == nil || st.FreeSpace == 0 {
+		t.Errorf("disk backend should report free space and AAE progress: %+v", st)
+	}
+	if len(st.Neighbors) != 2 || st.Neighbors[0].UUID != "down" || st.Neighbors[1].UUID != "up" {
+		t.Fatalf("unexpected neighbors: %+v", st.Neighbors)
+	}
+	if st.Neighbors[0].Healthy || st.Neighbors[0].Writeable || !st.Neighbors[1].Healthy {
+		t.Errorf("wrong neighbor health: %+v", st.Neighbors)
+	}
+}
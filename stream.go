@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// a live feed of log records and cluster events, streamed out of
+// /log/stream/ as Server-Sent Events. every subscriber gets its own
+// buffered channel. publishing never waits on a subscriber, so if
+// one falls behind it misses messages (and is told how many)
+// instead of holding up the logger.
+type clusterEvent struct {
+	Time   time.Time `json:"time"`
+	Type   string    `json:"type"`
+	Node   string    `json:"node"`
+	Detail string    `json:"detail,omitempty"`
+}
+
+const (
+	clusterJoin      = "join"
+	clusterLeave     = "leave"
+	clusterFailed    = "failed"
+	clusterWriteable = "writeable"
+	clusterReadOnly  = "read_only"
+)
+
+// one of these is set
+type feedMessage struct {
+	Log     *logRecord
+	Cluster *clusterEvent
+}
+
+type feedSubscriber struct {
+	ch chan feedMessage
+
+	mu      sync.Mutex
+	dropped int
+}
+
+// how many messages can pile up for a subscriber before they're
+// dropped
+const feedBuffer = 256
+
+type feed struct {
+	mu   sync.Mutex
+	subs map[*feedSubscriber]bool
+}
+
+var liveFeed = newFeed()
+
+func newFeed() *feed {
+	return &feed{subs: make(map[*feedSubscriber]bool)}
+}
+
+func (f *feed) Subscribe() *feedSubscriber {
+	s := &feedSubscriber{ch: make(chan feedMessage, feedBuffer)}
+	f.mu.Lock()
+	f.subs[s] = true
+	f.mu.Unlock()
+	return s
+}
+
+func (f *feed) Unsubscribe(s *feedSubscriber) {
+	f.mu.Lock()
+	delete(f.subs, s)
+	f.mu.Unlock()
+}
+
+func (f *feed) Publish(m feedMessage) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for s := range f.subs {
+		select {
+		case s.ch <- m:
+		default:
+			s.mu.Lock()
+			s.dropped++
+			s.mu.Unlock()
+		}
+	}
+}
+
+// how many messages were dropped since the last time it was asked
+func (s *feedSubscriber) Dropped() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := s.dropped
+	s.dropped = 0
+	return n
+}
+
+// something happened to a node. it gets logged too
+func publishClusterEvent(typ string, n node, detail string) {
+	e := clusterEvent{Time: time.Now(), Type: typ, Node: n.UUID, Detail: detail}
+	liveFeed.Publish(feedMessage{Cluster: &e})
+	slog.Info("cluster "+typ, "peer", n.UUID, "op", "cluster", "detail", detail)
+}
+
+func writeability(writeable bool) string {
+	if writeable {
+		return clusterWriteable
+	}
+	return clusterReadOnly
+}
+
+func writeSSE(w http.ResponseWriter, event string, v any) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, b)
+	return err
+}
+
+// how often to send a comment so proxies don't close an idle stream
+const streamKeepAlive = 15 * time.Second
+
+// /log/stream/?level=<level>&key=<Key>&request_id=<id>
+// the filters work like /log/ and only apply to log records.
+// cluster events are always sent
+func logStreamHandler(w http.ResponseWriter, r *http.Request, s *site) {
+	f, err := parseLogFilter(r)
+	if err != nil {
+		http.Error(w, "bad level", http.StatusBadRequest)
+		return
+	}
+	rc := http.NewResponseController(w)
+	// the server's write timeout would cut the stream off
+	_ = rc.SetWriteDeadline(time.Time{})
+
+	sub := liveFeed.Subscribe()
+	defer liveFeed.Unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	_, _ = fmt.Fprint(w, ": connected\n\n")
+	_ = rc.Flush()
+
+	ticker := time.NewTicker(streamKeepAlive)
+	defer ticker.Stop()
+	for {
+		var err error
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+			_, err = fmt.Fprint(w, ": keepalive\n\n")
+		case m := <-sub.ch:
+			if n := sub.Dropped(); n > 0 {
+				err = writeSSE(w, "dropped", n)
+			}
+			if err == nil && m.Log != nil && f.matches(*m.Log) {
+				err = writeSSE(w, "log", m.Log)
+			}
+			if err == nil && m.Cluster != nil {
+				err = writeSSE(w, "cluster", m.Cluster)
+			}
+		}
+		if err != nil {
+			return
+		}
+		_ = rc.Flush()
+	}
+}
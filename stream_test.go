@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bufio"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFeedDoesntBlock(t *testing.T) {
+	f := newFeed()
+	slow := f.Subscribe()
+	defer f.Unsubscribe(slow)
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < feedBuffer+10; i++ {
+			f.Publish(feedMessage{Log: &logRecord{Msg: "hi"}})
+		}
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("publishing blocked on a slow subscriber")
+	}
+	if n := slow.Dropped(); n != 10 {
+		t.Errorf("expected 10 dropped, got %d", n)
+	}
+	if n := slow.Dropped(); n != 0 {
+		t.Errorf("dropped count should reset, got %d", n)
+	}
+	f.Unsubscribe(slow)
+	f.Publish(feedMessage{Log: &logRecord{Msg: "nobody listening"}})
+}
+
+// reads SSE events off the stream until it sees one of the kind
+// wanted, returning its data
+func nextEvent(t *testing.T, sc *bufio.Scanner, kind string) string {
+	t.Helper()
+	event := ""
+	for sc.Scan() {
+		line := sc.Text()
+		if e, ok := strings.CutPrefix(line, "event: "); ok {
+			event = e
+		}
+		if d, ok := strings.CutPrefix(line, "data: "); ok && event == kind {
+			return d
+		}
+	}
+	t.Fatalf("stream ended before a %s event", kind)
+	return ""
+}
+
+func TestLogStream(t *testing.T) {
+	lc := newLogCache(10)
+	l := slog.New(lc.Handler(slog.LevelDebug))
+	s := listingSite("streamer")
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /log/stream/", makeHandler(logStreamHandler, s))
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/log/stream/?level=warn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Errorf("wrong content type %q", resp.Header.Get("Content-Type"))
+	}
+	sc := bufio.NewScanner(resp.Body)
+	if !sc.Scan() || sc.Text() != ": connected" {
+		t.Fatalf("didn't connect: %q", sc.Text())
+	}
+
+	l.Info("too quiet to stream")
+	l.Warn("streamed", "key", "sha1:abc")
+	if d := nextEvent(t, sc, "log"); !strings.Contains(d, `"msg":"streamed"`) || !strings.Contains(d, `"level":"WARN"`) {
+		t.Errorf("unexpected log event: %s", d)
+	}
+
+	s.Cluster.AddNeighbor(*newNode("newcomer", "http://example.com", true))
+	if d := nextEvent(t, sc, "cluster"); !strings.Contains(d, `"type":"join"`) || !strings.Contains(d, `"node":"newcomer"`) {
+		t.Errorf("unexpected cluster event: %s", d)
+	}
+	s.Cluster.FailedNeighbor(*newNode("newcomer", "", true))
+	if d := nextEvent(t, sc, "cluster"); !strings.Contains(d, `"type":"failed"`) {
+		t.Errorf("unexpected cluster event: %s", d)
+	}
+}
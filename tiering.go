@@ -0,0 +1,437 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// storage classes. nodes are hot unless they say otherwise. new
+// uploads only go to hot nodes, and files that haven't been read
+// for a while get moved from them to the cold ones. each class
+// replicates and rebalances amongst itself.
+//
+// read-through caches are in a class of their own. they only hold
+// copies of what the rest of the cluster has, so they're left off
+// the ring: nothing is placed on them, they aren't counted as
+// replicas, and they don't take part in merkle sync.
+const (
+	hotClass   = "hot"
+	coldClass  = "cold"
+	cacheClass = "cache"
+)
+
+// when each key on this node was last read. keys it doesn't know
+// about count as read the first time the tiering loop comes across
+// them, so nothing goes cold just because we haven't been keeping
+// track for long. like the hints, it's saved as an append-only log
+// that gets compacted once it's mostly stale. only what changed
+// since the last save gets written.
+type accessTracker struct {
+	file *mirroredFile
+
+	mu    sync.Mutex
+	last  map[string]time.Time
+	dirty map[string]bool
+	lines int
+}
+
+type accessEntry struct {
+	Key       string    `json:"key"`
+	Read      time.Time `json:"read"`
+	Forgotten bool      `json:"forgotten,omitempty"`
+}
+
+// with more than one path, a copy is kept at each of them
+func newAccessTracker(paths ...string) *accessTracker {
+	a := &accessTracker{
+		file:  newMirroredFile(paths...),
+		last:  make(map[string]time.Time),
+		dirty: make(map[string]bool),
+	}
+	if !a.file.enabled() {
+		return a
+	}
+	if err := a.readLog(); err != nil && !os.IsNotExist(err) {
+		slog.Error("couldn't read access times", "op", "tiering", "err", err)
+	}
+	// start the log off with just what's live
+	if err := a.compact(); err != nil {
+		slog.Error("couldn't save access times", "op", "tiering", "err", err)
+	}
+	return a
+}
+
+func (a *accessTracker) readLog() error {
+	data, err := a.file.Read()
+	if err != nil {
+		return err
+	}
+	// they used to be saved as one JSON object
+	var saved map[string]time.Time
+	if json.Unmarshal(data, &saved) == nil {
+		for k, t := range saved {
+			a.last[k] = t
+		}
+		return nil
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		var e accessEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			// a torn write at the end from a crash
+			continue
+		}
+		if e.Forgotten {
+			delete(a.last, e.Key)
+		} else {
+			a.last[e.Key] = e.Read
+		}
+	}
+	return scanner.Err()
+}
+
+func (a *accessTracker) Record(k key) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.last[k.String()] = time.Now()
+	a.dirty[k.String()] = true
+}
+
+// false if we don't know
+func (a *accessTracker) LastAccess(k key) (time.Time, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	t, ok := a.last[k.String()]
+	return t, ok
+}
+
+func (a *accessTracker) Forget(k key) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.last, k.String())
+	a.dirty[k.String()] = true
+}
+
+// only the tiering loop saves, so the file isn't touched by
+// anything else once we're up and running
+func (a *accessTracker) Save() error {
+	if !a.file.enabled() {
+		return nil
+	}
+	a.mu.Lock()
+	if a.lines+len(a.dirty) > 2*len(a.last)+1000 {
+		defer a.mu.Unlock()
+		return a.compact()
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for k := range a.dirty {
+		t, ok := a.last[k]
+		if err := enc.Encode(accessEntry{Key: k, Read: t, Forgotten: !ok}); err != nil {
+			a.mu.Unlock()
+			return err
+		}
+	}
+	written := len(a.dirty)
+	a.dirty = make(map[string]bool)
+	a.lines += written
+	a.mu.Unlock()
+	if written == 0 {
+		return nil
+	}
+	return a.file.Append(buf.Bytes())
+}
+
+// write out just what's live and switch to that. must hold the
+// lock, or be the only one with the tracker
+func (a *accessTracker) compact() error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for k, t := range a.last {
+		if err := enc.Encode(accessEntry{Key: k, Read: t}); err != nil {
+			return err
+		}
+	}
+	if err := a.file.Rewrite(buf.Bytes()); err != nil {
+		return err
+	}
+	a.dirty = make(map[string]bool)
+	a.lines = len(a.last)
+	return nil
+}
+
+type tierPolicy struct {
+	// files that haven't been read for this long go cold. zero
+	// means never
+	ColdAfter time.Duration
+	// copy cold files back to the hot nodes when they're read
+	PromoteOnRead bool
+	access        *accessTracker
+}
+
+func (t *tierPolicy) enabled() bool {
+	return t != nil && (t.ColdAfter > 0 || t.PromoteOnRead)
+}
+
+func newTierPolicy(coldAfter time.Duration, promoteOnRead bool, accessFile string) *tierPolicy {
+	return &tierPolicy{
+		ColdAfter:     coldAfter,
+		PromoteOnRead: promoteOnRead,
+		access:        newAccessTracker(accessFile),
+	}
+}
+
+func (n node) class() string {
+	if n.StorageClass == "" {
+		return hotClass
+	}
+	return n.StorageClass
+}
+
+// just the part of the ring for one storage class
+func classRing(ring ringEntryList, class string) ringEntryList {
+	var results ringEntryList
+	for _, e := range ring {
+		if e.Node.class() == class {
+			results = append(results, e)
+		}
+	}
+	return results
+}
+
+func (s site) recordAccess(k key) {
+	if s.Tiering != nil && s.Tiering.ColdAfter > 0 {
+		s.Tiering.access.Record(k)
+	}
+}
+
+// the cold nodes that should hold the key, in order
+func (s site) coldOwners(k key) []node {
+	var results []node
+	for _, n := range s.Cluster.ClassOrder(k.String(), coldClass) {
+		if n.Writeable && !n.Draining {
+			results = append(results, n)
+		}
+	}
+	return results
+}
+
+// the hot nodes that should hold the key, in order
+func (s site) hotOwners(k key) []node {
+	owners := s.Cluster.ClassOrder(k.String(), hotClass)
+	return owners[:min(s.Replication, len(owners))]
+}
+
+// whether our copy has been read too recently to go cold. if we
+// don't know when it was last read, it has
+func (s site) readRecently(k key) bool {
+	t, ok := s.Tiering.access.LastAccess(k)
+	return !ok || time.Since(t) < s.Tiering.ColdAfter
+}
+
+// whether the key looks like it's been moved to the cold nodes:
+// we've known about it for a while without reading it, and the
+// cold nodes have it. rebalancing and merkle sync don't put hot
+// copies of a key like that back. anything read recently on any
+// hot node is still rebalanced from there, so tiering never leaves
+// a key that's in use with fewer hot copies, and promoted keys get
+// their full set again. the cold nodes only get asked about keys
+// that look stale
+func (s site) migrated(k key) bool {
+	if s.Tiering == nil || s.Tiering.ColdAfter <= 0 || s.self().class() != hotClass {
+		return false
+	}
+	if s.readRecently(k) {
+		return false
+	}
+	owners := s.coldOwners(k)
+	for i, n := range owners {
+		if i >= s.Replication {
+			break
+		}
+		if found, err := n.RetrieveInfo(k, s.ClusterSecret); err == nil && found {
+			return true
+		}
+	}
+	return false
+}
+
+// copy the key to the cold nodes and drop the hot copies. only
+// the first hot owner does this, once none of the hot copies have
+// been read for a while. the others drop theirs when it tells them
+// to, and ours goes last, so if anything goes wrong we still have
+// a copy and try again next time round. returns whether it was
+// moved
+func (s site) migrateIfCold(k key) bool {
+	t, ok := s.Tiering.access.LastAccess(k)
+	if !ok {
+		// start the clock on it
+		s.Tiering.access.Record(k)
+		return false
+	}
+	if time.Since(t) < s.Tiering.ColdAfter {
+		return false
+	}
+	hot := s.hotOwners(k)
+	if len(hot) == 0 || hot[0].UUID != s.Node.UUID {
+		return false
+	}
+	l := slog.With("key", k.String(), "op", "tiering")
+	for _, n := range hot[1:] {
+		found, read, err := n.LastRead(k, s.ClusterSecret)
+		if err != nil {
+			// can't tell whether it's cold there
+			return false
+		}
+		if found && (read.IsZero() || time.Since(read) < s.Tiering.ColdAfter) {
+			return false
+		}
+	}
+	owners := s.coldOwners(k)
+	if len(owners) == 0 {
+		return false
+	}
+	want := min(s.Replication, len(owners))
+	copies := 0
+	var data []byte
+	for _, n := range owners {
+		if copies >= want {
+			break
+		}
+		if found, err := n.RetrieveInfo(k, s.ClusterSecret); err == nil && found {
+			copies++
+			continue
+		}
+		if data == nil {
+			b, err := s.Backend.Read(k)
+			if err != nil {
+				l.Error("couldn't read it to move it", "err", err)
+				return false
+			}
+			data = b
+		}
+		if n.AddFile(k, bytes.NewReader(data), s.ClusterSecret) {
+			recordEvent(eventReplicated, k, n.UUID, "tiering")
+			copies++
+		}
+	}
+	if copies < want {
+		l.Warn("couldn't put enough cold copies", "replicas", copies, "want", want)
+		return false
+	}
+	for _, n := range hot[1:] {
+		if err := n.DropColdCopy(k, s.ClusterSecret); err != nil {
+			l.Warn("peer couldn't drop its hot copy", "peer", n.UUID, "err", err)
+			return false
+		}
+	}
+	if !s.dropColdCopy(k) {
+		return false
+	}
+	l.Info("moved to cold storage")
+	tierMigrations.Inc()
+	return true
+}
+
+var errReadRecently = errors.New("read recently")
+
+// drop our copy of a key that's been moved to the cold nodes
+func (s site) dropColdCopy(k key) bool {
+	if err := s.Backend.Delete(k); err != nil {
+		slog.Error("couldn't drop hot copy", "key", k.String(), "op", "tiering", "err", err)
+		return false
+	}
+	s.Tiering.access.Forget(k)
+	// it's an extra copy now that the cold nodes have it
+	recordEvent(eventDeleted, k, "", "tiering")
+	return true
+}
+
+// DELETE /local/<key>/. the first hot owner telling us the key has
+// gone cold and the cold nodes have it. refused if it's been read
+// here since the owner checked
+func localDropHandler(w http.ResponseWriter, r *http.Request, s *site) {
+	secret := r.Header.Get("X-Cask-Cluster-Secret")
+	if !s.Cluster.CheckSecret(secret) {
+		logger(r.Context()).Warn("unauthorized drop request", "op", "tiering")
+		http.Error(w, "sorry, need the secret knock", http.StatusForbidden)
+		return
+	}
+	k, err := keyFromString(r.PathValue("key"))
+	if err != nil {
+		http.Error(w, "invalid key\n", 400)
+		return
+	}
+	if !s.Backend.Exists(*k) {
+		return
+	}
+	if s.Tiering == nil || s.Tiering.ColdAfter <= 0 || s.readRecently(*k) {
+		http.Error(w, errReadRecently.Error(), http.StatusConflict)
+		return
+	}
+	if !s.dropColdCopy(*k) {
+		http.Error(w, "couldn't drop it", 500)
+	}
+}
+
+// put a cold file back on the hot nodes that should have it
+func (s site) promote(k key, data []byte) {
+	if !doublecheckReplica(data, k) {
+		return
+	}
+	copies := 0
+	for _, n := range s.Cluster.WriteOrder(k.String()) {
+		if copies >= s.Replication {
+			break
+		}
+		if n.UUID == s.Node.UUID {
+			if err := s.Backend.Write(k, io.NopCloser(bytes.NewReader(data))); err != nil {
+				slog.Error("couldn't promote", "key", k.String(), "op", "promote", "err", err)
+				continue
+			}
+			s.recordAccess(k)
+			copies++
+		} else if n.AddFile(k, bytes.NewReader(data), s.ClusterSecret) {
+			copies++
+		}
+	}
+	if copies > 0 {
+		slog.Info("promoted to hot nodes", "key", k.String(), "op", "promote", "replicas", copies)
+		tierPromotions.Inc()
+	}
+}
+
+// goes through everything on a hot node now and then, moving
+// whatever hasn't been read recently to the cold nodes
+func (s site) TierMigration(interval time.Duration) {
+	if !s.Tiering.enabled() || s.Tiering.ColdAfter <= 0 || s.self().class() != hotClass {
+		return
+	}
+	for {
+		time.Sleep(interval)
+		moved := 0
+		err := forEachKey(s.Backend, func(ki keyInfo) error {
+			if s.migrateIfCold(ki.Key) {
+				moved++
+			}
+			return nil
+		})
+		if err != nil {
+			slog.Error("couldn't list keys to move", "op", "tiering", "err", err)
+		}
+		if moved > 0 {
+			slog.Info("moved keys to cold storage", "op", "tiering", "moved", moved)
+		}
+		if err := s.Tiering.access.Save(); err != nil {
+			slog.Error("couldn't save access times", "op", "tiering", "err", err)
+		}
+	}
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_accessTracker(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.json")
+	keys := testKeys(t,
+		"sha1:f48dd853820860816c75d54d0f58d47663456009",
+		"sha1:a94a8fe5ccb19ba61c4c0873d391e987982fbbd3",
+	)
+	a := newAccessTracker(path)
+	a.Record(keys[0])
+	if _, ok := a.LastAccess(keys[1]); ok {
+		t.Errorf("shouldn't know about a key that was never read")
+	}
+	if len(a.last) != 1 {
+		t.Errorf("looking a key up shouldn't start tracking it: %v", a.last)
+	}
+	a.last[keys[0].String()] = time.Now().Add(-48 * time.Hour)
+	if err := a.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	a = newAccessTracker(path)
+	if last, ok := a.LastAccess(keys[0]); !ok || time.Since(last) < 47*time.Hour {
+		t.Errorf("access time wasn't saved: %v", last)
+	}
+	a.Record(keys[1])
+	a.Forget(keys[0])
+	if err := a.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	a = newAccessTracker(path)
+	if _, ok := a.LastAccess(keys[0]); ok {
+		t.Errorf("forgotten key came back")
+	}
+	if _, ok := a.LastAccess(keys[1]); !ok {
+		t.Errorf("appended access time was lost")
+	}
+}
+
+func Test_accessTrackerSavesChanges(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.json")
+	k, _ := keyFromString(contentKey("read me"))
+	a := newAccessTracker(path)
+	for i := 0; i < 100; i++ {
+		a.Record(*k)
+	}
+	if err := a.Save(); err != nil {
+		t.Fatal(err)
+	}
+	before, _ := os.ReadFile(path)
+	// nothing changed, so nothing is written
+	if err := a.Save(); err != nil {
+		t.Fatal(err)
+	}
+	after, _ := os.ReadFile(path)
+	if len(after) != len(before) || bytes.Count(after, []byte("\n")) != 1 {
+		t.Errorf("unexpected access log: %q", after)
+	}
+}
+
+func Test_accessTrackerOldFormat(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.json")
+	k := "sha1:f48dd853820860816c75d54d0f58d47663456009"
+	read := time.Now().Add(-72 * time.Hour).UTC()
+	old, _ := json.Marshal(map[string]time.Time{k: read})
+	if err := os.WriteFile(path, old, 0644); err != nil {
+		t.Fatal(err)
+	}
+	a := newAccessTracker(path)
+	keys := testKeys(t, k)
+	if last, ok := a.LastAccess(keys[0]); !ok || !last.Equal(read) {
+		t.Errorf("old access file wasn't loaded: %v", last)
+	}
+}
+
+func Test_storageClassPlacement(t *testing.T) {
+	n := newNode("hot", "http://localhost:1000", true)
+	c := newCluster(n, "secret", 60)
+	cold := newNode("cold", "http://localhost:1001", true)
+	cold.StorageClass = coldClass
+	c.AddNeighbor(*cold)
+
+	k := "sha1:f48dd853820860816c75d54d0f58d47663456009"
+	if w := nodeUUIDs(c.WriteOrder(k)); len(w) != 1 || w[0] != "hot" {
+		t.Errorf("new files should only go to hot nodes: %v", w)
+	}
+	if r := c.ReadOrder(k); len(r) != 2 {
+		t.Errorf("reads should check every node: %v", nodeUUIDs(r))
+	}
+	if co := c.ClassOrder(k, coldClass); len(co) != 1 || co[0].UUID != "cold" {
+		t.Errorf("unexpected cold nodes: %v", nodeUUIDs(co))
+	}
+
+	cc := newCluster(cold, "secret", 60)
+	var hb heartbeat
+	_ = json.Unmarshal(cc.jsonSerialize(), &hb)
+	if hb.node().StorageClass != coldClass {
+		t.Errorf("storage class didn't make it through the heartbeat")
+	}
+}
+
+// a hot node with a memory backend, and a cold one behind a
+// test server
+func tieredSites(t *testing.T) (*site, *memoryBackend) {
+	coldBackend := newMemoryBackend(1000)
+	ts := memoryPeer(t, coldBackend)
+	n := newNode("hot", "", true)
+	c := newCluster(n, "secret", 60)
+	cold := newNode("cold", ts.URL, true)
+	cold.StorageClass = coldClass
+	c.AddNeighbor(*cold)
+	s := newSite(n, c, newMemoryBackend(1000), 1, 1, "secret", 1, 1000, nil)
+	s.Tiering.ColdAfter = 24 * time.Hour
+	return s, coldBackend
+}
+
+func Test_migrateIfCold(t *testing.T) {
+	s, coldBackend := tieredSites(t)
+	fresh := memoryWrite(t, s.Backend.(*memoryBackend), "fresh")
+	stale := memoryWrite(t, s.Backend.(*memoryBackend), "stale")
+	unknown := memoryWrite(t, s.Backend.(*memoryBackend), "unknown")
+	s.Tiering.access.Record(fresh)
+	s.Tiering.access.last[stale.String()] = time.Now().Add(-48 * time.Hour)
+
+	if s.migrateIfCold(fresh) {
+		t.Errorf("a recently read key shouldn't move")
+	}
+	if s.migrateIfCold(unknown) {
+		t.Errorf("a key we've only just come across shouldn't move")
+	}
+	if _, ok := s.Tiering.access.LastAccess(unknown); !ok {
+		t.Errorf("should have started the clock on a new key")
+	}
+	if s.migrated(stale) {
+		t.Errorf("stale key isn't on the cold node yet")
+	}
+	if !s.migrateIfCold(stale) {
+		t.Fatalf("stale key should have moved")
+	}
+	if s.Backend.Exists(stale) || !coldBackend.Exists(stale) {
+		t.Errorf("stale key should only be on the cold node now")
+	}
+
+	// a hot copy that turns up again with nobody reading it is left
+	// alone by rebalancing
+	memoryWrite(t, s.Backend.(*memoryBackend), "stale")
+	s.Tiering.access.last[stale.String()] = time.Now().Add(-48 * time.Hour)
+	if !s.migrated(stale) {
+		t.Errorf("stale key should count as migrated")
+	}
+	if err := s.Rebalance(stale); err != nil || !s.Backend.Exists(stale) {
+		t.Errorf("rebalance shouldn't touch a migrated key: %v", err)
+	}
+	// but one that's read again is hot
+	s.Tiering.access.Record(stale)
+	if s.migrated(stale) {
+		t.Errorf("a key that's been read shouldn't count as migrated")
+	}
+}
+
+// another hot node, holding the same keys as the tiered site
+func hotPeer(t *testing.T, s *site) *site {
+	peer := listingSite("hot2")
+	peer.Backend = newMemoryBackend(1000)
+	peer.MaxUploadSize = 1000
+	peer.Tiering = newTierPolicy(0, false, "")
+	peer.Tiering.ColdAfter = s.Tiering.ColdAfter
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /local/", makeHandler(handleLocalPost, peer))
+	mux.HandleFunc("GET /local/{key}/", makeHandler(localHandler, peer))
+	mux.HandleFunc("DELETE /local/{key}/", makeHandler(localDropHandler, peer))
+	ts := httptest.NewServer(mux)
+	t.Cleanup(ts.Close)
+	n := newNode("hot2", ts.URL, true)
+	s.Cluster.AddNeighbor(*n)
+	s.Replication = 2
+	return peer
+}
+
+// a key with the given node first amongst the hot owners
+func keyOwnedBy(t *testing.T, s *site, uuid string) string {
+	for i := 0; i < 100; i++ {
+		content := fmt.Sprintf("key %d", i)
+		k, _ := keyFromString(contentKey(content))
+		if s.hotOwners(*k)[0].UUID == uuid {
+			return content
+		}
+	}
+	t.Fatalf("no key belongs to %s", uuid)
+	return ""
+}
+
+func Test_migrateIfColdAcrossReplicas(t *testing.T) {
+	s, coldBackend := tieredSites(t)
+	peer := hotPeer(t, s)
+	stale := time.Now().Add(-48 * time.Hour)
+	write := func(content string) key {
+		k := memoryWrite(t, s.Backend.(*memoryBackend), content)
+		memoryWrite(t, peer.Backend.(*memoryBackend), content)
+		s.Tiering.access.last[k.String()] = stale
+		peer.Tiering.access.last[k.String()] = stale
+		return k
+	}
+
+	theirs := write(keyOwnedBy(t, s, "hot2"))
+	if s.migrateIfCold(theirs) {
+		t.Errorf("only the first hot owner should move a key")
+	}
+
+	ours := write(keyOwnedBy(t, s, "hot"))
+	peer.Tiering.access.Record(ours)
+	if s.migrateIfCold(ours) {
+		t.Errorf("shouldn't move a key that's been read on another replica")
+	}
+	if !s.Backend.Exists(ours) || !peer.Backend.Exists(ours) {
+		t.Errorf("both hot copies should still be there")
+	}
+
+	peer.Tiering.access.last[ours.String()] = stale
+	if !s.migrateIfCold(ours) {
+		t.Fatalf("key that's cold everywhere should have moved")
+	}
+	if s.Backend.Exists(ours) || peer.Backend.Exists(ours) || !coldBackend.Exists(ours) {
+		t.Errorf("key should only be on the cold node now")
+	}
+}
+
+func Test_localDropHandler(t *testing.T) {
+	s, _ := tieredSites(t)
+	k := memoryWrite(t, s.Backend.(*memoryBackend), "drop me")
+	drop := func() int {
+		req := httptest.NewRequest("DELETE", "/local/"+k.String()+"/", nil)
+		req.SetPathValue("key", k.String())
+		req.Header.Set("X-Cask-Cluster-Secret", "secret")
+		rr := httptest.NewRecorder()
+		localDropHandler(rr, req, s)
+		return rr.Code
+	}
+	s.Tiering.access.Record(k)
+	if code := drop(); code != http.StatusConflict || !s.Backend.Exists(k) {
+		t.Errorf("recently read key shouldn't be dropped: %d", code)
+	}
+	s.Tiering.access.last[k.String()] = time.Now().Add(-48 * time.Hour)
+	if code := drop(); code != http.StatusOK || s.Backend.Exists(k) {
+		t.Errorf("cold key should have been dropped: %d", code)
+	}
+}
+
+func Test_promoteOnRead(t *testing.T) {
+	s, coldBackend := tieredSites(t)
+	s.Tiering.PromoteOnRead = true
+	k := memoryWrite(t, coldBackend, "warm me up")
+
+	req := httptest.NewRequest("GET", "/file/"+k.String()+"/", nil)
+	req.SetPathValue("key", k.String())
+	rr := httptest.NewRecorder()
+	fileHandler(rr, req, s)
+	if rr.Code != http.StatusOK || rr.Body.String() != "warm me up" {
+		t.Fatalf("unexpected response: %d %q", rr.Code, rr.Body.String())
+	}
+	for i := 0; i < 100 && !s.Backend.Exists(k); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !s.Backend.Exists(k) {
+		t.Fatalf("key should have been promoted to the hot node")
+	}
+	if last, ok := s.Tiering.access.LastAccess(k); !ok || time.Since(last) > time.Minute {
+		t.Errorf("promoted key should count as just read")
+	}
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// a small tracer. spans are started from a context, so they nest,
+// and the trace is carried to other nodes in a W3C traceparent
+// header. finished spans are batched up and sent to an OTLP/HTTP
+// collector or written to a file.
+type span struct {
+	TraceID  string            `json:"trace_id"`
+	SpanID   string            `json:"span_id"`
+	ParentID string            `json:"parent_id,omitempty"`
+	Name     string            `json:"name"`
+	Kind     string            `json:"kind"`
+	Start    time.Time         `json:"start"`
+	End      time.Time         `json:"end"`
+	Attrs    map[string]string `json:"attributes,omitempty"`
+	Error    string            `json:"error,omitempty"`
+
+	mu     sync.Mutex
+	tracer *tracer
+}
+
+const (
+	spanInternal = "internal"
+	spanServer   = "server"
+	spanClient   = "client"
+)
+
+// where in a trace a context is
+type spanContext struct {
+	TraceID string
+	SpanID  string
+}
+
+type spanContextKey struct{}
+
+type spanExporter interface {
+	Export([]*span) error
+}
+
+type tracer struct {
+	exporter spanExporter
+	node     string
+
+	mu      sync.Mutex
+	pending []*span
+}
+
+// nil when tracing is turned off. spans are nil then too, and
+// everything on them does nothing
+var activeTracer atomic.Pointer[tracer]
+
+// flush once this many spans are waiting
+const traceBatchSize = 256
+
+func newTracer(exporter spanExporter, node string) *tracer {
+	return &tracer{exporter: exporter, node: node}
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func startSpan(ctx context.Context, name string) (context.Context, *span) {
+	return startSpanKind(ctx, name, spanInternal)
+}
+
+func startSpanKind(ctx context.Context, name, kind string) (context.Context, *span) {
+	t := activeTracer.Load()
+	if t == nil {
+		return ctx, nil
+	}
+	sp := &span{
+		SpanID: randomHex(8),
+		Name:   name,
+		Kind:   kind,
+		Start:  time.Now(),
+		Attrs:  map[string]string{"cask.node": t.node},
+		tracer: t,
+	}
+	if parent, ok := ctx.Value(spanContextKey{}).(spanContext); ok {
+		sp.TraceID = parent.TraceID
+		sp.ParentID = parent.SpanID
+	} else {
+		sp.TraceID = randomHex(16)
+	}
+	return context.WithValue(ctx, spanContextKey{}, spanContext{sp.TraceID, sp.SpanID}), sp
+}
+
+func (sp *span) SetAttr(k, v string) {
+	if sp == nil {
+		return
+	}
+	sp.mu.Lock()
+	sp.Attrs[k] = v
+	sp.mu.Unlock()
+}
+
+// ends the span, marking it failed if there was an error
+func (sp *span) Finish(err error) {
+	if sp == nil {
+		return
+	}
+	sp.mu.Lock()
+	sp.End = time.Now()
+	if err != nil {
+		sp.Error = err.Error()
+	}
+	sp.mu.Unlock()
+	sp.tracer.record(sp)
+}
+
+func (t *tracer) record(sp *span) {
+	t.mu.Lock()
+	t.pending = append(t.pending, sp)
+	full := len(t.pending) >= traceBatchSize
+	t.mu.Unlock()
+	if full {
+		go t.Flush()
+	}
+}
+
+func (t *tracer) Flush() {
+	t.mu.Lock()
+	batch := t.pending
+	t.pending = nil
+	t.mu.Unlock()
+	if len(batch) == 0 {
+		return
+	}
+	if err := t.exporter.Export(batch); err != nil {
+		slog.Warn("couldn't export spans", "spans", len(batch), "op", "tracing", "err", err)
+	}
+}
+
+func (t *tracer) FlushEvery(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		t.Flush()
+	}
+}
+
+// traceparent is version-traceid-spanid-flags
+func injectTrace(ctx context.Context, req *http.Request) {
+	if sc, ok := ctx.Value(spanContextKey{}).(spanContext); ok {
+		req.Header.Set("traceparent", "00-"+sc.TraceID+"-"+sc.SpanID+"-01")
+	}
+}
+
+func extractTrace(r *http.Request) context.Context {
+	ctx := r.Context()
+	parts := strings.Split(r.Header.Get("traceparent"), "-")
+	if len(parts) != 4 || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return ctx
+	}
+	if _, err := hex.DecodeString(parts[1] + parts[2]); err != nil {
+		return ctx
+	}
+	return context.WithValue(ctx, spanContextKey{}, spanContext{parts[1], parts[2]})
+}
+
+// writes spans to a file, one JSON object per line
+type fileExporter struct {
+	path string
+	mu   sync.Mutex
+}
+
+func (e *fileExporter) Export(spans []*span) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	f, err := os.OpenFile(e.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	enc := json.NewEncoder(f)
+	for _, sp := range spans {
+		if err := enc.Encode(sp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sends spans to an OpenTelemetry collector, using the JSON
+// encoding of OTLP over HTTP
+type otlpExporter struct {
+	endpoint string
+	client   http.Client
+}
+
+func newOTLPExporter(endpoint string) *otlpExporter {
+	return &otlpExporter{
+		endpoint: strings.TrimSuffix(endpoint, "/") + "/v1/traces",
+		client:   http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+type otlpAttr struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue string `json:"stringValue"`
+	} `json:"value"`
+}
+
+type otlpSpan struct {
+	TraceID      string     `json:"traceId"`
+	SpanID       string     `json:"spanId"`
+	ParentSpanID string     `json:"parentSpanId,omitempty"`
+	Name         string     `json:"name"`
+	Kind         int        `json:"kind"`
+	Start        string     `json:"startTimeUnixNano"`
+	End          string     `json:"endTimeUnixNano"`
+	Attributes   []otlpAttr `json:"attributes"`
+	Status       struct {
+		Code    int    `json:"code"`
+		Message string `json:"message,omitempty"`
+	} `json:"status"`
+}
+
+func attr(k, v string) otlpAttr {
+	a := otlpAttr{Key: k}
+	a.Value.StringValue = v
+	return a
+}
+
+var otlpKinds = map[string]int{spanInternal: 1, spanServer: 2, spanClient: 3}
+
+func (e *otlpExporter) body(spans []*span) ([]byte, error) {
+	var out []otlpSpan
+	for _, sp := range spans {
+		o := otlpSpan{
+			TraceID:      sp.TraceID,
+			SpanID:       sp.SpanID,
+			ParentSpanID: sp.ParentID,
+			Name:         sp.Name,
+			Kind:         otlpKinds[sp.Kind],
+			Start:        strconv.FormatInt(sp.Start.UnixNano(), 10),
+			End:          strconv.FormatInt(sp.End.UnixNano(), 10),
+		}
+		for k, v := range sp.Attrs {
+			o.Attributes = append(o.Attributes, attr(k, v))
+		}
+		if sp.Error != "" {
+			// STATUS_CODE_ERROR
+			o.Status.Code = 2
+			o.Status.Message = sp.Error
+		}
+		out = append(out, o)
+	}
+	req := map[string]any{
+		"resourceSpans": []any{map[string]any{
+			"resource": map[string]any{
+				"attributes": []otlpAttr{attr("service.name", "cask")},
+			},
+			"scopeSpans": []any{map[string]any{
+				"scope": map[string]string{"name": "cask"},
+				"spans": out,
+			}},
+		}},
+	}
+	return json.Marshal(req)
+}
+
+func (e *otlpExporter) Export(spans []*span) error {
+	b, err := e.body(spans)
+	if err != nil {
+		return err
+	}
+	resp, err := e.client.Post(e.endpoint, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("collector said %s", resp.Status)
+	}
+	return nil
+}
+
+var errUnknownExporter = errors.New("trace exporter has to be otlp or file")
+
+func setupTracing(exporter, endpoint, file, node string) error {
+	var e spanExporter
+	switch exporter {
+	case "":
+		return nil
+	case "otlp":
+		if endpoint == "" {
+			endpoint = "http://localhost:4318"
+		}
+		e = newOTLPExporter(endpoint)
+	case "file":
+		if file == "" {
+			file = "cask-traces.json"
+		}
+		e = &fileExporter{path: file}
+	default:
+		return errUnknownExporter
+	}
+	t := newTracer(e, node)
+	activeTracer.Store(t)
+	go t.FlushEvery(5 * time.Second)
+	return nil
+}
+
+// a span for reading from or writing to the backend
+func backendSpan(ctx context.Context, op string, b backend, k key) *span {
+	_, sp := startSpan(ctx, "backend "+op)
+	sp.SetAttr("cask.backend", b.String())
+	sp.SetAttr("cask.key", k.String())
+	return sp
+}
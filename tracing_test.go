@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type recordingExporter struct {
+	mu    sync.Mutex
+	spans []*span
+}
+
+func (e *recordingExporter) Export(spans []*span) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.spans = append(e.spans, spans...)
+	return nil
+}
+
+func testTracer(t *testing.T, e spanExporter) *tracer {
+	tr := newTracer(e, "test")
+	activeTracer.Store(tr)
+	t.Cleanup(func() { activeTracer.Store(nil) })
+	return tr
+}
+
+func TestTracePropagatesToPeers(t *testing.T) {
+	e := &recordingExporter{}
+	tr := testTracer(t, e)
+	peer := newMemoryBackend(1000)
+	k := memoryWrite(t, peer, "traced")
+	n := newNode("peer", memoryPeer(t, peer).URL, true)
+
+	ctx, root := startSpan(context.Background(), "test")
+	if _, err := n.RetrieveContext(ctx, k, "secret"); err != nil {
+		t.Fatal(err)
+	}
+	root.Finish(nil)
+	tr.Flush()
+
+	byName := make(map[string]*span)
+	for _, sp := range e.spans {
+		byName[sp.Name] = sp
+		if sp.TraceID != root.TraceID {
+			t.Errorf("%s is in a different trace", sp.Name)
+		}
+	}
+	client, server, read := byName["peer retrieve"], byName["GET /local/{key}/"], byName["backend read"]
+	if client == nil || server == nil || read == nil {
+		t.Fatalf("missing spans: %v", byName)
+	}
+	if client.ParentID != root.SpanID || server.ParentID != client.SpanID || read.ParentID != server.SpanID {
+		t.Errorf("spans aren't nested right")
+	}
+	if client.Attrs["cask.peer"] != "peer" || server.Attrs["http.status_code"] != "200" {
+		t.Errorf("unexpected attributes: %v %v", client.Attrs, server.Attrs)
+	}
+}
+
+func TestTracingOff(t *testing.T) {
+	ctx, sp := startSpan(context.Background(), "nothing")
+	sp.SetAttr("a", "b")
+	sp.Finish(nil)
+	req := httptest.NewRequest("GET", "/", nil)
+	injectTrace(ctx, req)
+	if sp != nil || req.Header.Get("traceparent") != "" {
+		t.Errorf("shouldn't trace anything when it's turned off")
+	}
+}
+
+func TestFileExporter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "traces.json")
+	tr := testTracer(t, &fileExporter{path: path})
+	_, sp := startSpan(context.Background(), "one")
+	sp.Finish(io.EOF)
+	_, sp = startSpan(context.Background(), "two")
+	sp.Finish(nil)
+	tr.Flush()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var names []string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var s span
+		if err := json.Unmarshal(sc.Bytes(), &s); err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, s.Name)
+		if s.Name == "one" && s.Error != "EOF" {
+			t.Errorf("error wasn't recorded: %q", s.Error)
+		}
+	}
+	if strings.Join(names, ",") != "one,two" {
+		t.Errorf("unexpected spans: %v", names)
+	}
+}
+
+func TestOTLPExporter(t *testing.T) {
+	var body map[string]any
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/json" {
+			http.Error(w, "wrong", 400)
+			return
+		}
+		_ = json.NewDecoder(r.Body).Decode(&body)
+	}))
+	defer collector.Close()
+	tr := testTracer(t, newOTLPExporter(collector.URL))
+	_, sp := startSpanKind(context.Background(), "exported", spanServer)
+	sp.Finish(nil)
+	tr.Flush()
+
+	rs, _ := body["resourceSpans"].([]any)
+	if len(rs) != 1 {
+		t.Fatalf("unexpected body: %v", body)
+	}
+	spans := rs[0].(map[string]any)["scopeSpans"].([]any)[0].(map[string]any)["spans"].([]any)
+	got := spans[0].(map[string]any)
+	if got["name"] != "exported" || got["traceId"] != sp.TraceID || got["kind"] != float64(2) {
+		t.Errorf("unexpected span: %v", got)
+	}
+}
@@ -1,20 +1,25 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"crypto/sha1"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	"strings"
+	"sync"
 	"text/template"
+	"time"
 )
 
 func localPostFormHandler(w http.ResponseWriter, r *http.Request, s *site) {
 	secret := r.Header.Get("X-Cask-Cluster-Secret")
 	if !s.Cluster.CheckSecret(secret) {
-		log.Println("unauthorized local file request")
+		logger(r.Context()).Warn("unauthorized local file request", "op", "local")
 		http.Error(w, "sorry, need the secret knock", http.StatusForbidden)
 		return
 	}
@@ -26,12 +31,13 @@ func localPostFormHandler(w http.ResponseWriter, r *http.Request, s *site) {
 func localHandler(w http.ResponseWriter, r *http.Request, s *site) {
 	secret := r.Header.Get("X-Cask-Cluster-Secret")
 	if !s.Cluster.CheckSecret(secret) {
-		log.Println("unauthorized local file request")
+		logger(r.Context()).Warn("unauthorized local file request", "op", "local")
 		http.Error(w, "sorry, need the secret knock", http.StatusForbidden)
 		return
 	}
 	key := r.PathValue("key")
-	log.Printf("/local/%s/\n", key)
+	l := logger(r.Context()).With("key", key, "op", "local_read")
+	l.Debug("local read")
 	k, err := keyFromString(key)
 	if err != nil {
 		http.Error(w, "invalid key\n", 400)
@@ -51,15 +57,24 @@ func localHandler(w http.ResponseWriter, r *http.Request, s *site) {
 	if r.Method == "HEAD" {
 		w.Header().Set("Content-Type", "application/octet")
 		w.Header().Set("ETag", "\""+key+"\"")
+		if s.Tiering != nil {
+			// lets the key's first owner tell whether it's gone cold here
+			if t, ok := s.Tiering.access.LastAccess(*k); ok {
+				w.Header().Set("X-Cask-Last-Read", t.Format(time.RFC3339Nano))
+			}
+		}
 		return
 	}
 
+	sp := backendSpan(r.Context(), "read", s.Backend, *k)
 	data, err := s.Backend.Read(*k)
+	sp.Finish(err)
 	if err != nil {
-		log.Println(err)
+		l.Error("couldn't read file", "err", err)
 		http.Error(w, "error reading file", 500)
 		return
 	}
+	s.recordAccess(*k)
 	w.Header().Set("Content-Type", "application/octet")
 	w.Header().Set("ETag", "\""+key+"\"")
 	_, _ = w.Write(data)
@@ -68,7 +83,7 @@ func localHandler(w http.ResponseWriter, r *http.Request, s *site) {
 func handleLocalPost(w http.ResponseWriter, r *http.Request, s *site) {
 	secret := r.Header.Get("X-Cask-Cluster-Secret")
 	if !s.Cluster.CheckSecret(secret) {
-		log.Println("unauthorized local file request")
+		logger(r.Context()).Warn("unauthorized local file request", "op", "local")
 		http.Error(w, "sorry, need the secret knock", http.StatusForbidden)
 		return
 	}
@@ -78,39 +93,79 @@ func handleLocalPost(w http.ResponseWriter, r *http.Request, s *site) {
 		return
 	}
 
-	log.Println("write a file")
-	if !s.Node.Writeable {
+	l := logger(r.Context()).With("op", "local_write")
+	self := s.self()
+	if !self.Writeable {
 		http.Error(w, "this node is read-only", http.StatusServiceUnavailable)
 		return
 	}
+	if self.Draining {
+		http.Error(w, "this node is draining", http.StatusServiceUnavailable)
+		return
+	}
 	f, _, _ := r.FormFile("file")
 	defer f.Close()
+	_, sp := startSpan(r.Context(), "hash")
 	h := sha1.New()
 	_, _ = io.Copy(h, f)
+	sp.Finish(nil)
 	key, err := keyFromString("sha1:" + fmt.Sprintf("%x", h.Sum(nil)))
 	if err != nil {
 		http.Error(w, "bad hash", 500)
 		return
 	}
+	l = l.With("key", key.String())
 	if s.Backend.Exists(*key) {
-		log.Println("already exists, don't need to do anything")
+		l.Debug("already exists, don't need to do anything")
+		recordEvent(eventUploaded, *key, "", uploadDetail(r)+", already had it")
+		recordHint(r, s, *key)
 		fmt.Fprintf(w, "%s", key.String())
 		return
 	}
 	_, _ = f.Seek(0, 0)
+	sp = backendSpan(r.Context(), "write", s.Backend, *key)
 	err = s.Backend.Write(*key, f)
+	sp.Finish(err)
 	if err != nil {
+		l.Error("couldn't write file", "err", err)
 		http.Error(w, "could not write file", 500)
 		return
 	}
+	l.Info("wrote file")
+	recordEvent(eventUploaded, *key, "", uploadDetail(r))
+	recordHint(r, s, *key)
+	// a fresh copy shouldn't go cold straight away
+	s.recordAccess(*key)
 	fmt.Fprintf(w, "%s", key.String())
 }
 
+// where an upload came from, for the event journal
+func uploadDetail(r *http.Request) string {
+	detail := "from " + r.RemoteAddr
+	if target := r.Header.Get("X-Cask-Hint-For"); target != "" {
+		detail += ", held for " + target
+	}
+	return detail
+}
+
+// we're holding this file for a node that was down. remember
+// that so it can be handed off when it comes back
+func recordHint(r *http.Request, s *site, key key) {
+	target := r.Header.Get("X-Cask-Hint-For")
+	if target == "" || s.Cluster.handoff == nil || target == s.Node.UUID {
+		return
+	}
+	logger(r.Context()).Info("holding file for a node that's down", "key", key.String(),
+		"peer", target, "op", "hint")
+	s.Cluster.handoff.store.Add(target, key)
+}
+
 
 
 func fileHandler(w http.ResponseWriter, r *http.Request, s *site) {
 	key := r.PathValue("key")
-	log.Printf("/file/%s/\n", key)
+	l := logger(r.Context()).With("key", key, "op", "read")
+	l.Debug("file read")
 	k, err := keyFromString(key)
 	if err != nil {
 		http.Error(w, "invalid key\n", 400)
@@ -123,28 +178,45 @@ func fileHandler(w http.ResponseWriter, r *http.Request, s *site) {
 		}
 	}
 	if s.Backend.Exists(*k) {
+		sp := backendSpan(r.Context(), "read", s.Backend, *k)
 		data, err := s.Backend.Read(*k)
+		sp.Finish(err)
 		if err != nil {
-			log.Println(err)
+			l.Error("couldn't read file", "err", err)
 			http.Error(w, "error reading file", 500)
 			return
 		}
+		s.recordAccess(*k)
 		w.Header().Set("Content-Type", "application/octet")
 		w.Header().Set("ETag", "\""+key+"\"")
 		_, _ = w.Write(data)
 		// kick off a background goroutine to do read-repair
+		ctx := context.WithoutCancel(r.Context())
 		go func() {
-			_ = s.VerifyKey(*k)
-			_ = s.Rebalance(*k)
+			_ = s.VerifyKeyContext(ctx, *k)
+			if !cachesReads(s.Backend) {
+				_ = s.RebalanceContext(ctx, *k)
+			}
 		}()
 		return
 	}
 
-	data, err := s.Cluster.Retrieve(*k)
+	data, err := s.Cluster.RetrieveContext(r.Context(), *k)
 	if err != nil {
 		http.Error(w, "not found", 404)
 		return
 	}
+	if cachesReads(s.Backend) && fmt.Sprintf("sha1:%x", sha1.Sum(data)) == key {
+		// hang on to it for next time
+		sp := backendSpan(r.Context(), "write", s.Backend, *k)
+		err := s.Backend.Write(*k, io.NopCloser(bytes.NewReader(data)))
+		sp.Finish(err)
+		if err != nil {
+			l.Warn("couldn't cache file", "err", err)
+		}
+	} else if s.Tiering.enabled() && s.Tiering.PromoteOnRead && s.self().class() == hotClass {
+		go s.promote(*k, data)
+	}
 	w.Header().Set("ETag", "\""+key+"\"")
 	_, _ = w.Write(data)
 }
@@ -156,16 +228,22 @@ type clusterInfoPage struct {
 	Neighbors []node
 	Site      *site
 	FreeSpace uint64
+	Index     *indexStats
 }
 
 func clusterInfoHandler(w http.ResponseWriter, r *http.Request, s *site) {
+	self := s.self()
 	p := clusterInfoPage{
 		Title:     "cluster status",
 		Cluster:   s.Cluster,
-		Myself:    s.Node,
+		Myself:    &self,
 		Neighbors: s.Cluster.NeighborsInclusive(),
 		Site:      s,
 	}
+	if x, ok := s.Backend.(indexer); ok {
+		st := x.IndexStats()
+		p.Index = &st
+	}
 	t, _ := template.New("cluster").Parse(clusterTemplate)
 	_ = t.Execute(w, p)
 }
@@ -179,7 +257,7 @@ type postResponse struct {
 }
 
 func postFileHandler(w http.ResponseWriter, r *http.Request, s *site) {
-	log.Println("add a file")
+	l := logger(r.Context()).With("op", "add_file")
 
 	if r.ContentLength > s.MaxUploadSize {
 		http.Error(w, "file too large", http.StatusRequestEntityTooLarge)
@@ -187,16 +265,19 @@ func postFileHandler(w http.ResponseWriter, r *http.Request, s *site) {
 	}
 	f, _, _ := r.FormFile("file")
 	defer f.Close()
+	_, sp := startSpan(r.Context(), "hash")
 	h := sha1.New()
 	_, _ = io.Copy(h, f)
+	sp.Finish(nil)
 	key, err := keyFromString("sha1:" + fmt.Sprintf("%x", h.Sum(nil)))
 	if err != nil {
-		log.Println(err)
+		l.Error("bad hash", "err", err)
 		http.Error(w, "bad hash", 500)
 		return
 	}
 	_, _ = f.Seek(0, 0)
-	success := s.Cluster.AddFile(*key, f, defaultReplication, minReplication)
+	success := s.Cluster.AddFileContext(r.Context(), *key, f, defaultReplication, minReplication)
+	l.Info("added file", "key", key.String(), "success", success)
 	pr := postResponse{
 		Key:     key.String(),
 		Success: success,
@@ -221,8 +302,7 @@ func joinHandler(w http.ResponseWriter, r *http.Request, s *site) {
 	u := r.FormValue("url")
 	secret := r.FormValue("secret")
 	if !s.Cluster.CheckSecret(secret) {
-		log.Println("got an unauthorized join attempt")
-		log.Println(secret)
+		logger(r.Context()).Warn("got an unauthorized join attempt", "peer", u, "op", "join")
 		http.Error(w, "need to know the secret knock", http.StatusForbidden)
 		return
 	}
@@ -240,20 +320,286 @@ func uploadFormHandler(w http.ResponseWriter, r *http.Request, s *site) {
 }
 
 type logPage struct {
-	Logs []string
+	Logs      []logRecord
+	Level     string
+	Key       string
+	RequestID string
+}
+
+// /log/?level=warn&key=sha1:...&request_id=...
+// level is the lowest level to show
+func parseLogFilter(r *http.Request) (logFilter, error) {
+	q := r.URL.Query()
+	f := logFilter{Level: slog.LevelDebug, Key: q.Get("key"), RequestID: q.Get("request_id")}
+	if level := q.Get("level"); level != "" {
+		if err := f.Level.UnmarshalText([]byte(level)); err != nil {
+			return f, err
+		}
+	}
+	return f, nil
 }
 
 func logHandler(w http.ResponseWriter, r *http.Request, s *site) {
-	logs := s.LogCache.GetLogs()
-	p := logPage{Logs: logs}
+	f, err := parseLogFilter(r)
+	if err != nil {
+		http.Error(w, "bad level", http.StatusBadRequest)
+		return
+	}
+	q := r.URL.Query()
+	p := logPage{
+		Logs:      s.LogCache.Records(f),
+		Level:     q.Get("level"),
+		Key:       f.Key,
+		RequestID: f.RequestID,
+	}
 	t, _ := template.New("log").Parse(logTemplate)
 	_ = t.Execute(w, p)
 }
 
 func configHandler(w http.ResponseWriter, r *http.Request, s *site) {
-	b, err := json.Marshal(s.Node)
+	b, err := json.Marshal(s.self())
+	if err != nil {
+		logger(r.Context()).Error("couldn't encode config", "op", "config", "err", err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(b)
+}
+
+// GET shows drain progress, POST starts draining the node
+// and DELETE cancels it
+func drainHandler(w http.ResponseWriter, r *http.Request, s *site) {
+	if r.Method != "GET" {
+		secret := r.Header.Get("X-Cask-Cluster-Secret")
+		if !s.Cluster.CheckSecret(secret) {
+			logger(r.Context()).Warn("unauthorized drain request", "op", "drain")
+			http.Error(w, "sorry, need the secret knock", http.StatusForbidden)
+			return
+		}
+	}
+	switch r.Method {
+	case "POST":
+		s.drainer.Start()
+	case "DELETE":
+		s.drainer.Cancel()
+	}
+	b, err := json.Marshal(s.drainer.Status())
+	if err != nil {
+		http.Error(w, "json error", 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(b)
+}
+
+type ringEntryInfo struct {
+	Hash    string `json:"hash"`
+	UUID    string `json:"uuid"`
+	BaseURL string `json:"base_url"`
+}
+
+type ringInfo struct {
+	Version uint64          `json:"version"`
+	Entries []ringEntryInfo `json:"entries"`
+}
+
+// the full virtual node ring
+func ringHandler(w http.ResponseWriter, r *http.Request, s *site) {
+	rings, version := s.Cluster.currentRing()
+	ri := ringInfo{Version: version, Entries: make([]ringEntryInfo, len(rings.all))}
+	for i, e := range rings.all {
+		ri.Entries[i] = ringEntryInfo{Hash: e.Hash, UUID: e.Node.UUID, BaseURL: e.Node.BaseURL}
+	}
+	b, err := json.Marshal(ri)
+	if err != nil {
+		http.Error(w, "json error", 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(b)
+}
+
+type keyHolder struct {
+	UUID      string `json:"uuid"`
+	BaseURL   string `json:"base_url"`
+	HasKey    bool   `json:"has_key"`
+	Writeable bool   `json:"writeable"`
+	Healthy   bool   `json:"healthy"`
+	Error     string `json:"error,omitempty"`
+}
+
+type keyPlacement struct {
+	Key        string      `json:"key"`
+	ReadOrder  []string    `json:"read_order"`
+	WriteOrder []string    `json:"write_order"`
+	Holders    []keyHolder `json:"holders"`
+}
+
+func nodeUUIDs(nodes []node) []string {
+	uuids := []string{}
+	for _, n := range nodes {
+		if n.UUID != "" {
+			uuids = append(uuids, n.UUID)
+		}
+	}
+	return uuids
+}
+
+// which nodes should have a key, and which actually do
+func ringKeyHandler(w http.ResponseWriter, r *http.Request, s *site) {
+	k, err := keyFromString(r.PathValue("key"))
+	if err != nil {
+		http.Error(w, "invalid key\n", 400)
+		return
+	}
+	readOrder := s.Cluster.ReadOrder(k.String())
+	p := keyPlacement{
+		Key:        k.String(),
+		ReadOrder:  nodeUUIDs(readOrder),
+		WriteOrder: nodeUUIDs(s.Cluster.WriteOrder(k.String())),
+	}
+
+	// the read order has every node in it. ask them all at once
+	var wg sync.WaitGroup
+	holders := make([]keyHolder, len(readOrder))
+	for i, n := range readOrder {
+		if n.UUID == "" {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, n node) {
+			defer wg.Done()
+			h := keyHolder{
+				UUID:      n.UUID,
+				BaseURL:   n.BaseURL,
+				Writeable: n.Writeable,
+				Healthy:   !n.Unhealthy(),
+			}
+			if n.UUID == s.Cluster.Myself.UUID {
+				h.HasKey = s.Backend.Exists(*k)
+			} else {
+				found, err := n.RetrieveInfo(*k, s.ClusterSecret)
+				h.HasKey = found
+				if err != nil && !errors.Is(err, errNotFound) {
+					h.Error = err.Error()
+				}
+			}
+			holders[i] = h
+		}(i, n)
+	}
+	wg.Wait()
+	for _, h := range holders {
+		if h.UUID != "" {
+			p.Holders = append(p.Holders, h)
+		}
+	}
+
+	b, err := json.Marshal(p)
+	if err != nil {
+		http.Error(w, "json error", 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(b)
+}
+
+// show how data would move around the cluster if node
+// weights were changed. eg, /ring/dryrun/?weights=<uuid>:2,<uuid>:0.5
+func ringDryRunHandler(w http.ResponseWriter, r *http.Request, s *site) {
+	weights, err := parseWeights(r.FormValue("weights"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	m, err := s.Cluster.WeightChangeDryRun(weights, s.Replication)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		http.Error(w, "json error", 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(b)
+}
+
+// the keys stored on this node, with their sizes, in order.
+// eg, /local/keys/?after=<key>&limit=1000. without a limit, it
+// streams all of them
+func localKeysHandler(w http.ResponseWriter, r *http.Request, s *site) {
+	secret := r.Header.Get("X-Cask-Cluster-Secret")
+	if !s.Cluster.CheckSecret(secret) {
+		logger(r.Context()).Warn("unauthorized key listing request", "op", "list_keys")
+		http.Error(w, "sorry, need the secret knock", http.StatusForbidden)
+		return
+	}
+	after, limit, err := parseListParams(r)
 	if err != nil {
-		log.Println(err)
+		http.Error(w, "invalid after or limit", http.StatusBadRequest)
+		return
+	}
+	lw := newListingWriter(w)
+	if err := streamLocalKeys(lw, s.Backend, after, limit); err != nil {
+		logger(r.Context()).Error("error listing keys", "op", "list_keys", "err", err)
+		if lw.count == 0 {
+			http.Error(w, "couldn't list keys", 500)
+			return
+		}
+		// too late to change the status
+		_ = lw.Fail(&incompleteListing{Msg: "couldn't list keys"})
+	}
+}
+
+// every key in the cluster, with the nodes that have it. same
+// parameters as /local/keys/
+func clusterKeysHandler(w http.ResponseWriter, r *http.Request, s *site) {
+	secret := r.Header.Get("X-Cask-Cluster-Secret")
+	if !s.Cluster.CheckSecret(secret) {
+		logger(r.Context()).Warn("unauthorized key listing request", "op", "list_keys")
+		http.Error(w, "sorry, need the secret knock", http.StatusForbidden)
+		return
+	}
+	after, limit, err := parseListParams(r)
+	if err != nil {
+		http.Error(w, "invalid after or limit", http.StatusBadRequest)
+		return
+	}
+	cursors := []*keyCursor{backendCursor(s.Node.UUID, s.Backend, after)}
+	for _, n := range s.Cluster.GetNeighbors() {
+		if n.class() == cacheClass {
+			// its copies don't count
+			continue
+		}
+		cursors = append(cursors, nodeCursor(r.Context(), n, s.ClusterSecret, after))
+	}
+	mergeKeyListings(newListingWriter(w), cursors, limit)
+}
+
+// merkle summary of the keys this node has in a range. see
+// merkle.go
+func aaeRangeHandler(w http.ResponseWriter, r *http.Request, s *site) {
+	secret := r.Header.Get("X-Cask-Cluster-Secret")
+	if !s.Cluster.CheckSecret(secret) {
+		logger(r.Context()).Warn("unauthorized range summary request", "op", "range_summary")
+		http.Error(w, "sorry, need the secret knock", http.StatusForbidden)
+		return
+	}
+	kr := keyRange{Start: r.FormValue("start"), End: r.FormValue("end")}
+	if !validRangeBound(kr.Start) || !validRangeBound(kr.End) {
+		http.Error(w, "invalid range", http.StatusBadRequest)
+		return
+	}
+	summary, err := summarizeRange(s.Backend, kr)
+	if err != nil {
+		logger(r.Context()).Error("couldn't summarize range", "range", kr.String(), "op", "range_summary", "err", err)
+		http.Error(w, "couldn't summarize range", 500)
+		return
+	}
+	b, err := json.Marshal(summary)
+	if err != nil {
+		http.Error(w, "json error", 500)
+		return
 	}
 	w.Header().Set("Content-Type", "application/json")
 	_, _ = w.Write(b)
@@ -275,11 +621,15 @@ const clusterTemplate = `
 <table class="table">
 <tr><th>Backend</th><td>{{.Site.Backend}}</td></tr>
 <tr><th>Free Space</th><td>{{.Site.Backend.FreeSpace}}</td></tr>
+{{if .Index}}<tr><th>Keys</th><td>{{.Index.Keys}} ({{.Index.Bytes}} bytes)</td></tr>
+<tr><th>Unverified Keys</th><td>{{.Index.Unverified}}</td></tr>{{end}}
 <tr><th>Base</th><td>{{.Myself.BaseURL}}</td></tr>
 <tr><th>Writeable</th><td>{{.Myself.Writeable}}</td></tr>
+{{if .Myself.Draining}}<tr><th>Draining</th><td><a href="/drain/">yes</a></td></tr>{{end}}
 <tr><th>Replication</th><td>{{.Site.Replication}}</td></tr>
 <tr><th>Max Replication</th><td>{{.Site.MaxReplication}}</td></tr>
 <tr><th>Active Anti-Entropy Interval</th><td>{{.Site.AAEInterval}} seconds</td></tr>
+<tr><th>Ring Version</th><td>{{.Cluster.RingVersion}}</td></tr>
 </table>
 <h2>cluster status</h2>
 <table class="table table-condensed table-striped">
@@ -296,7 +646,7 @@ const clusterTemplate = `
 <tr {{if .Unhealthy}}class="danger"{{end}}>
 <td>{{.UUID}}</td>
 <td><a href="{{.BaseURL}}">{{.BaseURL}}</a></td>
-<td>{{if .Writeable}}<span class="text-success">yes</span>{{else}}<span class="text-danger">read-only</span>{{end}}</td>
+<td>{{if .Draining}}<span class="text-warning">draining</span>{{else if .Writeable}}<span class="text-success">yes</span>{{else}}<span class="text-danger">read-only</span>{{end}}</td>
 <td>{{.LastSeenFormatted}}</td>
 <td>{{if .LastFailed.IsZero}}-{{else}}{{.LastFailedFormatted}}{{end}}</td>
 </tr>
@@ -340,9 +690,20 @@ const logTemplate = `
 <body>
 <div class="container">
 <h1>Recent Logs</h1>
+<form action="/log/" method="get" class="form-inline">
+<select name="level" class="form-control">
+<option value="">all levels</option>
+<option value="info" {{if eq .Level "info"}}selected{{end}}>info and up</option>
+<option value="warn" {{if eq .Level "warn"}}selected{{end}}>warn and up</option>
+<option value="error" {{if eq .Level "error"}}selected{{end}}>error</option>
+</select>
+<input type="text" name="key" value="{{html .Key}}" placeholder="key" class="form-control" />
+<input type="text" name="request_id" value="{{html .RequestID}}" placeholder="request id" class="form-control" />
+<input type="submit" value="filter" class="btn btn-default" />
+</form>
 <ul class="list-group">
 {{range .Logs}}
-<li class="list-group-item"><tt>{{.}}</tt></li>
+<li class="list-group-item"><tt>{{.Time.Format "2006-01-02 15:04:05"}} {{.Level}} {{html .}}</tt></li>
 {{end}}
 </ul>
 </div>
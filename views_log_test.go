@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"log/slog"
 	"net/http"
 	"net/http/httptest"
 	"strings"
@@ -35,3 +36,24 @@ func TestLogHandler(t *testing.T) {
 	}
 }
 
+func TestLogHandlerFilter(t *testing.T) {
+	lc := newLogCache(10)
+	l := slog.New(lc.Handler(slog.LevelDebug))
+	l.Info("one request", "request_id", "aaa")
+	l.Info("another request", "request_id", "bbb")
+	l.Error("<b>oops</b>", "request_id", "aaa")
+	s := &site{LogCache: lc}
+
+	rr := httptest.NewRecorder()
+	logHandler(rr, httptest.NewRequest("GET", "/log/?request_id=aaa&level=error", nil), s)
+	body := rr.Body.String()
+	if !strings.Contains(body, "&lt;b&gt;oops") || strings.Contains(body, "one request") || strings.Contains(body, "another request") {
+		t.Errorf("filter wasn't applied: %s", body)
+	}
+
+	rr = httptest.NewRecorder()
+	logHandler(rr, httptest.NewRequest("GET", "/log/?level=loud", nil), s)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("got status %d for a bad level", rr.Code)
+	}
+}
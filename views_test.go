@@ -371,6 +371,28 @@ func Test_configHandler(t *testing.T) {
 	}
 }
 
+// run with -race. the free space watcher changes the node while
+// requests are reading it
+func Test_configHandlerWhileUpdating(t *testing.T) {
+	n := newNode("testuuid", "http://localhost:1000", true)
+	s := &site{Node: n, Cluster: newCluster(n, "secret", 60)}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			s.Cluster.UpdateSelf(func(n *node) { n.FreeSpace = uint64(i) })
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		rr := httptest.NewRecorder()
+		configHandler(rr, httptest.NewRequest("GET", "/config/", nil), s)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("got status %d", rr.Code)
+		}
+	}
+	<-done
+}
+
 func Test_postFileHandler_Success(t *testing.T) {
 	n := newNode("testuuid", "http://localhost:1000", true)
 	c := newCluster(n, "secret", 60)
@@ -417,4 +439,78 @@ func Test_faviconHandler(t *testing.T) {
 	if rr.Code != http.StatusOK {
 		t.Errorf("got status %d, want %d", rr.Code, http.StatusOK)
 	}
-}
\ No newline at end of file
+}
+func Test_ringHandler(t *testing.T) {
+	n := newNode("testuuid", "http://localhost:1000", true)
+	c := newCluster(n, "secret", 60)
+	c.AddNeighbor(*newNode("testuuid2", "http://localhost:1001", true))
+	s := &site{Node: n, Cluster: c}
+
+	req := httptest.NewRequest("GET", "/ring/", nil)
+	rr := httptest.NewRecorder()
+	ringHandler(rr, req, s)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", rr.Code, http.StatusOK)
+	}
+	var ri ringInfo
+	if err := json.Unmarshal(rr.Body.Bytes(), &ri); err != nil {
+		t.Fatal(err)
+	}
+	if len(ri.Entries) != 2*replicas {
+		t.Errorf("expected %d entries, got %d", 2*replicas, len(ri.Entries))
+	}
+	if ri.Version == 0 {
+		t.Error("expected a ring version")
+	}
+}
+
+func Test_ringKeyHandler(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	n := newNode("testuuid", "http://localhost:1000", true)
+	c := newCluster(n, "secret", 60)
+	c.AddNeighbor(*newNode("neighbor", ts.URL, true))
+	c.AddNeighbor(*newNode("down", "http://127.0.0.1:1", false))
+	mb := &MockBackendFull{}
+	s := &site{Node: n, Cluster: c, Backend: mb, ClusterSecret: "secret"}
+
+	key := "sha1:da39a3ee5e6b4b0d3255bfef95601890afd80709"
+	req := httptest.NewRequest("GET", "/ring/"+key+"/", nil)
+	req.SetPathValue("key", key)
+	rr := httptest.NewRecorder()
+	ringKeyHandler(rr, req, s)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", rr.Code, http.StatusOK)
+	}
+	var p keyPlacement
+	if err := json.Unmarshal(rr.Body.Bytes(), &p); err != nil {
+		t.Fatal(err)
+	}
+	if len(p.ReadOrder) != 3 || len(p.WriteOrder) != 2 {
+		t.Errorf("unexpected orders: %v %v", p.ReadOrder, p.WriteOrder)
+	}
+	holders := map[string]keyHolder{}
+	for _, h := range p.Holders {
+		holders[h.UUID] = h
+	}
+	if !holders["neighbor"].HasKey {
+		t.Error("neighbor should have the key")
+	}
+	if holders["testuuid"].HasKey {
+		t.Error("we don't have the key")
+	}
+	if holders["down"].HasKey || holders["down"].Error == "" {
+		t.Error("expected an error from the unreachable node")
+	}
+
+	req = httptest.NewRequest("GET", "/ring/invalid/", nil)
+	req.SetPathValue("key", "invalid")
+	rr = httptest.NewRecorder()
+	ringKeyHandler(rr, req, s)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("got status %d, want %d", rr.Code, http.StatusBadRequest)
+	}
+}